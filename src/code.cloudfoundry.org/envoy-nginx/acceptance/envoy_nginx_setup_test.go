@@ -5,6 +5,8 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
+	"runtime"
 	"strings"
 
 	. "code.cloudfoundry.org/envoy-nginx/testhelpers"
@@ -19,15 +21,19 @@ const (
 	SdsC2CCredsFixture     = "../fixtures/cf_assets_envoy_config/sds-c2c-cert-and-key.yaml"
 	SdsIdValidationFixture = "../fixtures/cf_assets_envoy_config/sds-id-validation-context.yaml"
 	EnvoyFixture           = "../fixtures/cf_assets_envoy_config/envoy.yaml"
+
+	EnvoyOneListenerPerServerFixture = "../fixtures/cf_assets_envoy_config/envoy_one_listener_per_server.yaml"
 )
 
 var _ = Describe("Acceptance", func() {
 	var (
-		envoyNginxBin   string
-		binParentDir    string
-		sdsIdCredsFile  string
-		sdsC2CCredsFile string
-		cmd             *exec.Cmd
+		envoyNginxBin       string
+		binParentDir        string
+		sdsIdCredsFile      string
+		sdsC2CCredsFile     string
+		sdsIdValidationFile string
+		envoyConfigFile     string
+		cmd                 *exec.Cmd
 	)
 
 	BeforeEach(func() {
@@ -56,33 +62,153 @@ var _ = Describe("Acceptance", func() {
 		err = CopyFile(SdsC2CCredsFixture, sdsC2CCredsFile)
 		Expect(err).ToNot(HaveOccurred())
 
-		cmd = exec.Command(envoyNginxBin, "-c", EnvoyFixture, "--id-creds", sdsIdCredsFile, "--c2c-creds", sdsC2CCredsFile, "--id-validation", SdsIdValidationFixture)
+		tmp, err = os.CreateTemp("", "sdsIdValidation")
+		Expect(err).ToNot(HaveOccurred())
+		sdsIdValidationFile = tmp.Name()
+		tmp.Close()
+		err = CopyFile(SdsIdValidationFixture, sdsIdValidationFile)
+		Expect(err).ToNot(HaveOccurred())
+
+		tmp, err = os.CreateTemp("", "envoyConfig")
+		Expect(err).ToNot(HaveOccurred())
+		envoyConfigFile = tmp.Name()
+		tmp.Close()
+		err = CopyFile(EnvoyFixture, envoyConfigFile)
+		Expect(err).ToNot(HaveOccurred())
+
+		cmd = exec.Command(envoyNginxBin, "-c", envoyConfigFile, "--id-creds", sdsIdCredsFile, "--c2c-creds", sdsC2CCredsFile, "--id-validation", sdsIdValidationFile)
 	})
 
 	AfterEach(func() {
 		Expect(os.Remove(sdsIdCredsFile)).NotTo(HaveOccurred())
 		Expect(os.Remove(sdsC2CCredsFile)).NotTo(HaveOccurred())
+		Expect(os.Remove(sdsIdValidationFile)).NotTo(HaveOccurred())
+		Expect(os.Remove(envoyConfigFile)).NotTo(HaveOccurred())
 		Expect(os.RemoveAll(binParentDir)).NotTo(HaveOccurred())
 	})
 
-	Context("when nginx.exe is present in the same directory", func() {
+	Context("when run with --mode validate", func() {
+		var nginxBin string
+
+		BeforeEach(func() {
+			var err error
+			nginxBin, err = gexec.Build("code.cloudfoundry.org/envoy-nginx/fixtures/nginx")
+			Expect(err).ToNot(HaveOccurred())
+
+			cmd.Args = append(cmd.Args, "--mode", "validate", "--nginx-bin", nginxBin)
+		})
+
+		AfterEach(func() {
+			gexec.CleanupBuildArtifacts()
+		})
+
+		It("checks the config with nginx -t and exits 0", func() {
+			session, err := gexec.Start(cmd, GinkgoWriter, GinkgoWriter)
+			Expect(err).ToNot(HaveOccurred())
+
+			Eventually(session, "5s").Should(gexec.Exit(0))
+			Expect(session.Out).To(gbytes.Say("validate: sds files OK"))
+			Expect(session.Out).To(gbytes.Say(`warning: unsupported envoy config field is ignored: static_resources\.clusters\[0\]\.type`))
+			Expect(session.Out).To(gbytes.Say("validate: envoy config .* OK"))
+			Expect(session.Out).To(gbytes.Say(",-t,-p,"))
+			Expect(session.Out).To(gbytes.Say("validate: nginx -t OK"))
+			Expect(session.Out).To(gbytes.Say("configuration OK"))
+			Expect(string(session.Out.Contents())).NotTo(ContainSubstring("start nginx"))
+		})
+
+		Context("when the envoy config is incomplete", func() {
+			BeforeEach(func() {
+				Expect(os.WriteFile(envoyConfigFile, []byte("static_resources: {}"), 0644)).To(Succeed())
+			})
+
+			It("exits 1 with the reason", func() {
+				session, err := gexec.Start(cmd, GinkgoWriter, GinkgoWriter)
+				Expect(err).ToNot(HaveOccurred())
+
+				Eventually(session, "5s").Should(gexec.Exit(1))
+				Expect(session.Err).To(gbytes.Say("validation failed: generate nginx config from envoy config: "))
+			})
+		})
+
+		Context("when strict and the subject alt name matchers of the validation context are not verified", func() {
+			BeforeEach(func() {
+				cmd.Args = append(cmd.Args, "--strict")
+			})
+
+			It("exits 1 rather than accepting any cert signed by the ca", func() {
+				session, err := gexec.Start(cmd, GinkgoWriter, GinkgoWriter)
+				Expect(err).ToNot(HaveOccurred())
+
+				Eventually(session, "5s").Should(gexec.Exit(1))
+				Expect(session.Err).To(gbytes.Say("validation failed: strict: subject alt name matchers of the validation context are only verified with --verify-san"))
+			})
+		})
+	})
+
+	Context("when run with the translate subcommand", func() {
+		It("prints the nginx config", func() {
+			session, err := gexec.Start(exec.Command(envoyNginxBin, "translate", "-c", envoyConfigFile, "--concurrency", "2"), GinkgoWriter, GinkgoWriter)
+			Expect(err).ToNot(HaveOccurred())
+
+			Eventually(session, "5s").Should(gexec.Exit(0))
+			Expect(session.Out).To(gbytes.Say("worker_processes 2;"))
+			Expect(session.Out).To(gbytes.Say("listen 61001 ssl;"))
+			Expect(string(session.Out.Contents())).NotTo(ContainSubstring("envoy-nginx application"))
+		})
+	})
+
+	Context("when the nginx binary is passed with --nginx-bin", func() {
 		var (
-			args     []string
-			nginxDir string
+			nginxBin string
 			session  *gexec.Session
 		)
 
+		BeforeEach(func() {
+			var err error
+			nginxBin, err = gexec.Build("code.cloudfoundry.org/envoy-nginx/fixtures/nginx")
+			Expect(err).ToNot(HaveOccurred())
+
+			cmd.Args = append(cmd.Args, "--nginx-bin", nginxBin)
+			session, err = gexec.Start(cmd, GinkgoWriter, GinkgoWriter)
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			session.Terminate()
+			Eventually(session, "5s").Should(gexec.Exit())
+
+			gexec.CleanupBuildArtifacts()
+		})
+
+		It("starts that nginx", func() {
+			Eventually(session.Out).Should(gbytes.Say(fmt.Sprintf("start nginx: %s -p ", regexp.QuoteMeta(nginxBin))))
+			Eventually(session.Out).Should(gbytes.Say(regexp.QuoteMeta(nginxBin) + ",-p,"))
+		})
+	})
+
+	Context("when nginx is present in the same directory", func() {
+		var (
+			args         []string
+			nginxDir     string
+			nginxFixture string
+			session      *gexec.Session
+		)
+
+		BeforeEach(func() {
+			nginxFixture = "code.cloudfoundry.org/envoy-nginx/fixtures/nginx"
+		})
+
 		JustBeforeEach(func() {
-			nginxBin, err := gexec.Build("code.cloudfoundry.org/envoy-nginx/fixtures/nginx")
+			nginxBin, err := gexec.Build(nginxFixture)
 			Expect(err).ToNot(HaveOccurred())
 
-			err = os.Rename(nginxBin, filepath.Join(binParentDir, "nginx.exe"))
+			err = os.Rename(nginxBin, filepath.Join(binParentDir, nginxBinName()))
 			Expect(err).ToNot(HaveOccurred())
 
 			session, err = gexec.Start(cmd, GinkgoWriter, GinkgoWriter)
 			Expect(err).ToNot(HaveOccurred())
 
-			// The output of the "fake" nginx.exe will always have a comma
+			// The output of the "fake" nginx will always have a comma
 			Eventually(session.Out).Should(gbytes.Say(","))
 			args = strings.Split(string(session.Out.Contents()), ",")
 			Expect(len(args)).To(Equal(3))
@@ -164,9 +290,228 @@ var _ = Describe("Acceptance", func() {
 			})
 		})
 
+		Context("when the sds file is rewritten without changing the cert and key", func() {
+			It("does not reload nginx", func() {
+				err := RotateCert(SdsIdCredsFixture, sdsIdCredsFile)
+				Expect(err).ToNot(HaveOccurred())
+
+				Eventually(session.Out).Should(gbytes.Say("detected change in sdsfile"))
+				Eventually(session.Out).Should(gbytes.Say(`sds material unchanged \(version_info "0", "0", "0"\). NOOP.`))
+				Consistently(session.Out).ShouldNot(gbytes.Say("-s,reload"))
+			})
+		})
+
+		Context("when the poll watcher is selected", func() {
+			BeforeEach(func() {
+				cmd.Args = append(cmd.Args, "--watcher", "poll", "--poll-interval", "100ms")
+			})
+
+			It("rewrites the id cert and reloads nginx", func() {
+				err := RotateCert("../fixtures/cf_assets_envoy_config/sds-id-cert-and-key-rotated.yaml", sdsIdCredsFile)
+				Expect(err).ToNot(HaveOccurred())
+
+				Eventually(session.Out).Should(gbytes.Say("detected change in sdsfile"))
+				Eventually(session.Out).Should(gbytes.Say(fmt.Sprintf("-p,%s,-s,reload", strings.Replace(nginxDir, `\`, `\\`, -1))))
+
+				currentCert, err := os.ReadFile(filepath.Join(nginxDir, "id-cert.pem"))
+				Expect(err).ShouldNot(HaveOccurred())
+
+				Expect(string(currentCert)).To(ContainSubstring("<<NEW EXPECTED ID CERT 1>>"))
+			})
+		})
+
+		Context("when envoy-nginx is terminated", func() {
+			It("quits nginx and removes the nginx config dir", func() {
+				if runtime.GOOS == "windows" {
+					Skip("gexec cannot send SIGTERM on windows")
+				}
+
+				session.Terminate()
+
+				Eventually(session, "5s").Should(gexec.Exit(0))
+				Expect(session.Out).To(gbytes.Say(fmt.Sprintf("-p,%s,-s,quit", strings.Replace(nginxDir, `\`, `\\`, -1))))
+				Expect(string(session.Out.Contents())).NotTo(ContainSubstring("-s,stop"))
+				Expect(nginxDir).NotTo(BeADirectory())
+			})
+
+			Context("when nginx does not quit within the drain timeout", func() {
+				BeforeEach(func() {
+					cmd.Args = append(cmd.Args, "--drain-time-s", "0")
+				})
+
+				It("stops nginx", func() {
+					if runtime.GOOS == "windows" {
+						Skip("gexec cannot send SIGTERM on windows")
+					}
+
+					session.Terminate()
+
+					Eventually(session, "8s").Should(gexec.Exit(0))
+					Expect(session.Out).To(gbytes.Say(fmt.Sprintf("-p,%s,-s,stop", strings.Replace(nginxDir, `\`, `\\`, -1))))
+					Expect(nginxDir).NotTo(BeADirectory())
+				})
+			})
+		})
+
+		Context("when passed envoy flags", func() {
+			BeforeEach(func() {
+				cmd.Args = append(cmd.Args, "--concurrency", "2", "--log-level", "debug", "--service-cluster", "proxy", "--service-node", "sidecar")
+			})
+
+			It("configures nginx accordingly and logs the ones it ignores", func() {
+				config, err := os.ReadFile(filepath.Join(nginxDir, "conf", "nginx.conf"))
+				Expect(err).ShouldNot(HaveOccurred())
+
+				Expect(string(config)).To(ContainSubstring("worker_processes 2;"))
+				Expect(string(config)).To(ContainSubstring("error_log logs/error.log debug;"))
+				Expect(string(session.Out.Contents())).To(ContainSubstring("ignoring --service-cluster proxy as it has no nginx equivalent"))
+				Expect(string(session.Out.Contents())).To(ContainSubstring("ignoring --service-node sidecar as it has no nginx equivalent"))
+			})
+		})
+
+		Context("when the id and c2c sds files are rotated together", func() {
+			It("reloads nginx once", func() {
+				err := RotateCert("../fixtures/cf_assets_envoy_config/sds-id-cert-and-key-rotated.yaml", sdsIdCredsFile)
+				Expect(err).ToNot(HaveOccurred())
+				err = RotateCert("../fixtures/cf_assets_envoy_config/sds-c2c-cert-and-key-rotated.yaml", sdsC2CCredsFile)
+				Expect(err).ToNot(HaveOccurred())
+
+				Eventually(session.Out).Should(gbytes.Say("reload 1 for changes in"))
+				Consistently(session.Out, "1s").ShouldNot(gbytes.Say("reload 2 for changes in"))
+				Expect(strings.Count(string(session.Out.Contents()), "-s,reload")).To(Equal(1))
+			})
+		})
+
+		Context("when the rotated config fails nginx -t", func() {
+			BeforeEach(func() {
+				nginxFixture = "code.cloudfoundry.org/envoy-nginx/fixtures/bad-nginx-config"
+			})
+
+			It("keeps the previous cert and key and does not reload nginx", func() {
+				err := RotateCert("../fixtures/cf_assets_envoy_config/sds-id-cert-and-key-rotated.yaml", sdsIdCredsFile)
+				Expect(err).ToNot(HaveOccurred())
+
+				Eventually(session.Out).Should(gbytes.Say(fmt.Sprintf("-t,-p,%s", strings.Replace(filepath.Join(nginxDir, "candidate"), `\`, `\\`, -1))))
+				Eventually(session.Out).Should(gbytes.Say("keeping last good nginx config: candidate failed nginx -t"))
+				Consistently(session.Out).ShouldNot(gbytes.Say("-s,reload"))
+
+				currentCert, err := os.ReadFile(filepath.Join(nginxDir, "id-cert.pem"))
+				Expect(err).ShouldNot(HaveOccurred())
+
+				Expect(string(currentCert)).To(ContainSubstring("<<EXPECTED ID CERT 1>>"))
+			})
+		})
+
+		Context("when nginx fails to reload", func() {
+			BeforeEach(func() {
+				nginxFixture = "code.cloudfoundry.org/envoy-nginx/fixtures/bad-nginx-reload"
+			})
+
+			It("keeps the rotated cert for the next start of nginx and keeps running", func() {
+				err := RotateCert("../fixtures/cf_assets_envoy_config/sds-id-cert-and-key-rotated.yaml", sdsIdCredsFile)
+				Expect(err).ToNot(HaveOccurred())
+
+				Eventually(session.Out).Should(gbytes.Say("-s,reload"))
+				Eventually(session.Out).Should(gbytes.Say("reload nginx: exit status 1. keeping the promoted nginx config for the next start of nginx"))
+
+				currentCert, err := os.ReadFile(filepath.Join(nginxDir, "id-cert.pem"))
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(string(currentCert)).To(ContainSubstring("<<NEW EXPECTED ID CERT 1>>"))
+
+				// The fixture nginx exits on its own after a while.
+				Eventually(session, "5s").Should(gexec.Exit(0))
+				Expect(nginxDir).NotTo(BeADirectory())
+			})
+		})
+
+		Context("when the sds validation context file is rotated", func() {
+			It("rewrites the ca file and reloads nginx", func() {
+				err := RotateCert("../fixtures/cf_assets_envoy_config/sds-id-validation-context-rotated.yaml", sdsIdValidationFile)
+				Expect(err).ToNot(HaveOccurred())
+
+				Eventually(session.Out).Should(gbytes.Say("detected change in sdsfile"))
+				Eventually(session.Out).Should(gbytes.Say(fmt.Sprintf("-p,%s,-s,reload", strings.Replace(nginxDir, `\`, `\\`, -1))))
+
+				expectedCA := `-----BEGIN CERTIFICATE-----
+<<NEW EXPECTED CA CERT>>
+-----END CERTIFICATE-----
+`
+				currentCA, err := os.ReadFile(filepath.Join(nginxDir, "id-ca.pem"))
+				Expect(err).ShouldNot(HaveOccurred())
+
+				Expect(string(currentCA)).To(Equal(expectedCA))
+			})
+		})
+
+		Context("when the envoy config is changed", func() {
+			var sdsServerCredsFile string
+
+			BeforeEach(func() {
+				// The new envoy config refers to a server-cert-and-key secret.
+				creds, err := os.ReadFile(SdsIdCredsFixture)
+				Expect(err).ToNot(HaveOccurred())
+
+				tmp, err := os.CreateTemp("", "sdsServerCreds")
+				Expect(err).ToNot(HaveOccurred())
+				sdsServerCredsFile = tmp.Name()
+				tmp.Close()
+				err = os.WriteFile(sdsServerCredsFile, []byte(strings.Replace(string(creds), "name: id-cert-and-key", "name: server-cert-and-key", 1)), 0644)
+				Expect(err).ToNot(HaveOccurred())
+
+				cmd.Args = append(cmd.Args, "--sds-secret", "server-cert-and-key="+sdsServerCredsFile)
+			})
+
+			AfterEach(func() {
+				Expect(os.Remove(sdsServerCredsFile)).NotTo(HaveOccurred())
+			})
+
+			It("regenerates nginx.conf and reloads nginx", func() {
+				err := RotateCert(EnvoyOneListenerPerServerFixture, envoyConfigFile)
+				Expect(err).ToNot(HaveOccurred())
+
+				Eventually(session.Out).Should(gbytes.Say("detected change in envoy config"))
+				Eventually(session.Out).Should(gbytes.Say(fmt.Sprintf("-p,%s,-s,reload", strings.Replace(nginxDir, `\`, `\\`, -1))))
+
+				nginxConf, err := os.ReadFile(filepath.Join(nginxDir, "conf", "nginx.conf"))
+				Expect(err).ShouldNot(HaveOccurred())
+
+				Expect(string(nginxConf)).To(ContainSubstring("upstream 0-service-cluster"))
+				Expect(string(nginxConf)).NotTo(ContainSubstring("upstream service-cluster-8080"))
+			})
+
+			Context("when the new envoy config is broken", func() {
+				It("keeps the last good nginx.conf and does not reload nginx", func() {
+					err := os.WriteFile(envoyConfigFile, []byte("static_resources:\n  listeners:\n  - address:\n"), 0644)
+					Expect(err).ToNot(HaveOccurred())
+
+					Eventually(session.Out).Should(gbytes.Say("keeping last good nginx config"))
+					Consistently(session.Out).ShouldNot(gbytes.Say("-s,reload"))
+
+					nginxConf, err := os.ReadFile(filepath.Join(nginxDir, "conf", "nginx.conf"))
+					Expect(err).ShouldNot(HaveOccurred())
+
+					Expect(string(nginxConf)).To(ContainSubstring("upstream service-cluster-8080"))
+				})
+			})
+		})
+
 		Context("when c2c creds file is not provided", func() {
 			BeforeEach(func() {
-				cmd = exec.Command(envoyNginxBin, "-c", EnvoyFixture, "--id-creds", sdsIdCredsFile, "--id-validation", SdsIdValidationFixture)
+				// Nor is there an sds_config path for the c2c secret.
+				envoyConfig, err := os.ReadFile(EnvoyFixture)
+				Expect(err).ToNot(HaveOccurred())
+				envoyConfig = []byte(strings.Replace(string(envoyConfig), "              sds_config:\n                path: /etc/cf-assets/envoy_config/sds-c2c-cert-and-key.yaml\n", "", 1))
+				Expect(os.WriteFile(envoyConfigFile, envoyConfig, 0644)).To(Succeed())
+
+				cmd = exec.Command(envoyNginxBin, "-c", envoyConfigFile, "--id-creds", sdsIdCredsFile, "--id-validation", sdsIdValidationFile)
+			})
+
+			It("skips the c2c listener", func() {
+				Expect(string(session.Out.Contents())).To(ContainSubstring(`skipping the listeners of tls certificate secret "c2c-cert-and-key" that has no sds file`))
+
+				nginxConf, err := os.ReadFile(filepath.Join(nginxDir, "conf", "nginx.conf"))
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(string(nginxConf)).NotTo(ContainSubstring("c2c-cert.pem"))
 			})
 
 			It("does not reload the nginx", func() {
@@ -180,6 +525,13 @@ var _ = Describe("Acceptance", func() {
 	})
 })
 
+func nginxBinName() string {
+	if runtime.GOOS == "windows" {
+		return "nginx.exe"
+	}
+	return "nginx"
+}
+
 func findNginxConfDir(args []string) string {
 	nginxDir := ""
 	for i, arg := range args {
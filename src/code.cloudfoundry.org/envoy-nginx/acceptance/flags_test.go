@@ -26,10 +26,21 @@ var _ = Describe("Flags", func() {
 	})
 
 	Context("when passed a flag it does not recognize", func() {
-		It("does not fail with undefined flag error", func() {
+		It("fails with a usage error", func() {
 			session, err := gexec.Start(exec.Command(envoyNginxBin, "-z", "nope"), GinkgoWriter, GinkgoWriter)
 			Expect(err).NotTo(HaveOccurred())
-			Eventually(session).ShouldNot(gbytes.Say("Flags parse:"))
+			Eventually(session).Should(gexec.Exit(2))
+			Expect(session.Err).To(gbytes.Say("flag provided but not defined: -z"))
+			Expect(session.Err).To(gbytes.Say("Usage of envoy:"))
+		})
+	})
+
+	Context("when passed --help", func() {
+		It("prints the usage", func() {
+			session, err := gexec.Start(exec.Command(envoyNginxBin, "--help"), GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(session).Should(gexec.Exit(0))
+			Expect(session.Out).To(gbytes.Say("Usage of envoy:"))
 		})
 	})
 })
@@ -0,0 +1,82 @@
+package app
+
+import (
+	"fmt"
+	"strings"
+
+	"code.cloudfoundry.org/envoy-nginx/parser"
+)
+
+// Fails on envoy config fields that are not translated to nginx
+// and affect security, instead of only warning about them.
+func (a *App) SetStrict(strict bool) {
+	a.strict = strict
+}
+
+// Logs a warning for every field of the envoy config and of the sds
+// validation contexts that is not translated to nginx. In strict mode,
+// unsupported fields that affect security are an error.
+func (a App) checkCompatibility(sdsIdValidation string) error {
+	unsupported, err := parser.CheckCompatibility(a.envoyConfig, a.limitConnectionDuration)
+	if err != nil {
+		return fmt.Errorf("check envoy config compatibility: %s", err)
+	}
+
+	problems := []string{}
+	security := a.warnUnsupported("envoy config", unsupported)
+	if len(security) > 0 {
+		problems = append(problems, fmt.Sprintf("unsupported security relevant envoy config fields: %s", strings.Join(security, ", ")))
+	}
+
+	if sdsIdValidation != "" {
+		unsupported, err = parser.CheckValidationContextCompatibility(sdsIdValidation)
+		if err != nil {
+			return fmt.Errorf("check sds validation context compatibility: %s", err)
+		}
+
+		security = a.warnUnsupported("sds validation context", unsupported)
+		if len(security) > 0 {
+			problems = append(problems, fmt.Sprintf("unsupported security relevant sds validation context fields: %s", strings.Join(security, ", ")))
+		}
+	}
+
+	if a.strict && len(problems) > 0 {
+		return fmt.Errorf("strict: %s", strings.Join(problems, "; "))
+	}
+
+	return nil
+}
+
+// Returns the paths of the fields that affect security.
+func (a App) warnUnsupported(document string, unsupported []parser.UnsupportedField) []string {
+	security := []string{}
+	for _, field := range unsupported {
+		a.logger.Println(fmt.Sprintf("envoy-nginx application: warning: unsupported %s field is ignored: %s", document, field))
+		if field.Security {
+			security = append(security, field.Path)
+		}
+	}
+	return security
+}
+
+// Logs a warning if the validation contexts have subject alt name
+// matchers that are not verified, because --verify-san is not set, so
+// that any client cert signed by their ca is accepted. In strict mode
+// that is an error.
+func (a App) checkSANMatchers(nginxConfParser parser.NginxConfig) error {
+	ignored, err := nginxConfParser.IgnoresSANMatchers()
+	if err != nil {
+		return fmt.Errorf("check subject alt name matchers: %s", err)
+	}
+
+	if !ignored {
+		return nil
+	}
+
+	if a.strict {
+		return fmt.Errorf("strict: subject alt name matchers of the validation context are only verified with --verify-san")
+	}
+
+	a.logger.Println("envoy-nginx application: WARNING: subject alt name matchers of the validation context are ignored without --verify-san: ANY client cert signed by its ca is accepted")
+	return nil
+}
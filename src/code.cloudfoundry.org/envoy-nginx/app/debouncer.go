@@ -0,0 +1,39 @@
+package app
+
+import (
+	"slices"
+	"time"
+)
+
+// Collects the names of changed files until no new change has come
+// in for quietPeriod, then calls callback once with every file seen
+// during that burst. Callbacks run one after the other on the calling
+// goroutine, so whatever they do is serialized.
+func Debounce(events <-chan string, quietPeriod time.Duration, callback func([]string) error) error {
+	var (
+		pending []string
+		quiet   <-chan time.Time
+	)
+
+	for {
+		select {
+		case fileName, ok := <-events:
+			if !ok {
+				return nil
+			}
+			if !slices.Contains(pending, fileName) {
+				pending = append(pending, fileName)
+			}
+			quiet = time.After(quietPeriod)
+		case <-quiet:
+			files := pending
+			pending = nil
+			quiet = nil
+
+			err := callback(files)
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
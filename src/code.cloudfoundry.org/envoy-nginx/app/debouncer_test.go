@@ -0,0 +1,102 @@
+package app_test
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"code.cloudfoundry.org/envoy-nginx/app"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Debounce", func() {
+	var (
+		events    chan string
+		callbacks chan []string
+		errorChan chan error
+	)
+
+	BeforeEach(func() {
+		events = make(chan string)
+		callbacks = make(chan []string, 10)
+		errorChan = make(chan error, 1)
+	})
+
+	start := func(callback func([]string) error) {
+		go func() {
+			errorChan <- app.Debounce(events, 100*time.Millisecond, callback)
+		}()
+	}
+
+	It("merges a burst of changes into a single callback with each file once", func() {
+		start(func(files []string) error {
+			callbacks <- files
+			return nil
+		})
+
+		events <- "id-creds"
+		events <- "c2c-creds"
+		events <- "id-creds"
+		events <- "id-validation"
+
+		Eventually(callbacks).Should(Receive(Equal([]string{"id-creds", "c2c-creds", "id-validation"})))
+		Consistently(callbacks, "300ms").ShouldNot(Receive())
+	})
+
+	It("calls back again for changes after the quiet period", func() {
+		start(func(files []string) error {
+			callbacks <- files
+			return nil
+		})
+
+		events <- "id-creds"
+		Eventually(callbacks).Should(Receive(Equal([]string{"id-creds"})))
+
+		events <- "c2c-creds"
+		Eventually(callbacks).Should(Receive(Equal([]string{"c2c-creds"})))
+	})
+
+	It("never runs callbacks concurrently", func() {
+		var running, overlapped int32
+		start(func(files []string) error {
+			if atomic.AddInt32(&running, 1) > 1 {
+				atomic.StoreInt32(&overlapped, 1)
+			}
+			time.Sleep(200 * time.Millisecond)
+			atomic.AddInt32(&running, -1)
+			callbacks <- files
+			return nil
+		})
+
+		events <- "id-creds"
+		time.Sleep(150 * time.Millisecond)
+		events <- "c2c-creds"
+
+		Eventually(callbacks, "2s").Should(Receive(Equal([]string{"id-creds"})))
+		Eventually(callbacks, "2s").Should(Receive(Equal([]string{"c2c-creds"})))
+		Expect(atomic.LoadInt32(&overlapped)).To(BeZero())
+	})
+
+	Context("when the callback fails", func() {
+		It("returns the error", func() {
+			start(func([]string) error {
+				return errors.New("banana")
+			})
+
+			events <- "id-creds"
+			Eventually(errorChan).Should(Receive(MatchError("banana")))
+		})
+	})
+
+	Context("when the events channel is closed", func() {
+		It("returns without an error", func() {
+			start(func([]string) error {
+				return nil
+			})
+
+			close(events)
+			Eventually(errorChan).Should(Receive(BeNil()))
+		})
+	})
+})
@@ -0,0 +1,11 @@
+//go:build windows
+
+package app
+
+const (
+	DefaultEnvoyConfigPath            = "C:\\etc\\cf-assets\\envoy_config\\envoy.yaml"
+	DefaultSdsIdCertAndKeysPath       = "C:\\etc\\cf-assets\\envoy_config\\sds-server-cert-and-key.yaml"
+	DefaultSdsIdValidationContextPath = "C:\\etc\\cf-assets\\envoy_config\\sds-server-validation-context.yaml"
+
+	nginxBinName = "nginx.exe"
+)
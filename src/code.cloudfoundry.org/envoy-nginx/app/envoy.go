@@ -1,20 +1,41 @@
 package app
 
 import (
+	"errors"
 	"fmt"
+	"io/fs"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"slices"
+	"strings"
+	"time"
 
 	"code.cloudfoundry.org/envoy-nginx/parser"
 )
 
+const fileWaitInterval = 250 * time.Millisecond
+
 type App struct {
-	logger      logger
-	cmd         cmd
-	tailer      tailer
-	envoyConfig string
-	nginxBin    string
+	logger                  logger
+	cmd                     cmd
+	tailer                  tailer
+	watcher                 fileWatcher
+	envoyConfig             string
+	nginxBin                string
+	reloadQuietPeriod       time.Duration
+	maxRestarts             int
+	restartBackoff          time.Duration
+	maxRestartBackoff       time.Duration
+	shutdownSignals         <-chan os.Signal
+	drainTimeout            time.Duration
+	workerProcesses         int
+	errorLogLevel           string
+	njsModule               string
+	verifySAN               bool
+	limitConnectionDuration bool
+	sdsSecrets              map[string]string
+	strict                  bool
 }
 
 type logger interface {
@@ -29,12 +50,23 @@ type cmd interface {
 	Run(string, ...string) error
 }
 
+type fileWatcher interface {
+	WatchFile(string, chan bool, func() error) error
+}
+
 func NewApp(logger logger, cmd cmd, tailer tailer, envoyConfig string) App {
 	return App{
-		logger:      logger,
-		cmd:         cmd,
-		tailer:      tailer,
-		envoyConfig: envoyConfig,
+		logger:            logger,
+		cmd:               cmd,
+		tailer:            tailer,
+		watcher:           NotifyWatcher{},
+		envoyConfig:       envoyConfig,
+		reloadQuietPeriod: DefaultReloadQuietPeriod,
+		maxRestarts:       DefaultMaxRestarts,
+		restartBackoff:    DefaultRestartBackoff,
+		maxRestartBackoff: DefaultMaxRestartBackoff,
+		drainTimeout:      DefaultDrainTimeout,
+		workerProcesses:   DefaultConcurrency,
 		// Will be set on Run()
 		nginxBin: "",
 	}
@@ -44,32 +76,257 @@ func (a *App) SetNginxBin(nginxPath string) {
 	a.nginxBin = nginxPath
 }
 
-// Searching for nginx.exe in the same directory
-// that our app binary is running in.
+func (a *App) SetWatcher(watcher fileWatcher) {
+	a.watcher = watcher
+}
+
+// How long the watched files have to stay unchanged before
+// a burst of changes is turned into a single nginx reload.
+func (a *App) SetReloadQuietPeriod(quietPeriod time.Duration) {
+	a.reloadQuietPeriod = quietPeriod
+}
+
+// Number of nginx worker processes, set from envoy's --concurrency.
+func (a *App) SetWorkerProcesses(workerProcesses int) {
+	a.workerProcesses = workerProcesses
+}
+
+// nginx error_log level, set from envoy's --log-level.
+func (a *App) SetErrorLogLevel(level string) {
+	a.errorLogLevel = level
+}
+
+// Path of the njs dynamic module, set from --njs-module.
+func (a *App) SetNjsModule(path string) {
+	a.njsModule = path
+}
+
+// Verify client cert SANs with njs, set from --verify-san.
+func (a *App) SetVerifySAN(verifySAN bool) {
+	a.verifySAN = verifySAN
+}
+
+// Limit connection durations with njs, set from --limit-connection-duration.
+func (a *App) SetLimitConnectionDuration(limitConnectionDuration bool) {
+	a.limitConnectionDuration = limitConnectionDuration
+}
+
+// Searching for nginx (nginx.exe on windows). A binary set with
+// SetNginxBin wins, then the one in the same directory that our app
+// binary is running in, then the one on the $PATH.
 func (a App) GetNginxPath() (path string, err error) {
+	if a.nginxBin != "" {
+		_, err = os.Stat(a.nginxBin)
+		if err != nil {
+			return "", fmt.Errorf("stat %s: %s", a.nginxBin, err)
+		}
+		return a.nginxBin, nil
+	}
+
 	mypath, err := os.Executable()
 	if err != nil {
 		return "", fmt.Errorf("executable path: %s", err)
 	}
 
 	pwd := filepath.Dir(mypath)
-	nginxPath := filepath.Join(pwd, "nginx.exe")
+	nginxPath := filepath.Join(pwd, nginxBinName)
 
 	_, err = os.Stat(nginxPath)
+	if err == nil {
+		return nginxPath, nil
+	}
+
+	nginxPath, err = exec.LookPath(nginxBinName)
 	if err != nil {
-		return "", fmt.Errorf("stat nginx.exe: %s", err)
+		return "", fmt.Errorf("find %s in %s or on the PATH: %s", nginxBinName, pwd, err)
 	}
 
 	return nginxPath, nil
 }
 
 // Setting up nginx config and directory.
-// Creating two goroutines: one to watch the sds creds file
-// and reload nginx when the creds rotate, the other to start
-// nginx.
+// Creating a goroutine per watched file (the envoy config, the sds
+// files passed on the command line and those of tls certificate
+// secrets found at their sds_config.path) that reports changes to a
+// single event loop, one for that event loop, which merges a burst
+// of changes into a single nginx reload, and another to start and
+// supervise nginx once all watched files exist. Receiving one of
+// the shutdown signals shuts nginx down and returns, as does an
+// error of a watcher or the reload loop, so that nginx never
+// outlives us.
 func (a App) Run(nginxConfDir, nginxBinPath, sdsIdCreds, sdsC2CCreds, sdsIdValidation string) error {
 	a.SetNginxBin(nginxBinPath)
 
+	err := createNginxDirs(nginxConfDir)
+	if err != nil {
+		return err
+	}
+
+	watchedFiles := append([]string{a.envoyConfig}, a.sdsFiles(sdsIdCreds, sdsC2CCreds, sdsIdValidation)...)
+
+	errorChan := make(chan error)
+	readyChan := make(chan bool)
+	events := make(chan string, len(watchedFiles))
+
+	// Only touched by one goroutine at a time: this one, then the
+	// one configuring nginx, then the reload loop.
+	watching := map[string]bool{}
+	watch := func(watchedFile string, ready chan bool) {
+		watching[watchedFile] = true
+		go func() {
+			errorChan <- a.watcher.WatchFile(watchedFile, ready, func() error {
+				events <- watchedFile
+				return nil
+			})
+		}()
+	}
+
+	for _, watchedFile := range watchedFiles {
+		watch(watchedFile, readyChan)
+	}
+
+	// Resolves the secrets of the current envoy config and watches
+	// sds files that are not watched yet, e.g. once the envoy config
+	// refers to a new secret. Returns the sds files of the secrets,
+	// which may not exist yet.
+	newNginxConfig := func() (parser.NginxConfig, []string, error) {
+		sdsCredParsers, sdsFiles, err := a.sdsCredParsers(sdsIdCreds, sdsC2CCreds)
+		if err != nil {
+			return parser.NginxConfig{}, nil, err
+		}
+
+		for _, sdsFile := range sdsFiles {
+			if !watching[sdsFile] {
+				a.logger.Println(fmt.Sprintf("envoy-nginx application: watching %s", sdsFile))
+				watch(sdsFile, make(chan bool, 1))
+			}
+		}
+
+		return a.newNginxConfig(nginxConfDir, sdsCredParsers, sdsIdValidation), sdsFiles, nil
+	}
+
+	// applied holds the fingerprints of the sds material nginx
+	// currently runs with, so that sds files rewritten without
+	// changes to their material do not cause a reload.
+	reloadLoop := func(nginxConfParser parser.NginxConfig, applied []parser.SdsFingerprint) error {
+		reloads := 0
+		return Debounce(events, a.reloadQuietPeriod, func(files []string) error {
+			start := time.Now()
+
+			changed, err := a.filesUpdated(files)
+			if err != nil || !changed {
+				return err
+			}
+
+			if slices.Contains(files, a.envoyConfig) || slices.Contains(files, sdsIdValidation) {
+				err = a.checkCompatibility(sdsIdValidation)
+				if err != nil {
+					a.logger.Println(fmt.Sprintf("envoy-nginx application: keeping last good nginx config: %s", err))
+					return nil
+				}
+			}
+
+			if slices.Contains(files, a.envoyConfig) {
+				// The envoy config may refer to other secrets now. Until
+				// their sds files appear, staging the candidate fails and
+				// the watchers of those files trigger another attempt.
+				candidateConfParser, _, err := newNginxConfig()
+				if err != nil {
+					a.logger.Println(fmt.Sprintf("envoy-nginx application: keeping last good nginx config: %s", err))
+					return nil
+				}
+				nginxConfParser = candidateConfParser
+			}
+
+			fingerprints, err := nginxConfParser.SdsFingerprints()
+			if err == nil && !slices.Contains(files, a.envoyConfig) && slices.Equal(fingerprints, applied) {
+				a.logger.Println(fmt.Sprintf("envoy-nginx application: sds material unchanged (version_info %s). NOOP.\n", versionInfos(fingerprints)))
+				return nil
+			}
+
+			reloaded, err := a.reloadNginx(nginxConfParser)
+			if reloaded {
+				applied = fingerprints
+				reloads++
+				a.logger.Println(fmt.Sprintf("envoy-nginx application: reload %d for changes in %s took %s", reloads, strings.Join(files, ", "), time.Since(start)))
+			}
+
+			return err
+		})
+	}
+
+	// Closed on shutdown, so that nginx is neither started
+	// nor restarted once it has been asked to quit.
+	stopping := make(chan struct{})
+	// Closed right before nginx is first started.
+	nginxStarted := make(chan struct{})
+	nginxDone := make(chan error, 1)
+
+	// Only start nginx once every watcher is ready, so that
+	// a rotation happening during startup is not missed, and
+	// every watched file exists. Changes are only acted upon
+	// once the initial config has been written.
+	go func() {
+		for range watchedFiles {
+			<-readyChan
+		}
+		if !a.waitForFiles(watchedFiles, stopping) {
+			nginxDone <- nil
+			return
+		}
+
+		nginxConfParser, sdsFiles, err := newNginxConfig()
+		if err != nil {
+			errorChan <- err
+			return
+		}
+
+		// sds files only the envoy config refers to.
+		if !a.waitForFiles(sdsFiles, stopping) {
+			nginxDone <- nil
+			return
+		}
+
+		applied, _ := nginxConfParser.SdsFingerprints()
+
+		err = a.configureNginx(nginxConfParser, sdsIdValidation)
+		if err != nil {
+			errorChan <- err
+			return
+		}
+
+		close(nginxStarted)
+
+		go func() {
+			errorChan <- reloadLoop(nginxConfParser, applied)
+		}()
+
+		nginxDone <- a.superviseNginx(nginxConfDir, stopping)
+	}()
+
+	select {
+	case err = <-errorChan:
+		close(stopping)
+		select {
+		case <-nginxStarted:
+		default:
+			return err
+		}
+
+		shutdownErr := a.shutdownNginx(fmt.Sprintf("failed: %s", err), nginxConfDir, nginxDone)
+		if shutdownErr != nil {
+			a.logger.Println(fmt.Sprintf("envoy-nginx application: shut down nginx: %s", shutdownErr))
+		}
+		return err
+	case err = <-nginxDone:
+		return err
+	case sig := <-a.shutdownSignals:
+		close(stopping)
+		return a.shutdownNginx(fmt.Sprintf("received %s", sig), nginxConfDir, nginxDone)
+	}
+}
+
+func createNginxDirs(nginxConfDir string) error {
 	err := os.Mkdir(filepath.Join(nginxConfDir, "logs"), 0755)
 	if err != nil {
 		return fmt.Errorf("create nginx/logs dir for error.log: %s", err)
@@ -80,88 +337,173 @@ func (a App) Run(nginxConfDir, nginxBinPath, sdsIdCreds, sdsC2CCreds, sdsIdValid
 		return fmt.Errorf("create nginx/conf dir for nginx.conf: %s", err)
 	}
 
+	return nil
+}
+
+func (a App) newNginxConfig(nginxConfDir string, sdsCredParsers []parser.SdsCredParser, sdsIdValidation string) parser.NginxConfig {
 	envoyConfParser := parser.NewEnvoyConfParser()
 
-	sdsIdCredParser := parser.NewSdsIdCredParser(sdsIdCreds)
-	sdsCredParsers := []parser.SdsCredParser{sdsIdCredParser}
-	if sdsC2CCreds != "" {
-		sdsC2CCredParser := parser.NewSdsC2CCredParser(sdsC2CCreds)
-		sdsCredParsers = append(sdsCredParsers, sdsC2CCredParser)
-	}
 	sdsIdValidationParser := parser.NewSdsIdValidationParser(sdsIdValidation)
 
 	nginxConfParser := parser.NewNginxConfig(envoyConfParser, sdsCredParsers, sdsIdValidationParser, nginxConfDir)
+	nginxConfParser.SetWorkerProcesses(a.workerProcesses)
+	nginxConfParser.SetErrorLogLevel(a.errorLogLevel)
+	nginxConfParser.SetNjsModule(a.njsModule)
+	nginxConfParser.SetVerifySAN(a.verifySAN)
+	nginxConfParser.SetLimitConnectionDuration(a.limitConnectionDuration)
 
-	errorChan := make(chan error)
-	readyChan := make(chan bool)
-
-	go func() {
-		errorChan <- WatchFile(sdsIdCreds, readyChan, func() error {
-			return a.sdsFileUpdated(sdsIdCreds, nginxConfParser)
-		})
-	}()
+	return nginxConfParser
+}
 
-	if sdsC2CCreds != "" {
-		go func() {
-			errorChan <- WatchFile(sdsC2CCreds, readyChan, func() error {
-				return a.sdsFileUpdated(sdsC2CCreds, nginxConfParser)
-			})
-		}()
+// Called once per burst of changes to the watched files. Reports
+// whether any of the changes was not a false alarm.
+func (a App) filesUpdated(files []string) (bool, error) {
+	changed := false
+	for _, fileName := range files {
+		if fileName == a.envoyConfig {
+			a.logger.Println(fmt.Sprintf("detected change in envoy config: %s \n", fileName))
+		} else {
+			a.logger.Println(fmt.Sprintf("detected change in sdsfile: %s \n", fileName))
+		}
+
+		fd, err := os.Stat(fileName)
+		if errors.Is(err, fs.ErrNotExist) {
+			a.logger.Println(fmt.Sprintf("%s no longer exists. NOOP.\n", fileName))
+			continue
+		}
+		if err != nil {
+			return false, fmt.Errorf("stat %s: %s", fileName, err)
+		}
+		/* It's observed that sometimes fsnotify may provide a double notification
+		* with one of the notifications reporting an empty file. NOOP in that case
+		 */
+		if fd.Size() < 1 {
+			a.logger.Println(fmt.Sprintf("detected change in %s was a false alarm. NOOP.\n", fileName))
+			continue
+		}
+
+		changed = true
 	}
 
-	go func() {
-		<-readyChan
-		errorChan <- a.startNginx(nginxConfParser)
-	}()
+	return changed, nil
+}
 
-	err = <-errorChan
-	if err != nil {
-		return err
+func versionInfos(fingerprints []parser.SdsFingerprint) string {
+	versions := []string{}
+	for _, fingerprint := range fingerprints {
+		versions = append(versions, fmt.Sprintf("%q", fingerprint.VersionInfo))
 	}
-
-	return nil
+	return strings.Join(versions, ", ")
 }
 
-func (a App) sdsFileUpdated(fileName string, nginxConfParser parser.NginxConfig) error {
-	a.logger.Println(fmt.Sprintf("detected change in sdsfile: %s \n", fileName))
+// Stages the rotated cert, key, and ca cert together with a freshly
+// generated nginx.conf in a candidate directory and validates them
+// with `nginx -t`. Only a valid candidate replaces the files in the
+// nginx config directory before nginx is reloaded. If the reload
+// fails, e.g. because the supervisor is about to restart nginx, the
+// promoted files are kept for nginx to pick up when it starts.
+// Reports whether the candidate was promoted.
+func (a App) reloadNginx(nginxConfParser parser.NginxConfig) (bool, error) {
+	nginxDir := nginxConfParser.GetNginxDir()
+	candidateDir := filepath.Join(nginxDir, "candidate")
+	previousDir := filepath.Join(nginxDir, "previous")
 
-	sdsFd, err := os.Stat(fileName)
+	// A rotated validation context may bring matchers that are not verified.
+	err := a.checkSANMatchers(nginxConfParser)
 	if err != nil {
-		return fmt.Errorf("stat %s: %s", fileName, err)
+		a.logger.Println(fmt.Sprintf("envoy-nginx application: keeping last good nginx config: %s", err))
+		return false, nil
 	}
-	/* It's observed that sometimes fsnotify may provide a double notification
-	* with one of the notifications reporting an empty file. NOOP in that case
-	 */
-	if sdsFd.Size() < 1 {
-		a.logger.Println("detected change in sdsfile was a false alarm. NOOP.\n")
-		return nil
+
+	candidate, err := nginxConfParser.Stage(a.envoyConfig, candidateDir)
+	if err != nil {
+		a.logger.Println(fmt.Sprintf("envoy-nginx application: keeping last good nginx config: stage candidate: %s", err))
+		return false, nil
 	}
-	return a.reloadNginx(nginxConfParser)
-}
 
-// Rotates cert, key, and ca cert in nginx config directory.
-// Reloads nginx.
-func (a App) reloadNginx(nginxConfParser parser.NginxConfig) error {
-	err := nginxConfParser.WriteTLSFiles()
+	a.logger.Println("envoy-nginx application: validate nginx config:", a.nginxBin, "-t", "-p", candidateDir)
+	err = a.cmd.Run(a.nginxBin, "-t", "-p", candidateDir)
 	if err != nil {
-		return fmt.Errorf("write tls files: %s", err)
+		a.logger.Println(fmt.Sprintf("envoy-nginx application: keeping last good nginx config: candidate failed nginx -t: %s", err))
+		return false, nil
 	}
 
-	nginxDir := nginxConfParser.GetNginxDir()
+	err = nginxConfParser.Backup(candidate, previousDir)
+	if err != nil {
+		return false, fmt.Errorf("back up nginx config: %s", err)
+	}
 
-	a.logger.Println("envoy-nginx application: reload nginx:", a.nginxBin, "-p", nginxDir, "-s", "reload")
+	err = nginxConfParser.Promote(candidate)
+	if err != nil {
+		return false, a.restoreNginxConfig(nginxConfParser, candidate, previousDir, fmt.Errorf("promote candidate: %s", err))
+	}
 
+	a.logger.Println("envoy-nginx application: reload nginx:", a.nginxBin, "-p", nginxDir, "-s", "reload")
 	c := exec.Command(a.nginxBin, "-p", nginxDir, "-s", "reload")
 	c.Stdout = os.Stdout
 	c.Stderr = os.Stderr
-	return c.Run()
+	err = c.Run()
+	if err != nil {
+		a.logger.Println(fmt.Sprintf("envoy-nginx application: reload nginx: %s. keeping the promoted nginx config for the next start of nginx", err))
+	}
+
+	return true, nil
+}
+
+func (a App) restoreNginxConfig(nginxConfParser parser.NginxConfig, candidate parser.Candidate, previousDir string, cause error) error {
+	a.logger.Println(fmt.Sprintf("envoy-nginx application: restoring previous nginx config: %s", cause))
+
+	err := nginxConfParser.Restore(candidate, previousDir)
+	if err != nil {
+		return fmt.Errorf("%s: restore previous nginx config: %s", cause, err)
+	}
+
+	return cause
 }
 
+// Blocks until every file exists, so that sds files which are
+// only written after the container started do not fail startup.
+// Returns false if stopping was closed in the meantime.
+func (a App) waitForFiles(files []string, stopping <-chan struct{}) bool {
+	for _, fileName := range files {
+		logged := false
+		for {
+			_, err := os.Stat(fileName)
+			if err == nil {
+				break
+			}
+			if !logged {
+				a.logger.Println(fmt.Sprintf("envoy-nginx application: waiting for %s to appear", fileName))
+				logged = true
+			}
+			select {
+			case <-stopping:
+				return false
+			case <-time.After(fileWaitInterval):
+			}
+		}
+	}
+
+	return true
+}
+
+// Warns about envoy config and validation context fields that are
+// not translated.
 // Generates nginx config from envoy config.
 // Writes cert, key, and ca cert to files in nginx config directory.
-// Starts nginx.
-func (a App) startNginx(nginxConfParser parser.NginxConfig) error {
-	err := nginxConfParser.WriteTLSFiles()
+// Starts tailing the nginx error log.
+func (a App) configureNginx(nginxConfParser parser.NginxConfig, sdsIdValidation string) error {
+	err := a.checkCompatibility(sdsIdValidation)
+	if err != nil {
+		return err
+	}
+
+	err = a.checkSANMatchers(nginxConfParser)
+	if err != nil {
+		return err
+	}
+
+	err = nginxConfParser.WriteTLSFiles()
 	if err != nil {
 		return fmt.Errorf("write tls files: %s", err)
 	}
@@ -179,11 +521,5 @@ func (a App) startNginx(nginxConfParser parser.NginxConfig) error {
 		return fmt.Errorf("tail error log: %s", err)
 	}
 
-	a.logger.Println(fmt.Sprintf("envoy-nginx application: start nginx: %s -p %s", a.nginxBin, nginxDir))
-
-	err = a.cmd.Run(a.nginxBin, "-p", nginxDir)
-	if err != nil {
-		return fmt.Errorf("cmd run: %s", err)
-	}
 	return nil
 }
@@ -2,10 +2,17 @@ package app_test
 
 import (
 	"errors"
+	"fmt"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
 
 	"code.cloudfoundry.org/envoy-nginx/app"
 	"code.cloudfoundry.org/envoy-nginx/app/fakes"
+	. "code.cloudfoundry.org/envoy-nginx/testhelpers"
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
 	"github.com/onsi/gomega/gexec"
@@ -51,13 +58,61 @@ var _ = Describe("App", func() {
 	})
 
 	Describe("NginxPath", func() {
-		Context("when nginx.exe cannot be found", func() {
+		var nginxBinName string
+
+		BeforeEach(func() {
+			nginxBinName = "nginx"
+			if runtime.GOOS == "windows" {
+				nginxBinName = "nginx.exe"
+			}
+
+			path := os.Getenv("PATH")
+			DeferCleanup(func() {
+				os.Setenv("PATH", path)
+			})
+			os.Setenv("PATH", nginxConfDir)
+		})
+
+		Context("when nginx cannot be found", func() {
 			It("returns a helpful error", func() {
 				path, err := application.GetNginxPath()
-				Expect(err).To(MatchError(ContainSubstring("stat nginx.exe: ")))
+				Expect(err).To(MatchError(ContainSubstring("find " + nginxBinName + " in ")))
+				Expect(err).To(MatchError(ContainSubstring("or on the PATH: ")))
 				Expect(path).To(Equal(""))
 			})
 		})
+
+		Context("when nginx is on the PATH", func() {
+			BeforeEach(func() {
+				Expect(CopyFile(nginxBinPath, filepath.Join(nginxConfDir, nginxBinName))).To(Succeed())
+				Expect(os.Chmod(filepath.Join(nginxConfDir, nginxBinName), 0755)).To(Succeed())
+			})
+
+			It("returns its path", func() {
+				path, err := application.GetNginxPath()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(path).To(Equal(filepath.Join(nginxConfDir, nginxBinName)))
+			})
+		})
+
+		Context("when the nginx binary is set explicitly", func() {
+			It("returns it", func() {
+				application.SetNginxBin(nginxBinPath)
+
+				path, err := application.GetNginxPath()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(path).To(Equal(nginxBinPath))
+			})
+
+			Context("when it does not exist", func() {
+				It("returns a helpful error", func() {
+					application.SetNginxBin("not-a-real-nginx")
+
+					_, err := application.GetNginxPath()
+					Expect(err).To(MatchError(ContainSubstring("stat not-a-real-nginx: ")))
+				})
+			})
+		})
 	})
 
 	Describe("Run", func() {
@@ -65,8 +120,8 @@ var _ = Describe("App", func() {
 			err := application.Run(nginxConfDir, nginxBinPath, SdsIdCreds, SdsC2CCreds, SdsIdValidation)
 			Expect(err).NotTo(HaveOccurred())
 
-			Expect(cmd.RunCall.Receives[0].Binary).To(Equal(nginxBinPath))
-			Expect(cmd.RunCall.Receives[0].Args).To(ConsistOf(
+			Expect(cmd.Receives()[0].Binary).To(Equal(nginxBinPath))
+			Expect(cmd.Receives()[0].Args).To(ConsistOf(
 				"-p", ContainSubstring("nginx"),
 			))
 
@@ -78,18 +133,405 @@ var _ = Describe("App", func() {
 				names = append(names, file.Name())
 			}
 			Expect(names).To(ConsistOf("logs", "conf", "id-cert.pem", "id-key.pem", "id-ca.pem", "c2c-cert.pem", "c2c-key.pem"))
+
+			conf, err := os.ReadFile(filepath.Join(nginxConfDir, "conf", "nginx.conf"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(conf)).NotTo(ContainSubstring("js_preread"))
+
+			Expect(logger.Messages()).To(ContainElement(ContainSubstring("subject alt name matchers of the validation context are ignored without --verify-san: ANY client cert signed by its ca is accepted")))
 		})
 
-		Context("when running the command fails", func() {
+		Context("when strict and client cert SANs are not verified", func() {
 			BeforeEach(func() {
+				application.SetStrict(true)
+			})
+
+			It("returns a helpful error without starting nginx", func() {
+				err := application.Run(nginxConfDir, nginxBinPath, SdsIdCreds, SdsC2CCreds, SdsIdValidation)
+				Expect(err).To(MatchError("strict: subject alt name matchers of the validation context are only verified with --verify-san"))
+
+				Expect(cmd.CallCount()).To(Equal(0))
+			})
+		})
+
+		Context("when strict and the validation context has unsupported security relevant fields", func() {
+			var sdsIdValidationFile string
+
+			BeforeEach(func() {
+				application.SetStrict(true)
+
+				contents, err := os.ReadFile(SdsIdValidation)
+				Expect(err).NotTo(HaveOccurred())
+				contents = []byte(strings.Replace(string(contents), "    verify_subject_alt_name:\n", "    crl:\n      inline_string: some-crl\n    verify_subject_alt_name:\n", 1))
+				sdsIdValidationFile = filepath.Join(nginxConfDir, "sds-id-validation-context.yaml")
+				Expect(os.WriteFile(sdsIdValidationFile, contents, 0644)).To(Succeed())
+			})
+
+			It("returns a helpful error without starting nginx", func() {
+				err := application.Run(nginxConfDir, nginxBinPath, SdsIdCreds, SdsC2CCreds, sdsIdValidationFile)
+				Expect(err).To(MatchError("strict: unsupported security relevant sds validation context fields: resources[0].validation_context.crl"))
+
+				Expect(logger.Messages()).To(ContainElement(ContainSubstring("warning: unsupported sds validation context field is ignored: resources[0].validation_context.crl (security relevant)")))
+				Expect(cmd.CallCount()).To(Equal(0))
+			})
+		})
+
+		Context("when strict and a rotated validation context brings subject alt name matchers", func() {
+			var sdsIdValidationFile string
+
+			BeforeEach(func() {
+				application.SetStrict(true)
+				application.SetMaxRestarts(1)
+				application.SetRestartBackoff(time.Second, time.Second)
+				application.SetReloadQuietPeriod(10 * time.Millisecond)
+				// Keeps nginx down long enough for the rotation.
 				cmd.RunCall.Returns = []fakes.RunCallReturn{{Error: errors.New("banana")}}
+
+				contents, err := os.ReadFile(SdsIdValidation)
+				Expect(err).NotTo(HaveOccurred())
+				contents = []byte(strings.Replace(string(contents), "    verify_subject_alt_name:\n    - gorouter.service.cf.internal\n", "", 1))
+				Expect(string(contents)).NotTo(ContainSubstring("verify_subject_alt_name"))
+				sdsIdValidationFile = filepath.Join(nginxConfDir, "sds-id-validation-context.yaml")
+				Expect(os.WriteFile(sdsIdValidationFile, contents, 0644)).To(Succeed())
+
+				go func() {
+					defer GinkgoRecover()
+					time.Sleep(300 * time.Millisecond)
+					Expect(RotateCert("../fixtures/cf_assets_envoy_config/sds-id-validation-context-rotated.yaml", sdsIdValidationFile)).To(Succeed())
+				}()
 			})
 
-			It("returns a helpful error", func() {
+			It("keeps the last good nginx config", func() {
+				err := application.Run(nginxConfDir, nginxBinPath, SdsIdCreds, SdsC2CCreds, sdsIdValidationFile)
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(logger.Messages()).To(ContainElement(ContainSubstring("keeping last good nginx config: strict: subject alt name matchers of the validation context are only verified with --verify-san")))
+				Expect(cmd.Receives()).NotTo(ContainElement(HaveField("Args", ContainElement("-t"))))
+
+				ca, err := os.ReadFile(filepath.Join(nginxConfDir, "id-ca.pem"))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(string(ca)).NotTo(ContainSubstring("<<NEW EXPECTED CA CERT>>"))
+			})
+		})
+
+		Context("when client cert SANs are verified", func() {
+			BeforeEach(func() {
+				application.SetVerifySAN(true)
+			})
+
+			It("writes the njs verifier and runs it for mTLS listeners", func() {
+				err := application.Run(nginxConfDir, nginxBinPath, SdsIdCreds, SdsC2CCreds, SdsIdValidation)
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(filepath.Join(nginxConfDir, "san-verifier.js")).To(BeAnExistingFile())
+
+				conf, err := os.ReadFile(filepath.Join(nginxConfDir, "conf", "nginx.conf"))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(string(conf)).To(ContainSubstring("js_preread san.verify;"))
+
+				Expect(logger.Messages()).NotTo(ContainElement(ContainSubstring("--verify-san")))
+			})
+		})
+
+		Context("when an sds file only appears after startup", func() {
+			var sdsC2CCredsFile string
+
+			BeforeEach(func() {
+				sdsC2CCredsFile = filepath.Join(nginxConfDir, "sds-c2c-cert-and-key.yaml")
+
+				go func() {
+					defer GinkgoRecover()
+					time.Sleep(500 * time.Millisecond)
+					Expect(CopyFile(SdsC2CCreds, sdsC2CCredsFile)).To(Succeed())
+				}()
+			})
+
+			It("waits for it before starting nginx", func() {
+				err := application.Run(nginxConfDir, nginxBinPath, SdsIdCreds, sdsC2CCredsFile, SdsIdValidation)
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(logger.Messages()).To(ContainElement(ContainSubstring("waiting for " + sdsC2CCredsFile)))
+				Expect(cmd.CallCount()).To(Equal(1))
+			})
+		})
+
+		Context("when the sds file at the sds_config path of a secret only appears after startup", func() {
+			var sdsC2CCredsFile string
+
+			BeforeEach(func() {
+				sdsC2CCredsFile = filepath.Join(nginxConfDir, "sds-c2c-cert-and-key.yaml")
+
+				envoyConfig, err := os.ReadFile(EnvoyConfig)
+				Expect(err).NotTo(HaveOccurred())
+				envoyConfig = []byte(strings.ReplaceAll(string(envoyConfig), "/etc/cf-assets/envoy_config/sds-c2c-cert-and-key.yaml", sdsC2CCredsFile))
+				envoyConfigFile := filepath.Join(nginxConfDir, "envoy.yaml")
+				Expect(os.WriteFile(envoyConfigFile, envoyConfig, 0644)).To(Succeed())
+				application = app.NewApp(logger, cmd, tailer, envoyConfigFile)
+
+				go func() {
+					defer GinkgoRecover()
+					time.Sleep(500 * time.Millisecond)
+					Expect(CopyFile(SdsC2CCreds, sdsC2CCredsFile)).To(Succeed())
+				}()
+			})
+
+			It("waits for it before starting nginx", func() {
+				err := application.Run(nginxConfDir, nginxBinPath, SdsIdCreds, "", SdsIdValidation)
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(logger.Messages()).To(ContainElement(ContainSubstring("waiting for " + sdsC2CCredsFile)))
+				Expect(cmd.CallCount()).To(Equal(1))
+
+				cert, err := os.ReadFile(filepath.Join(nginxConfDir, "c2c-cert.pem"))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(string(cert)).To(ContainSubstring("<<EXPECTED C2C CERT"))
+			})
+		})
+
+		Context("when nginx exits unexpectedly", func() {
+			BeforeEach(func() {
+				application.SetMaxRestarts(2)
+				application.SetRestartBackoff(10*time.Millisecond, time.Second)
+				cmd.RunCall.Returns = []fakes.RunCallReturn{{Error: errors.New("banana")}}
+			})
+
+			It("restarts nginx with backoff", func() {
 				err := application.Run(nginxConfDir, nginxBinPath, SdsIdCreds, SdsC2CCreds, SdsIdValidation)
-				Expect(err).To(MatchError("cmd run: banana"))
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(cmd.CallCount()).To(Equal(2))
+				Expect(cmd.Receives()[1].Args).To(Equal(cmd.Receives()[0].Args))
+				Expect(logger.Messages()).To(ContainElement(ContainSubstring("nginx exited unexpectedly: cmd run: banana. restart 1 of 2 in 10ms")))
+			})
+
+			Context("when an sds file is rotated while nginx waits to be restarted", func() {
+				var sdsIdCredsFile string
+
+				BeforeEach(func() {
+					application.SetMaxRestarts(1)
+					application.SetRestartBackoff(time.Second, time.Second)
+					application.SetReloadQuietPeriod(10 * time.Millisecond)
+
+					var err error
+					// Fails to reload, like nginx -s reload does while no master is running.
+					nginxBinPath, err = gexec.Build("code.cloudfoundry.org/envoy-nginx/fixtures/bad-nginx-reload")
+					Expect(err).ToNot(HaveOccurred())
+
+					sdsIdCredsFile = filepath.Join(nginxConfDir, "sds-id-cert-and-key.yaml")
+					Expect(CopyFile(SdsIdCreds, sdsIdCredsFile)).To(Succeed())
+
+					go func() {
+						defer GinkgoRecover()
+						time.Sleep(300 * time.Millisecond)
+						Expect(RotateCert("../fixtures/cf_assets_envoy_config/sds-id-cert-and-key-rotated.yaml", sdsIdCredsFile)).To(Succeed())
+					}()
+				})
+
+				It("keeps the rotated config for the restarted nginx", func() {
+					err := application.Run(nginxConfDir, nginxBinPath, sdsIdCredsFile, SdsC2CCreds, SdsIdValidation)
+					Expect(err).NotTo(HaveOccurred())
+
+					Expect(logger.Messages()).To(ContainElement(ContainSubstring("keeping the promoted nginx config for the next start of nginx")))
+					Expect(cmd.Receives()).To(HaveLen(3))
+					Expect(cmd.Receives()[1].Args).To(ContainElement("-t"))
+					Expect(cmd.Receives()[2].Args).To(Equal(cmd.Receives()[0].Args))
+
+					cert, err := os.ReadFile(filepath.Join(nginxConfDir, "id-cert.pem"))
+					Expect(err).NotTo(HaveOccurred())
+					Expect(string(cert)).To(ContainSubstring("<<NEW EXPECTED ID CERT 1>>"))
+				})
+			})
+
+			Context("when the restart budget is used up", func() {
+				BeforeEach(func() {
+					cmd.RunCall.Returns = []fakes.RunCallReturn{
+						{Error: errors.New("banana")},
+						{Error: errors.New("banana")},
+						{Error: errors.New("kiwi")},
+					}
+				})
+
+				It("returns a helpful error", func() {
+					err := application.Run(nginxConfDir, nginxBinPath, SdsIdCreds, SdsC2CCreds, SdsIdValidation)
+					Expect(err).To(MatchError("giving up after 2 restarts of nginx: cmd run: kiwi"))
+
+					Expect(cmd.CallCount()).To(Equal(3))
+					Expect(logger.Messages()).To(ContainElement(ContainSubstring("start nginx: ")))
+					Expect(logger.Messages()).To(ContainElement(ContainSubstring("restart 1 of 2 in 10ms")))
+					Expect(logger.Messages()).To(ContainElement(ContainSubstring("restart 2 of 2 in 20ms")))
+				})
+			})
+		})
+
+		Context("when nginx daemonized", func() {
+			var (
+				pidFile string
+				session *gexec.Session
+			)
+
+			BeforeEach(func() {
+				if runtime.GOOS == "windows" {
+					Skip("nginx does not daemonize on windows")
+				}
+
+				application.SetMaxRestarts(0)
+				pidFile = filepath.Join(nginxConfDir, "nginx.pid")
+			})
+
+			JustBeforeEach(func() {
+				Expect(os.WriteFile(pidFile, []byte(fmt.Sprintf("%d\n", session.Command.Process.Pid)), 0644)).To(Succeed())
+			})
+
+			AfterEach(func() {
+				session.Kill()
+			})
+
+			Context("when the master process removes nginx.pid on exit", func() {
+				BeforeEach(func() {
+					var err error
+					session, err = gexec.Start(exec.Command("sh", "-c", `sleep 1 && rm "$0"`, pidFile), GinkgoWriter, GinkgoWriter)
+					Expect(err).NotTo(HaveOccurred())
+				})
+
+				It("tracks the master process until it stopped", func() {
+					err := application.Run(nginxConfDir, nginxBinPath, SdsIdCreds, SdsC2CCreds, SdsIdValidation)
+					Expect(err).NotTo(HaveOccurred())
+
+					Expect(session).To(gexec.Exit(0))
+				})
+			})
+
+			Context("when the master process exits leaving nginx.pid behind", func() {
+				BeforeEach(func() {
+					var err error
+					session, err = gexec.Start(exec.Command("sh", "-c", "sleep 1"), GinkgoWriter, GinkgoWriter)
+					Expect(err).NotTo(HaveOccurred())
+				})
+
+				It("treats the exit as unexpected", func() {
+					err := application.Run(nginxConfDir, nginxBinPath, SdsIdCreds, SdsC2CCreds, SdsIdValidation)
+					Expect(err).To(MatchError(fmt.Sprintf("giving up after 0 restarts of nginx: nginx master process %d exited without removing %s", session.Command.Process.Pid, pidFile)))
+				})
+			})
+		})
+
+		Context("when a shutdown signal is received", func() {
+			var (
+				signals chan os.Signal
+				pidFile string
+				session *gexec.Session
+			)
+
+			BeforeEach(func() {
+				if runtime.GOOS == "windows" {
+					Skip("the test stands in for a daemonized nginx, which does not exist on windows")
+				}
+
+				signals = make(chan os.Signal, 1)
+				application.SetShutdownSignals(signals)
+				pidFile = filepath.Join(nginxConfDir, "nginx.pid")
+
+				// Stands in for an nginx master that takes a second to drain.
+				var err error
+				session, err = gexec.Start(exec.Command("sh", "-c", `sleep 1 && rm "$0"`, pidFile), GinkgoWriter, GinkgoWriter)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(os.WriteFile(pidFile, []byte(fmt.Sprintf("%d\n", session.Command.Process.Pid)), 0644)).To(Succeed())
+
+				go func() {
+					time.Sleep(300 * time.Millisecond)
+					signals <- os.Interrupt
+				}()
+			})
+
+			AfterEach(func() {
+				session.Kill()
+			})
+
+			It("asks nginx to quit and waits for it to drain", func() {
+				err := application.Run(nginxConfDir, nginxBinPath, SdsIdCreds, SdsC2CCreds, SdsIdValidation)
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(session).To(gexec.Exit(0))
+				Expect(cmd.Receives()).To(ContainElement(fakes.RunCallReceive{
+					Binary: nginxBinPath,
+					Args:   []string{"-p", nginxConfDir, "-s", "quit"},
+				}))
+				Expect(cmd.Receives()).NotTo(ContainElement(HaveField("Args", ContainElement("stop"))))
+				Expect(logger.Messages()).To(ContainElement(ContainSubstring("received interrupt, quit nginx: ")))
+			})
+
+			Context("when nginx does not quit within the drain timeout", func() {
+				BeforeEach(func() {
+					application.SetDrainTimeout(100 * time.Millisecond)
+				})
+
+				It("stops nginx forcibly", func() {
+					err := application.Run(nginxConfDir, nginxBinPath, SdsIdCreds, SdsC2CCreds, SdsIdValidation)
+					Expect(err).NotTo(HaveOccurred())
+
+					Expect(cmd.Receives()).To(ContainElement(fakes.RunCallReceive{
+						Binary: nginxBinPath,
+						Args:   []string{"-p", nginxConfDir, "-s", "stop"},
+					}))
+					Expect(logger.Messages()).To(ContainElement(ContainSubstring("nginx did not quit within 100ms, stop nginx: ")))
+				})
+			})
+		})
+
+		Context("when a watcher fails after nginx started", func() {
+			var (
+				pidFile string
+				session *gexec.Session
+			)
+
+			BeforeEach(func() {
+				if runtime.GOOS == "windows" {
+					Skip("the test stands in for a daemonized nginx, which does not exist on windows")
+				}
+
+				watcher := &fakes.Watcher{}
+				watcher.WatchFileCall.Returns.After = 300 * time.Millisecond
+				watcher.WatchFileCall.Returns.Error = errors.New("banana")
+				application.SetWatcher(watcher)
+				pidFile = filepath.Join(nginxConfDir, "nginx.pid")
+
+				// Stands in for an nginx master that takes a second to drain.
+				var err error
+				session, err = gexec.Start(exec.Command("sh", "-c", `sleep 1 && rm "$0"`, pidFile), GinkgoWriter, GinkgoWriter)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(os.WriteFile(pidFile, []byte(fmt.Sprintf("%d\n", session.Command.Process.Pid)), 0644)).To(Succeed())
+			})
+
+			AfterEach(func() {
+				session.Kill()
+			})
+
+			It("asks nginx to quit before returning the error", func() {
+				err := application.Run(nginxConfDir, nginxBinPath, SdsIdCreds, SdsC2CCreds, SdsIdValidation)
+				Expect(err).To(MatchError("banana"))
+
+				Expect(session).To(gexec.Exit(0))
+				Expect(cmd.Receives()).To(ContainElement(fakes.RunCallReceive{
+					Binary: nginxBinPath,
+					Args:   []string{"-p", nginxConfDir, "-s", "quit"},
+				}))
+				Expect(logger.Messages()).To(ContainElement(ContainSubstring("failed: banana, quit nginx: ")))
+			})
+		})
+
+		Context("when a shutdown signal is received while waiting for sds files", func() {
+			It("returns without starting nginx", func() {
+				signals := make(chan os.Signal, 1)
+				application.SetShutdownSignals(signals)
+				go func() {
+					time.Sleep(300 * time.Millisecond)
+					signals <- os.Interrupt
+				}()
+
+				err := application.Run(nginxConfDir, nginxBinPath, SdsIdCreds, filepath.Join(nginxConfDir, "never-written.yaml"), SdsIdValidation)
+				Expect(err).NotTo(HaveOccurred())
 
-				Expect(logger.PrintlnCall.Messages).To(ContainElement(ContainSubstring("start nginx: ")))
+				Expect(cmd.Receives()).NotTo(ContainElement(HaveField("Args", Equal([]string{"-p", nginxConfDir}))))
 			})
 		})
 
@@ -1,7 +1,10 @@
 package fakes
 
+import "sync"
+
 type Cmd struct {
 	RunCall struct {
+		sync.Mutex
 		CallCount int
 		Receives  []RunCallReceive
 		Returns   []RunCallReturn
@@ -18,6 +21,9 @@ type RunCallReturn struct {
 }
 
 func (c *Cmd) Run(binary string, args ...string) error {
+	c.RunCall.Lock()
+	defer c.RunCall.Unlock()
+
 	c.RunCall.CallCount++
 	c.RunCall.Receives = append(c.RunCall.Receives, RunCallReceive{Binary: binary, Args: args})
 
@@ -27,3 +33,21 @@ func (c *Cmd) Run(binary string, args ...string) error {
 
 	return c.RunCall.Returns[c.RunCall.CallCount-1].Error
 }
+
+// Returns the number of runs so far, safe to read while the app is still
+// running commands.
+func (c *Cmd) CallCount() int {
+	c.RunCall.Lock()
+	defer c.RunCall.Unlock()
+
+	return c.RunCall.CallCount
+}
+
+// Returns a copy of the runs so far, safe to read while the app is still
+// running commands.
+func (c *Cmd) Receives() []RunCallReceive {
+	c.RunCall.Lock()
+	defer c.RunCall.Unlock()
+
+	return append([]RunCallReceive(nil), c.RunCall.Receives...)
+}
@@ -1,9 +1,13 @@
 package fakes
 
-import "fmt"
+import (
+	"fmt"
+	"sync"
+)
 
 type Logger struct {
 	PrintlnCall struct {
+		sync.Mutex
 		Receives struct {
 			Message []interface{}
 		}
@@ -12,7 +16,19 @@ type Logger struct {
 }
 
 func (l *Logger) Println(v ...interface{}) {
+	l.PrintlnCall.Lock()
+	defer l.PrintlnCall.Unlock()
+
 	l.PrintlnCall.Receives.Message = v
 
 	l.PrintlnCall.Messages = append(l.PrintlnCall.Messages, fmt.Sprintln(v...))
 }
+
+// Returns a copy of the messages logged so far, safe to read while the app
+// is still logging.
+func (l *Logger) Messages() []string {
+	l.PrintlnCall.Lock()
+	defer l.PrintlnCall.Unlock()
+
+	return append([]string(nil), l.PrintlnCall.Messages...)
+}
@@ -0,0 +1,31 @@
+package fakes
+
+import (
+	"sync"
+	"time"
+)
+
+// Reports ready right away, then fails after a while.
+type Watcher struct {
+	WatchFileCall struct {
+		sync.Mutex
+		CallCount int
+		Returns   struct {
+			After time.Duration
+			Error error
+		}
+	}
+}
+
+func (w *Watcher) WatchFile(filePath string, readyChan chan bool, callback func() error) error {
+	w.WatchFileCall.Lock()
+	w.WatchFileCall.CallCount++
+	after := w.WatchFileCall.Returns.After
+	err := w.WatchFileCall.Returns.Error
+	w.WatchFileCall.Unlock()
+
+	readyChan <- true
+	time.Sleep(after)
+
+	return err
+}
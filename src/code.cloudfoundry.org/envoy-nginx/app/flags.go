@@ -1,58 +1,211 @@
 package app
 
-import "strings"
+import (
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
 
 const (
-	DefaultEnvoyConfigPath            = "C:\\etc\\cf-assets\\envoy_config\\envoy.yaml"
-	DefaultSdsIdCertAndKeysPath       = "C:\\etc\\cf-assets\\envoy_config\\sds-server-cert-and-key.yaml"
-	DefaultSdsIdValidationContextPath = "C:\\etc\\cf-assets\\envoy_config\\sds-server-validation-context.yaml"
+	DefaultReloadQuietPeriod = 500 * time.Millisecond
+	DefaultPollInterval      = 1 * time.Second
+	DefaultConcurrency       = 1
+
+	ServeMode    = "serve"
+	ValidateMode = "validate"
+	// Not an envoy mode, set by the translate subcommand.
+	TranslateMode = "translate"
 )
 
+// envoy log levels and the nginx error_log levels they map to.
+var errorLogLevels = map[string]string{
+	"trace":    "debug",
+	"debug":    "debug",
+	"info":     "info",
+	"warning":  "warn",
+	"warn":     "warn",
+	"error":    "error",
+	"critical": "crit",
+	"off":      "emerg",
+}
+
 type Options struct {
 	EnvoyConfig     string
+	EnvoyConfigYaml string
 	SdsIdCreds      string
 	SdsC2CCreds     string
 	SdsIdValidation string
+	// sds files of tls certificate secrets by name, from --sds-secret.
+	SdsSecrets        map[string]string
+	ReloadQuietPeriod time.Duration
+	Watcher           string
+	PollInterval      time.Duration
+	DrainTimeout      time.Duration
+	NginxBin          string
+	Concurrency       int
+	// nginx error_log level mapped from --log-level,
+	// empty if nginx's default should be used.
+	ErrorLogLevel string
+	Mode          string
+	// Path of the njs dynamic module, empty if njs is built into nginx.
+	NjsModule string
+	// Verify client cert SANs with njs, from --verify-san.
+	VerifySAN bool
+	// Close connections after their max_downstream_connection_duration
+	// with njs, from --limit-connection-duration.
+	LimitConnectionDuration bool
+	// Fail on unsupported envoy config fields that affect security.
+	Strict bool
+	// envoy flags that were passed, but have no nginx equivalent.
+	Ignored []string
 }
 
 type Flags struct {
-	options Options
+	flagSet *flag.FlagSet
+	options *Options
+	envoy   *envoyFlags
+}
+
+// envoy flags that are translated before they end up in Options.
+type envoyFlags struct {
+	configYaml     string
+	logLevel       string
+	drainTimeS     int
+	serviceCluster string
+	serviceNode    string
 }
 
 func NewFlags() Flags {
-	return Flags{
-		options: Options{
-			EnvoyConfig:     DefaultEnvoyConfigPath,
-			SdsIdCreds:      DefaultSdsIdCertAndKeysPath,
-			SdsIdValidation: DefaultSdsIdValidationContextPath,
-		},
-	}
-}
-
-func (f Flags) Parse(args []string) Options {
-	for i, arg := range args {
-		switch arg {
-		case "-c":
-			if hasValidArgument(i, args) {
-				f.options.EnvoyConfig = args[i+1]
-			}
-		case "--id-creds":
-			if hasValidArgument(i, args) {
-				f.options.SdsIdCreds = args[i+1]
-			}
-		case "--c2c-creds":
-			if hasValidArgument(i, args) {
-				f.options.SdsC2CCreds = args[i+1]
-			}
-		case "--id-validation":
-			if hasValidArgument(i, args) {
-				f.options.SdsIdValidation = args[i+1]
-			}
+	f := Flags{
+		flagSet: flag.NewFlagSet("envoy", flag.ContinueOnError),
+		options: &Options{SdsSecrets: map[string]string{}},
+		envoy:   &envoyFlags{},
+	}
+	f.flagSet.SetOutput(io.Discard)
+
+	o := f.options
+	e := f.envoy
+	fs := f.flagSet
+	fs.StringVar(&o.EnvoyConfig, "c", DefaultEnvoyConfigPath, "path to the envoy bootstrap config (shorthand)")
+	fs.StringVar(&o.EnvoyConfig, "config-path", DefaultEnvoyConfigPath, "path to the envoy bootstrap config")
+	fs.StringVar(&e.configYaml, "config-yaml", "", "envoy bootstrap config as inline yaml, instead of --config-path")
+	fs.StringVar(&o.SdsIdCreds, "id-creds", DefaultSdsIdCertAndKeysPath, "path to the sds file with the instance identity cert and key")
+	fs.StringVar(&o.SdsC2CCreds, "c2c-creds", "", "path to the sds file with the container to container cert and key")
+	fs.StringVar(&o.SdsIdValidation, "id-validation", DefaultSdsIdValidationContextPath, "path to the sds file with the validation contexts for client certs")
+	fs.Var(sdsSecretsFlag(o.SdsSecrets), "sds-secret", "name=path of the sds file with the cert and key of a tls certificate secret, repeatable")
+	fs.DurationVar(&o.ReloadQuietPeriod, "reload-quiet-period", DefaultReloadQuietPeriod, "how long changed files have to stay unchanged before nginx is reloaded")
+	fs.StringVar(&o.Watcher, "watcher", FsnotifyWatcherKind, fmt.Sprintf("how to watch files for changes, %q or %q", FsnotifyWatcherKind, PollWatcherKind))
+	fs.DurationVar(&o.PollInterval, "poll-interval", DefaultPollInterval, "how often the poll watcher checks files for changes")
+	fs.StringVar(&o.NginxBin, "nginx-bin", "", "path to the nginx binary")
+	fs.IntVar(&o.Concurrency, "concurrency", DefaultConcurrency, "number of nginx worker processes")
+	fs.StringVar(&e.logLevel, "log-level", "", "envoy log level, mapped to the nginx error_log level")
+	fs.IntVar(&e.drainTimeS, "drain-time-s", int(DefaultDrainTimeout/time.Second), "seconds nginx gets to drain connections on shutdown")
+	fs.StringVar(&e.serviceCluster, "service-cluster", "", "ignored")
+	fs.StringVar(&e.serviceNode, "service-node", "", "ignored")
+	fs.StringVar(&o.NjsModule, "njs-module", "", "path to the njs dynamic module that verifies client cert SANs, if njs is not built into nginx")
+	fs.BoolVar(&o.VerifySAN, "verify-san", false, "verify client cert SANs against the matchers of the validation context, needs njs")
+	fs.BoolVar(&o.LimitConnectionDuration, "limit-connection-duration", false, "close connections after the max_downstream_connection_duration of their tcp_proxy, needs njs")
+	fs.BoolVar(&o.Strict, "strict", false, "fail on unsupported envoy config fields that affect security, e.g. certificate pinning")
+	fs.StringVar(&o.Mode, "mode", ServeMode, fmt.Sprintf("envoy mode, %q or %q", ServeMode, ValidateMode))
+
+	return f
+}
+
+// Collects repeated --sds-secret name=path flags.
+type sdsSecretsFlag map[string]string
+
+func (s sdsSecretsFlag) String() string {
+	pairs := []string{}
+	for _, name := range sortedKeys(s) {
+		pairs = append(pairs, fmt.Sprintf("%s=%s", name, s[name]))
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (s sdsSecretsFlag) Set(value string) error {
+	name, path, ok := strings.Cut(value, "=")
+	if !ok || name == "" || path == "" {
+		return fmt.Errorf("invalid --sds-secret %q, expected name=path", value)
+	}
+	s[name] = path
+	return nil
+}
+
+// Parses envoy flags as well as our own. Unknown flags, arguments
+// and invalid values are errors. A leading translate subcommand
+// takes the same flags.
+func (f Flags) Parse(args []string) (Options, error) {
+	translate := len(args) > 0 && args[0] == TranslateMode
+	if translate {
+		args = args[1:]
+	}
+
+	err := f.flagSet.Parse(args)
+	if err != nil {
+		return Options{}, err
+	}
+
+	if f.flagSet.NArg() > 0 {
+		return Options{}, fmt.Errorf("unexpected arguments: %s", strings.Join(f.flagSet.Args(), " "))
+	}
+
+	options := *f.options
+
+	set := map[string]bool{}
+	f.flagSet.Visit(func(fl *flag.Flag) {
+		set[fl.Name] = true
+	})
+
+	if f.envoy.configYaml != "" {
+		if set["c"] || set["config-path"] {
+			return Options{}, fmt.Errorf("--config-yaml cannot be combined with --config-path")
+		}
+		options.EnvoyConfig = ""
+		options.EnvoyConfigYaml = f.envoy.configYaml
+	}
+
+	if options.Concurrency < 1 {
+		return Options{}, fmt.Errorf("--concurrency must be at least 1, got %d", options.Concurrency)
+	}
+
+	if f.envoy.logLevel != "" {
+		level, ok := errorLogLevels[f.envoy.logLevel]
+		if !ok {
+			return Options{}, fmt.Errorf("invalid --log-level %q, expected one of trace, debug, info, warning, warn, error, critical, off", f.envoy.logLevel)
 		}
+		options.ErrorLogLevel = level
 	}
-	return f.options
+
+	if f.envoy.drainTimeS < 0 {
+		return Options{}, fmt.Errorf("--drain-time-s must not be negative, got %d", f.envoy.drainTimeS)
+	}
+	options.DrainTimeout = time.Duration(f.envoy.drainTimeS) * time.Second
+
+	if options.Mode != ServeMode && options.Mode != ValidateMode {
+		return Options{}, fmt.Errorf("unsupported --mode %q, expected %q or %q", options.Mode, ServeMode, ValidateMode)
+	}
+	if translate {
+		if set["mode"] {
+			return Options{}, fmt.Errorf("--mode cannot be combined with translate")
+		}
+		options.Mode = TranslateMode
+	}
+
+	for _, name := range []string{"service-cluster", "service-node"} {
+		if set[name] {
+			options.Ignored = append(options.Ignored, fmt.Sprintf("--%s %s", name, f.flagSet.Lookup(name).Value))
+		}
+	}
+
+	return options, nil
 }
 
-func hasValidArgument(i int, args []string) bool {
-	return (i+1) < len(args) && !strings.HasPrefix(args[i+1], "-")
+// Writes the usage of every flag to w.
+func (f Flags) PrintUsage(w io.Writer) {
+	fmt.Fprintln(w, "Usage of envoy: envoy [translate] [flags]")
+	f.flagSet.SetOutput(w)
+	f.flagSet.PrintDefaults()
+	f.flagSet.SetOutput(io.Discard)
 }
@@ -1,6 +1,9 @@
 package app_test
 
 import (
+	"bytes"
+	"time"
+
 	"code.cloudfoundry.org/envoy-nginx/app"
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
@@ -18,37 +21,190 @@ var _ = Describe("Flags", func() {
 			"--id-creds", SdsIdCreds,
 			"--c2c-creds", SdsC2CCreds,
 			"--id-validation", SdsIdValidation,
+			"--sds-secret", "server-cert-and-key=/etc/cf-assets/envoy_config/sds-server-cert-and-key.yaml",
+			"--sds-secret", "c2c-cert-and-key=" + SdsC2CCreds,
+			"--reload-quiet-period", "2s",
+			"--watcher", "poll",
+			"--poll-interval", "3s",
+			"--drain-time-s", "4",
+			"--nginx-bin", "/usr/sbin/nginx",
+			"--concurrency", "2",
+			"--log-level", "warning",
+			"--mode", "serve",
+			"--njs-module", "modules/ngx_stream_js_module.so",
+			"--verify-san",
+			"--limit-connection-duration",
+			"--strict",
 		}
 		flags = app.NewFlags()
 	})
 
 	Describe("Parse", func() {
 		It("parses known flags and returns options", func() {
-			opts := flags.Parse(args)
+			opts, err := flags.Parse(args)
+			Expect(err).NotTo(HaveOccurred())
 			Expect(opts.EnvoyConfig).To(Equal(EnvoyConfig))
+			Expect(opts.EnvoyConfigYaml).To(BeEmpty())
 			Expect(opts.SdsIdCreds).To(Equal(SdsIdCreds))
 			Expect(opts.SdsC2CCreds).To(Equal(SdsC2CCreds))
 			Expect(opts.SdsIdValidation).To(Equal(SdsIdValidation))
+			Expect(opts.SdsSecrets).To(Equal(map[string]string{
+				"server-cert-and-key": "/etc/cf-assets/envoy_config/sds-server-cert-and-key.yaml",
+				"c2c-cert-and-key":    SdsC2CCreds,
+			}))
+			Expect(opts.ReloadQuietPeriod).To(Equal(2 * time.Second))
+			Expect(opts.Watcher).To(Equal(app.PollWatcherKind))
+			Expect(opts.PollInterval).To(Equal(3 * time.Second))
+			Expect(opts.DrainTimeout).To(Equal(4 * time.Second))
+			Expect(opts.NginxBin).To(Equal("/usr/sbin/nginx"))
+			Expect(opts.Concurrency).To(Equal(2))
+			Expect(opts.ErrorLogLevel).To(Equal("warn"))
+			Expect(opts.Mode).To(Equal(app.ServeMode))
+			Expect(opts.NjsModule).To(Equal("modules/ngx_stream_js_module.so"))
+			Expect(opts.VerifySAN).To(BeTrue())
+			Expect(opts.LimitConnectionDuration).To(BeTrue())
+			Expect(opts.Strict).To(BeTrue())
+			Expect(opts.Ignored).To(BeEmpty())
 		})
 
 		It("has defaults", func() {
-			opts := flags.Parse([]string{})
+			opts, err := flags.Parse([]string{})
+			Expect(err).NotTo(HaveOccurred())
 			Expect(opts.EnvoyConfig).To(Equal(app.DefaultEnvoyConfigPath))
 			Expect(opts.SdsIdCreds).To(Equal(app.DefaultSdsIdCertAndKeysPath))
 			Expect(opts.SdsC2CCreds).To(BeEmpty())
 			Expect(opts.SdsIdValidation).To(Equal(app.DefaultSdsIdValidationContextPath))
+			Expect(opts.SdsSecrets).To(BeEmpty())
+			Expect(opts.ReloadQuietPeriod).To(Equal(app.DefaultReloadQuietPeriod))
+			Expect(opts.Watcher).To(Equal(app.FsnotifyWatcherKind))
+			Expect(opts.PollInterval).To(Equal(app.DefaultPollInterval))
+			Expect(opts.DrainTimeout).To(Equal(app.DefaultDrainTimeout))
+			Expect(opts.NginxBin).To(BeEmpty())
+			Expect(opts.Concurrency).To(Equal(app.DefaultConcurrency))
+			Expect(opts.ErrorLogLevel).To(BeEmpty())
+			Expect(opts.Mode).To(Equal(app.ServeMode))
+			Expect(opts.NjsModule).To(BeEmpty())
+			Expect(opts.VerifySAN).To(BeFalse())
+			Expect(opts.LimitConnectionDuration).To(BeFalse())
+			Expect(opts.Strict).To(BeFalse())
 		})
 
-		It("does not fail with unknown flags", func() {
-			opts := flags.Parse([]string{"--invalid", "invalid"})
-			Expect(opts.EnvoyConfig).To(Equal(app.DefaultEnvoyConfigPath))
+		It("accepts --config-path as the long form of -c", func() {
+			opts, err := flags.Parse([]string{"--config-path", EnvoyConfig})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(opts.EnvoyConfig).To(Equal(EnvoyConfig))
+		})
+
+		It("accepts values that start with a dash", func() {
+			opts, err := flags.Parse([]string{"--id-creds", "-creds.yaml"})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(opts.SdsIdCreds).To(Equal("-creds.yaml"))
+		})
+
+		DescribeTable("maps envoy log levels to nginx error_log levels",
+			func(logLevel, errorLogLevel string) {
+				opts, err := flags.Parse([]string{"--log-level", logLevel})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(opts.ErrorLogLevel).To(Equal(errorLogLevel))
+			},
+			Entry(nil, "trace", "debug"),
+			Entry(nil, "debug", "debug"),
+			Entry(nil, "info", "info"),
+			Entry(nil, "warning", "warn"),
+			Entry(nil, "warn", "warn"),
+			Entry(nil, "error", "error"),
+			Entry(nil, "critical", "crit"),
+			Entry(nil, "off", "emerg"),
+		)
+
+		Context("when --config-yaml is passed", func() {
+			It("uses it instead of a config file", func() {
+				opts, err := flags.Parse([]string{"--config-yaml", "static_resources: {}"})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(opts.EnvoyConfig).To(BeEmpty())
+				Expect(opts.EnvoyConfigYaml).To(Equal("static_resources: {}"))
+			})
+
+			Context("together with --config-path", func() {
+				It("returns a helpful error", func() {
+					_, err := flags.Parse([]string{"--config-yaml", "static_resources: {}", "-c", EnvoyConfig})
+					Expect(err).To(MatchError("--config-yaml cannot be combined with --config-path"))
+				})
+			})
+		})
+
+		It("accepts --mode validate", func() {
+			opts, err := flags.Parse([]string{"--mode", "validate"})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(opts.Mode).To(Equal(app.ValidateMode))
 		})
 
-		Context("when provided a flag with no argument", func() {
-			It("continues to use the default", func() {
-				opts := flags.Parse([]string{"-c", "--id-creds", "--id-validation", "--invalid", "invalid"})
-				Expect(opts.EnvoyConfig).To(Equal(app.DefaultEnvoyConfigPath))
+		Context("when passed the translate subcommand", func() {
+			It("parses the flags following it", func() {
+				opts, err := flags.Parse([]string{"translate", "-c", EnvoyConfig})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(opts.Mode).To(Equal(app.TranslateMode))
+				Expect(opts.EnvoyConfig).To(Equal(EnvoyConfig))
+			})
+
+			Context("together with --mode", func() {
+				It("returns a helpful error", func() {
+					_, err := flags.Parse([]string{"translate", "--mode", "serve"})
+					Expect(err).To(MatchError("--mode cannot be combined with translate"))
+				})
 			})
 		})
+
+		Context("when passed envoy flags without an nginx equivalent", func() {
+			It("reports them as ignored", func() {
+				opts, err := flags.Parse([]string{"--service-cluster", "proxy", "--service-node", "sidecar~10.0.0.1"})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(opts.Ignored).To(Equal([]string{"--service-cluster proxy", "--service-node sidecar~10.0.0.1"}))
+			})
+		})
+
+		Context("when passed an unknown flag", func() {
+			It("returns a helpful error", func() {
+				_, err := flags.Parse([]string{"--invalid", "invalid"})
+				Expect(err).To(MatchError("flag provided but not defined: -invalid"))
+			})
+		})
+
+		Context("when passed arguments that are not flags", func() {
+			It("returns a helpful error", func() {
+				_, err := flags.Parse([]string{"-c", EnvoyConfig, "banana"})
+				Expect(err).To(MatchError("unexpected arguments: banana"))
+			})
+		})
+
+		Context("when a flag is missing its value", func() {
+			It("returns a helpful error", func() {
+				_, err := flags.Parse([]string{"-c"})
+				Expect(err).To(MatchError("flag needs an argument: -c"))
+			})
+		})
+
+		DescribeTable("when provided an invalid value",
+			func(args []string, message string) {
+				_, err := flags.Parse(args)
+				Expect(err).To(MatchError(ContainSubstring(message)))
+			},
+			Entry("sds secret", []string{"--sds-secret", "server-cert-and-key"}, `invalid --sds-secret "server-cert-and-key", expected name=path`),
+			Entry("quiet period", []string{"--reload-quiet-period", "banana"}, `invalid value "banana" for flag -reload-quiet-period`),
+			Entry("concurrency", []string{"--concurrency", "banana"}, `invalid value "banana" for flag -concurrency`),
+			Entry("zero concurrency", []string{"--concurrency", "0"}, "--concurrency must be at least 1, got 0"),
+			Entry("drain time", []string{"--drain-time-s", "-1"}, "--drain-time-s must not be negative, got -1"),
+			Entry("log level", []string{"--log-level", "banana"}, `invalid --log-level "banana"`),
+			Entry("mode", []string{"--mode", "init_only"}, `unsupported --mode "init_only", expected "serve" or "validate"`),
+		)
+	})
+
+	Describe("PrintUsage", func() {
+		It("lists every flag", func() {
+			out := &bytes.Buffer{}
+			flags.PrintUsage(out)
+			Expect(out.String()).To(ContainSubstring("-config-path"))
+			Expect(out.String()).To(ContainSubstring("-service-cluster"))
+		})
 	})
 })
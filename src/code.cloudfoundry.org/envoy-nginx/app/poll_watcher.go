@@ -0,0 +1,131 @@
+package app
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"time"
+)
+
+const (
+	FsnotifyWatcherKind = "fsnotify"
+	PollWatcherKind     = "poll"
+)
+
+// Watches files by way of fsnotify events.
+type NotifyWatcher struct{}
+
+func (NotifyWatcher) WatchFile(filePath string, readyChan chan bool, callback func() error) error {
+	return WatchFile(filePath, readyChan, callback)
+}
+
+// Watches files by comparing their size, modification time and a
+// hash of their contents at a fixed interval. Meant for filesystems
+// where fsnotify drops events or reports them before the file has
+// been written.
+type PollWatcher struct {
+	interval time.Duration
+}
+
+func NewPollWatcher(interval time.Duration) PollWatcher {
+	return PollWatcher{
+		interval: interval,
+	}
+}
+
+// Returns the watcher selected on the command line.
+func NewFileWatcher(kind string, pollInterval time.Duration) (fileWatcher, error) {
+	switch kind {
+	case FsnotifyWatcherKind:
+		return NotifyWatcher{}, nil
+	case PollWatcherKind:
+		if pollInterval <= 0 {
+			return nil, fmt.Errorf("poll interval must be positive, got %s", pollInterval)
+		}
+		return NewPollWatcher(pollInterval), nil
+	default:
+		return nil, fmt.Errorf("unknown watcher %q, expected %q or %q", kind, FsnotifyWatcherKind, PollWatcherKind)
+	}
+}
+
+type fileState struct {
+	exists  bool
+	size    int64
+	modTime time.Time
+	hash    []byte
+}
+
+func (s fileState) equal(other fileState) bool {
+	return s.exists == other.exists &&
+		s.size == other.size &&
+		s.modTime.Equal(other.modTime) &&
+		bytes.Equal(s.hash, other.hash)
+}
+
+/*
+* Same semantics as WatchFile: readyChan tells when the watcher is ready,
+* and callback runs whenever the file was created or changed, but not
+* when it was removed.
+ */
+func (p PollWatcher) WatchFile(filePath string, readyChan chan bool, callback func() error) error {
+	last, err := pollFile(filePath)
+	if err != nil {
+		return err
+	}
+
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+
+	readyChan <- true
+
+	for range ticker.C {
+		current, err := pollFile(filePath)
+		if err != nil {
+			// e.g. the file is locked while being replaced on windows, try again next tick.
+			continue
+		}
+
+		if current.equal(last) {
+			continue
+		}
+		last = current
+
+		if !current.exists {
+			continue
+		}
+
+		err = callback()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func pollFile(filePath string) (fileState, error) {
+	info, err := os.Stat(filePath)
+	if os.IsNotExist(err) {
+		return fileState{}, nil
+	}
+	if err != nil {
+		return fileState{}, fmt.Errorf("stat %s: %s", filePath, err)
+	}
+
+	contents, err := os.ReadFile(filePath)
+	if os.IsNotExist(err) {
+		return fileState{}, nil
+	}
+	if err != nil {
+		return fileState{}, fmt.Errorf("read %s: %s", filePath, err)
+	}
+	hash := sha256.Sum256(contents)
+
+	return fileState{
+		exists:  true,
+		size:    info.Size(),
+		modTime: info.ModTime(),
+		hash:    hash[:],
+	}, nil
+}
@@ -0,0 +1,123 @@
+package app_test
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"code.cloudfoundry.org/envoy-nginx/app"
+	. "code.cloudfoundry.org/envoy-nginx/testhelpers"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("PollWatcher", func() {
+	Describe("WatchFile", func() {
+		var (
+			watchDir  string
+			watchFile string
+			callbacks chan string
+			readyChan chan bool
+		)
+
+		BeforeEach(func() {
+			var err error
+			watchDir, err = os.MkdirTemp("", "watchdir")
+			Expect(err).ToNot(HaveOccurred())
+			watchFile = filepath.Join(watchDir, "sds.yaml")
+
+			callbacks = make(chan string, 10)
+			readyChan = make(chan bool)
+		})
+
+		AfterEach(func() {
+			Expect(os.RemoveAll(watchDir)).NotTo(HaveOccurred())
+		})
+
+		JustBeforeEach(func() {
+			go func() {
+				app.NewPollWatcher(50*time.Millisecond).WatchFile(watchFile, readyChan, func() error {
+					callbacks <- "message"
+					return nil
+				})
+			}()
+			<-readyChan
+		})
+
+		Context("when the file exists", func() {
+			BeforeEach(func() {
+				Expect(os.WriteFile(watchFile, []byte("Hello-0"), 0666)).To(Succeed())
+			})
+
+			It("does not execute the callback while the file is unchanged", func() {
+				Consistently(callbacks, "300ms").ShouldNot(Receive())
+			})
+
+			It("detects rotations and executes the callback, repeatedly", func() {
+				newFile := filepath.Join(watchDir, "new-file")
+				for i := 1; i <= 3; i++ {
+					Expect(os.WriteFile(newFile, []byte(fmt.Sprintf("Hello-%d", i)), 0666)).To(Succeed())
+					Expect(RotateCert(newFile, watchFile)).To(Succeed())
+
+					Eventually(callbacks, "2s").Should(Receive())
+					Consistently(callbacks, "200ms").ShouldNot(Receive())
+				}
+			})
+
+			It("detects changes that keep the size and modification time", func() {
+				info, err := os.Stat(watchFile)
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(os.WriteFile(watchFile, []byte("Hello-1"), 0666)).To(Succeed())
+				Expect(os.Chtimes(watchFile, info.ModTime(), info.ModTime())).To(Succeed())
+
+				Eventually(callbacks, "2s").Should(Receive())
+			})
+
+			It("does not execute the callback when the file is removed", func() {
+				Expect(os.Remove(watchFile)).To(Succeed())
+
+				Consistently(callbacks, "300ms").ShouldNot(Receive())
+			})
+		})
+
+		Context("when the file does not exist yet", func() {
+			It("executes the callback once the file appears", func() {
+				Consistently(callbacks, "200ms").ShouldNot(Receive())
+
+				Expect(os.WriteFile(watchFile, []byte("Hello"), 0666)).To(Succeed())
+
+				Eventually(callbacks, "2s").Should(Receive())
+			})
+		})
+	})
+})
+
+var _ = Describe("NewFileWatcher", func() {
+	It("returns the fsnotify watcher", func() {
+		watcher, err := app.NewFileWatcher(app.FsnotifyWatcherKind, time.Second)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(watcher).To(Equal(app.NotifyWatcher{}))
+	})
+
+	It("returns the poll watcher", func() {
+		watcher, err := app.NewFileWatcher(app.PollWatcherKind, time.Second)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(watcher).To(Equal(app.NewPollWatcher(time.Second)))
+	})
+
+	Context("when the poll interval is not positive", func() {
+		It("returns a helpful error", func() {
+			_, err := app.NewFileWatcher(app.PollWatcherKind, 0)
+			Expect(err).To(MatchError("poll interval must be positive, got 0s"))
+		})
+	})
+
+	Context("when the watcher is unknown", func() {
+		It("returns a helpful error", func() {
+			_, err := app.NewFileWatcher("banana", time.Second)
+			Expect(err).To(MatchError(`unknown watcher "banana", expected "fsnotify" or "poll"`))
+		})
+	})
+})
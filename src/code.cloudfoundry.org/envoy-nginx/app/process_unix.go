@@ -0,0 +1,15 @@
+//go:build !windows
+
+package app
+
+import (
+	"errors"
+	"syscall"
+)
+
+// Signal 0 only checks whether the process exists. EPERM means
+// it exists but belongs to someone else.
+func processAlive(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
@@ -0,0 +1,24 @@
+//go:build windows
+
+package app
+
+import "syscall"
+
+// Exit code reported for processes that are still running.
+const stillActive = 259
+
+func processAlive(pid int) bool {
+	handle, err := syscall.OpenProcess(syscall.PROCESS_QUERY_INFORMATION, false, uint32(pid))
+	if err != nil {
+		return false
+	}
+	defer syscall.CloseHandle(handle)
+
+	var exitCode uint32
+	err = syscall.GetExitCodeProcess(handle, &exitCode)
+	if err != nil {
+		return false
+	}
+
+	return exitCode == stillActive
+}
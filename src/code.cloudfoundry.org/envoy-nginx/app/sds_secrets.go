@@ -0,0 +1,86 @@
+package app
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+
+	"code.cloudfoundry.org/envoy-nginx/parser"
+)
+
+// sds files of tls certificate secrets by name, set from --sds-secret.
+func (a *App) SetSdsSecrets(files map[string]string) {
+	a.sdsSecrets = files
+}
+
+// Returns the tls certificate secrets of the envoy config.
+func (a App) certificateSecrets() ([]parser.TLSCertificateSdsSecretConfig, error) {
+	envoyConfParser := parser.NewEnvoyConfParser()
+
+	envoyConf, err := envoyConfParser.ReadUnmarshalEnvoyConfig(a.envoyConfig)
+	if err != nil {
+		return nil, fmt.Errorf("read and unmarshal Envoy config: %s", err)
+	}
+
+	return envoyConfParser.GetCertificateSecrets(envoyConf), nil
+}
+
+// Returns an sds cred parser for every tls certificate secret of the
+// envoy config and the sds files they read. Secrets without an sds
+// file are logged, nginx leaves out the listeners that use them.
+func (a App) sdsCredParsers(sdsIdCreds, sdsC2CCreds string) ([]parser.SdsCredParser, []string, error) {
+	secrets, err := a.certificateSecrets()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	sdsSecrets := parser.SdsSecrets{
+		Files:    a.sdsSecrets,
+		C2CCreds: sdsC2CCreds,
+		IdCreds:  sdsIdCreds,
+	}
+
+	sdsCredParsers := []parser.SdsCredParser{}
+	files := []string{}
+	for _, secret := range secrets {
+		file, ok := sdsSecrets.Resolve(secret)
+		if !ok {
+			a.logger.Println(fmt.Sprintf("envoy-nginx application: warning: skipping the listeners of tls certificate secret %q that has no sds file", secret.Name))
+			continue
+		}
+
+		sdsCredParsers = append(sdsCredParsers, parser.NewSdsCredParser(secret.Name, file))
+		files = append(files, file)
+	}
+
+	return sdsCredParsers, files, nil
+}
+
+// sds files passed on the command line, which have to exist before
+// nginx is configured.
+func (a App) sdsFiles(sdsIdCreds, sdsC2CCreds, sdsIdValidation string) []string {
+	files := []string{}
+	for _, file := range append([]string{sdsIdCreds, sdsC2CCreds, sdsIdValidation}, sortedValues(a.sdsSecrets)...) {
+		if file != "" && !slices.Contains(files, file) {
+			files = append(files, file)
+		}
+	}
+	return files
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := []string{}
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func sortedValues(m map[string]string) []string {
+	values := []string{}
+	for _, key := range sortedKeys(m) {
+		values = append(values, m[key])
+	}
+	return values
+}
@@ -0,0 +1,68 @@
+package app
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+const (
+	DefaultDrainTimeout = 10 * time.Second
+
+	forcedStopTimeout = 5 * time.Second
+)
+
+// Returns a channel that receives SIGINT and SIGTERM. On windows the
+// console control events (ctrl-c, ctrl-break, closing the console,
+// logoff and shutdown) are delivered as the same two signals.
+func NotifyShutdown() <-chan os.Signal {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	return signals
+}
+
+// Signals that make Run shut nginx down and return.
+func (a *App) SetShutdownSignals(signals <-chan os.Signal) {
+	a.shutdownSignals = signals
+}
+
+// How long nginx gets to finish in-flight connections
+// after a graceful quit before it is stopped forcibly.
+func (a *App) SetDrainTimeout(drainTimeout time.Duration) {
+	a.drainTimeout = drainTimeout
+}
+
+/*
+* Asks nginx to quit gracefully and waits for the supervisor to report
+* that it exited. Once the drain timeout passed, nginx is stopped
+* forcibly. stopping must already be closed, so that the supervisor
+* does not restart nginx. reason tells why, e.g. the signal received.
+ */
+func (a App) shutdownNginx(reason string, nginxDir string, nginxDone <-chan error) error {
+	a.logger.Println(fmt.Sprintf("envoy-nginx application: %s, quit nginx: %s -p %s -s quit", reason, a.nginxBin, nginxDir))
+	err := a.cmd.Run(a.nginxBin, "-p", nginxDir, "-s", "quit")
+	if err != nil {
+		a.logger.Println(fmt.Sprintf("envoy-nginx application: quit nginx: %s", err))
+	}
+
+	select {
+	case err := <-nginxDone:
+		return err
+	case <-time.After(a.drainTimeout):
+	}
+
+	a.logger.Println(fmt.Sprintf("envoy-nginx application: nginx did not quit within %s, stop nginx: %s -p %s -s stop", a.drainTimeout, a.nginxBin, nginxDir))
+	err = a.cmd.Run(a.nginxBin, "-p", nginxDir, "-s", "stop")
+	if err != nil {
+		a.logger.Println(fmt.Sprintf("envoy-nginx application: stop nginx: %s", err))
+	}
+
+	select {
+	case err := <-nginxDone:
+		return err
+	case <-time.After(forcedStopTimeout):
+		return fmt.Errorf("nginx did not stop within %s of being stopped", forcedStopTimeout)
+	}
+}
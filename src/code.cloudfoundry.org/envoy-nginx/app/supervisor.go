@@ -0,0 +1,137 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultMaxRestarts       = 5
+	DefaultRestartBackoff    = time.Second
+	DefaultMaxRestartBackoff = 30 * time.Second
+
+	processPollInterval = 250 * time.Millisecond
+)
+
+// How often nginx may exit unexpectedly and be restarted before
+// the supervisor gives up. The budget is reset once nginx kept
+// running for at least maxBackoff.
+func (a *App) SetMaxRestarts(maxRestarts int) {
+	a.maxRestarts = maxRestarts
+}
+
+// How long to wait before the first restart. The wait doubles
+// with every further restart, up to maxBackoff.
+func (a *App) SetRestartBackoff(backoff, maxBackoff time.Duration) {
+	a.restartBackoff = backoff
+	a.maxRestartBackoff = maxBackoff
+}
+
+// Runs nginx and restarts it with exponential backoff whenever its
+// master process exits unexpectedly. Returns nil once nginx stopped
+// on purpose or after stopping was closed, and an error once the
+// restart budget is used up.
+func (a App) superviseNginx(nginxDir string, stopping <-chan struct{}) error {
+	restarts := 0
+	backoff := a.restartBackoff
+
+	for {
+		select {
+		case <-stopping:
+			return nil
+		default:
+		}
+
+		started := time.Now()
+
+		err := a.runNginx(nginxDir)
+		if err == nil {
+			a.logger.Println("envoy-nginx application: nginx exited")
+			return nil
+		}
+
+		select {
+		case <-stopping:
+			a.logger.Println(fmt.Sprintf("envoy-nginx application: nginx exited while stopping: %s", err))
+			return nil
+		default:
+		}
+
+		if time.Since(started) >= a.maxRestartBackoff {
+			restarts = 0
+			backoff = a.restartBackoff
+		}
+
+		if restarts >= a.maxRestarts {
+			return fmt.Errorf("giving up after %d restarts of nginx: %s", restarts, err)
+		}
+		restarts++
+
+		a.logger.Println(fmt.Sprintf("envoy-nginx application: nginx exited unexpectedly: %s. restart %d of %d in %s", err, restarts, a.maxRestarts, backoff))
+		select {
+		case <-stopping:
+			return nil
+		case <-time.After(backoff):
+		}
+
+		backoff *= 2
+		if backoff > a.maxRestartBackoff {
+			backoff = a.maxRestartBackoff
+		}
+	}
+}
+
+/*
+* Runs nginx until its master process exits. nginx removes nginx.pid
+* when it stops on purpose, so an exit that leaves the pid file behind
+* is unexpected. If nginx daemonized, the command returns right away
+* and the master process is tracked through the pid in nginx.pid.
+ */
+func (a App) runNginx(nginxDir string) error {
+	pidFile := filepath.Join(nginxDir, "nginx.pid")
+
+	a.logger.Println(fmt.Sprintf("envoy-nginx application: start nginx: %s -p %s", a.nginxBin, nginxDir))
+	err := a.cmd.Run(a.nginxBin, "-p", nginxDir)
+	if err != nil {
+		return fmt.Errorf("cmd run: %s", err)
+	}
+
+	pid, err := readPidFile(pidFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for processAlive(pid) {
+		time.Sleep(processPollInterval)
+	}
+
+	_, err = os.Stat(pidFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+
+	return fmt.Errorf("nginx master process %d exited without removing %s", pid, pidFile)
+}
+
+func readPidFile(pidFile string) (int, error) {
+	contents, err := os.ReadFile(pidFile)
+	if err != nil {
+		return 0, err
+	}
+
+	pid, err := strconv.Atoi(strings.TrimSpace(string(contents)))
+	if err != nil {
+		return 0, fmt.Errorf("parse %s: %s", pidFile, err)
+	}
+
+	return pid, nil
+}
@@ -0,0 +1,90 @@
+package app
+
+import (
+	"fmt"
+	"io"
+
+	"code.cloudfoundry.org/envoy-nginx/parser"
+)
+
+// Checks the envoy config and sds files offline, the way `envoy --mode
+// validate` does: writes the tls files and nginx.conf to nginxConfDir
+// and, if an nginx binary is given, runs `nginx -t` against them.
+// Every step that passed is logged, the first one that failed is
+// returned.
+func (a App) Validate(nginxConfDir, nginxBinPath, sdsIdCreds, sdsC2CCreds, sdsIdValidation string) error {
+	err := createNginxDirs(nginxConfDir)
+	if err != nil {
+		return err
+	}
+
+	sdsCredParsers, _, err := a.sdsCredParsers(sdsIdCreds, sdsC2CCreds)
+	if err != nil {
+		return fmt.Errorf("generate nginx config from envoy config: %s", err)
+	}
+	nginxConfParser := a.newNginxConfig(nginxConfDir, sdsCredParsers, sdsIdValidation)
+
+	err = nginxConfParser.WriteTLSFiles()
+	if err != nil {
+		return fmt.Errorf("write tls files: %s", err)
+	}
+	a.logger.Println("envoy-nginx application: validate: sds files OK")
+
+	err = a.checkSANMatchers(nginxConfParser)
+	if err != nil {
+		return err
+	}
+
+	err = nginxConfParser.Generate(a.envoyConfig)
+	if err != nil {
+		return fmt.Errorf("generate nginx config from envoy config: %s", err)
+	}
+
+	err = a.checkCompatibility(sdsIdValidation)
+	if err != nil {
+		return err
+	}
+	a.logger.Println(fmt.Sprintf("envoy-nginx application: validate: envoy config %s OK", a.envoyConfig))
+
+	if nginxBinPath == "" {
+		a.logger.Println("envoy-nginx application: validate: no nginx binary, skipping nginx -t")
+		return nil
+	}
+
+	err = a.cmd.Run(nginxBinPath, "-t", "-p", nginxConfDir)
+	if err != nil {
+		return fmt.Errorf("nginx -t: %s", err)
+	}
+	a.logger.Println("envoy-nginx application: validate: nginx -t OK")
+
+	return nil
+}
+
+// Writes the nginx.conf generated from the envoy config to out. Paths
+// in it point into nginxConfDir, which is neither read nor written, so
+// the same envoy config and nginxConfDir always give the same output.
+// No sds file is read either, every secret is assumed to have one.
+func (a App) Translate(nginxConfDir string, out io.Writer) error {
+	secrets, err := a.certificateSecrets()
+	if err != nil {
+		return fmt.Errorf("translate envoy config: %s", err)
+	}
+
+	sdsCredParsers := []parser.SdsCredParser{}
+	for _, secret := range secrets {
+		sdsCredParsers = append(sdsCredParsers, parser.NewSdsCredParser(secret.Name, ""))
+	}
+	nginxConfParser := a.newNginxConfig(nginxConfDir, sdsCredParsers, "")
+
+	conf, err := nginxConfParser.Translate(a.envoyConfig)
+	if err != nil {
+		return fmt.Errorf("translate envoy config: %s", err)
+	}
+
+	_, err = out.Write(conf)
+	if err != nil {
+		return fmt.Errorf("write nginx config: %s", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,217 @@
+package app_test
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+
+	"code.cloudfoundry.org/envoy-nginx/app"
+	"code.cloudfoundry.org/envoy-nginx/app/fakes"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Validate", func() {
+	var (
+		logger *fakes.Logger
+		cmd    *fakes.Cmd
+
+		nginxConfDir string
+
+		application app.App
+	)
+
+	BeforeEach(func() {
+		logger = &fakes.Logger{}
+		cmd = &fakes.Cmd{}
+
+		var err error
+		nginxConfDir, err = os.MkdirTemp("", "nginx")
+		Expect(err).ToNot(HaveOccurred())
+
+		application = app.NewApp(logger, cmd, &fakes.Tailer{}, EnvoyConfig)
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(nginxConfDir)).NotTo(HaveOccurred())
+	})
+
+	It("generates the nginx config and checks it with nginx -t", func() {
+		err := application.Validate(nginxConfDir, "some-nginx", SdsIdCreds, SdsC2CCreds, SdsIdValidation)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(filepath.Join(nginxConfDir, "conf", "nginx.conf")).To(BeAnExistingFile())
+		Expect(filepath.Join(nginxConfDir, "id-cert.pem")).To(BeAnExistingFile())
+		Expect(cmd.Receives()).To(Equal([]fakes.RunCallReceive{
+			{Binary: "some-nginx", Args: []string{"-t", "-p", nginxConfDir}},
+		}))
+		Expect(logger.Messages()).To(ContainElements(
+			ContainSubstring("validate: sds files OK"),
+			ContainSubstring("validate: envoy config "+EnvoyConfig+" OK"),
+			ContainSubstring("validate: nginx -t OK"),
+		))
+	})
+
+	It("warns about subject alt name matchers that are not verified", func() {
+		err := application.Validate(nginxConfDir, "", SdsIdCreds, SdsC2CCreds, SdsIdValidation)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(logger.Messages()).To(ContainElement(ContainSubstring("subject alt name matchers of the validation context are ignored without --verify-san: ANY client cert signed by its ca is accepted")))
+	})
+
+	Context("when strict and subject alt name matchers are not verified", func() {
+		BeforeEach(func() {
+			application.SetStrict(true)
+		})
+
+		It("returns a helpful error", func() {
+			err := application.Validate(nginxConfDir, "some-nginx", SdsIdCreds, SdsC2CCreds, SdsIdValidation)
+			Expect(err).To(MatchError("strict: subject alt name matchers of the validation context are only verified with --verify-san"))
+
+			Expect(cmd.CallCount()).To(Equal(0))
+		})
+	})
+
+	Context("when there is no nginx binary", func() {
+		It("skips nginx -t", func() {
+			err := application.Validate(nginxConfDir, "", SdsIdCreds, SdsC2CCreds, SdsIdValidation)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(cmd.CallCount()).To(Equal(0))
+			Expect(logger.Messages()).To(ContainElement(ContainSubstring("no nginx binary, skipping nginx -t")))
+		})
+	})
+
+	Context("when an sds file cannot be read", func() {
+		It("returns a helpful error", func() {
+			err := application.Validate(nginxConfDir, "some-nginx", "not-a-real-file", SdsC2CCreds, SdsIdValidation)
+			Expect(err).To(MatchError(ContainSubstring("write tls files: ")))
+
+			Expect(cmd.CallCount()).To(Equal(0))
+		})
+	})
+
+	Context("when the envoy config is invalid", func() {
+		BeforeEach(func() {
+			application = app.NewApp(logger, cmd, &fakes.Tailer{}, "not-a-real-file")
+		})
+
+		It("returns a helpful error", func() {
+			err := application.Validate(nginxConfDir, "some-nginx", SdsIdCreds, SdsC2CCreds, SdsIdValidation)
+			Expect(err).To(MatchError(ContainSubstring("generate nginx config from envoy config: ")))
+		})
+	})
+
+	It("warns about envoy config fields that are not translated", func() {
+		err := application.Validate(nginxConfDir, "some-nginx", SdsIdCreds, SdsC2CCreds, SdsIdValidation)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(logger.Messages()).To(ContainElement(
+			ContainSubstring("warning: unsupported envoy config field is ignored: static_resources.clusters[0].type"),
+		))
+	})
+
+	Context("when strict and the envoy config has unsupported security relevant fields", func() {
+		BeforeEach(func() {
+			envoyConfig := filepath.Join(nginxConfDir, "envoy.yaml")
+			contents, err := os.ReadFile(EnvoyConfig)
+			Expect(err).NotTo(HaveOccurred())
+			contents = bytes.Replace(contents, []byte("common_tls_context:\n"),
+				[]byte("common_tls_context:\n            validation_context:\n              match_subject_alt_names:\n              - exact: some-san\n"), 1)
+			Expect(os.WriteFile(envoyConfig, contents, 0644)).To(Succeed())
+
+			application = app.NewApp(logger, cmd, &fakes.Tailer{}, envoyConfig)
+			application.SetVerifySAN(true)
+			application.SetStrict(true)
+		})
+
+		It("returns a helpful error", func() {
+			err := application.Validate(nginxConfDir, "some-nginx", SdsIdCreds, SdsC2CCreds, SdsIdValidation)
+			Expect(err).To(MatchError(ContainSubstring("strict: unsupported security relevant envoy config fields: static_resources.listeners[0].filter_chains[0].transport_socket.typed_config.common_tls_context.validation_context")))
+
+			Expect(cmd.CallCount()).To(Equal(0))
+		})
+	})
+
+	Context("when strict and the validation context has unsupported security relevant fields", func() {
+		var sdsIdValidationFile string
+
+		BeforeEach(func() {
+			contents, err := os.ReadFile(SdsIdValidation)
+			Expect(err).NotTo(HaveOccurred())
+			contents = bytes.Replace(contents, []byte("    verify_subject_alt_name:\n"),
+				[]byte("    crl:\n      inline_string: some-crl\n    verify_subject_alt_name:\n"), 1)
+			sdsIdValidationFile = filepath.Join(nginxConfDir, "sds-id-validation-context.yaml")
+			Expect(os.WriteFile(sdsIdValidationFile, contents, 0644)).To(Succeed())
+
+			application.SetVerifySAN(true)
+			application.SetStrict(true)
+		})
+
+		It("warns about the field and returns a helpful error", func() {
+			err := application.Validate(nginxConfDir, "some-nginx", SdsIdCreds, SdsC2CCreds, sdsIdValidationFile)
+			Expect(err).To(MatchError("strict: unsupported security relevant sds validation context fields: resources[0].validation_context.crl"))
+
+			Expect(logger.Messages()).To(ContainElement(
+				ContainSubstring("warning: unsupported sds validation context field is ignored: resources[0].validation_context.crl (security relevant)"),
+			))
+			Expect(cmd.CallCount()).To(Equal(0))
+		})
+	})
+
+	Context("when nginx -t fails", func() {
+		BeforeEach(func() {
+			cmd.RunCall.Returns = []fakes.RunCallReturn{{Error: errors.New("banana")}}
+		})
+
+		It("returns a helpful error", func() {
+			err := application.Validate(nginxConfDir, "some-nginx", SdsIdCreds, SdsC2CCreds, SdsIdValidation)
+			Expect(err).To(MatchError("nginx -t: banana"))
+		})
+	})
+})
+
+var _ = Describe("Translate", func() {
+	var (
+		nginxConfDir string
+		application  app.App
+	)
+
+	BeforeEach(func() {
+		var err error
+		nginxConfDir, err = os.MkdirTemp("", "nginx")
+		Expect(err).ToNot(HaveOccurred())
+
+		application = app.NewApp(&fakes.Logger{}, &fakes.Cmd{}, &fakes.Tailer{}, EnvoyConfig)
+		application.SetWorkerProcesses(2)
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(nginxConfDir)).NotTo(HaveOccurred())
+	})
+
+	It("writes the nginx config to out without touching the nginx config dir", func() {
+		out := &bytes.Buffer{}
+		err := application.Translate(nginxConfDir, out)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(out.String()).To(ContainSubstring("worker_processes 2;"))
+		Expect(out.String()).To(ContainSubstring("listen 61001 ssl;"))
+
+		files, err := os.ReadDir(nginxConfDir)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(files).To(BeEmpty())
+	})
+
+	Context("when the envoy config cannot be read", func() {
+		BeforeEach(func() {
+			application = app.NewApp(&fakes.Logger{}, &fakes.Cmd{}, &fakes.Tailer{}, "not-a-real-file")
+		})
+
+		It("returns a helpful error", func() {
+			err := application.Translate(nginxConfDir, &bytes.Buffer{})
+			Expect(err).To(MatchError(ContainSubstring("translate envoy config: ")))
+		})
+	})
+})
@@ -2,63 +2,123 @@ package app
 
 import (
 	"errors"
+	"fmt"
+	"path/filepath"
 
 	fsnotify "github.com/fsnotify/fsnotify"
 )
 
-/* readyChan tell when the watcher is ready */
-func WatchFile(filepath string, readyChan chan bool, callback func() error) error {
+/*
+* Watches the directory the file lives in rather than the file itself and
+* filters events by file name. That way replacing the file via rename,
+* creating it only after startup, or swapping a symlink in its path (e.g.
+* the ..data symlink of a kubernetes-style secret volume) are all picked up
+* without having to re-add a watch on a file that may not exist.
+* readyChan tells when the watcher is ready.
+ */
+func WatchFile(filePath string, readyChan chan bool, callback func() error) error {
 	watcher, err := fsnotify.NewWatcher()
 	if err != nil {
 		return err
 	}
 	defer watcher.Close()
 
-	watcherErr := make(chan error)
+	dir := filepath.Dir(filePath)
+	err = watcher.Add(dir)
+	if err != nil {
+		return err
+	}
 
-	go func() {
-		for {
-			select {
-			case event, ok := <-watcher.Events:
-				if !ok {
-					watcherErr <- errors.New("File watcher: unexpected event")
-				}
-				if event.Op&fsnotify.Create == fsnotify.Create ||
-					event.Op&fsnotify.Write == fsnotify.Write ||
-					event.Op&fsnotify.Remove == fsnotify.Remove ||
-					event.Op&fsnotify.Rename == fsnotify.Rename {
+	/*
+	* If the file is a symlink, its target may be rewritten in place in a
+	* directory of its own, so that directory is watched as well.
+	 */
+	target := resolveFile(filePath)
+	targetDir := ""
+	watchTargetDir := func() {
+		newTargetDir := ""
+		if target != "" && filepath.Dir(target) != dir {
+			newTargetDir = filepath.Dir(target)
+		}
+		if newTargetDir == targetDir {
+			return
+		}
+		if targetDir != "" {
+			watcher.Remove(targetDir)
+		}
+		if newTargetDir != "" && watcher.Add(newTargetDir) != nil {
+			newTargetDir = ""
+		}
+		targetDir = newTargetDir
+	}
+	watchTargetDir()
 
-					/*
-					* It is important to re-add because though the filepath hasn't changed,
-					* it's a new file in the fs.
-					* Maybe it watches the inode or something
-					 */
-					err := watcher.Add(filepath)
-					if err != nil {
-						watcherErr <- err
-					}
+	readyChan <- true
+
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return errors.New("File watcher: unexpected event")
+			}
+			if !event.Has(fsnotify.Create) &&
+				!event.Has(fsnotify.Write) &&
+				!event.Has(fsnotify.Remove) &&
+				!event.Has(fsnotify.Rename) {
+				continue
+			}
 
-					err = callback()
-					if err != nil {
-						watcherErr <- err
-					}
-				}
-			case err, ok := <-watcher.Errors:
-				if err != nil {
-					watcherErr <- err
-				}
-				if !ok {
-					watcherErr <- errors.New("File watcher: unexpected error")
-				}
+			// The watch is gone with the directory, so nothing is picked up anymore.
+			if filepath.Clean(event.Name) == filepath.Clean(dir) &&
+				(event.Has(fsnotify.Remove) || event.Has(fsnotify.Rename)) {
+				return fmt.Errorf("File watcher: watched directory %s was removed", dir)
+			}
+
+			newTarget := resolveFile(filePath)
+			if !isEventFor(event, filePath, target) && newTarget == target {
+				// Something else in one of the watched directories changed.
+				continue
+			}
+			target = newTarget
+			watchTargetDir()
+
+			// The file was removed or moved away; it will be picked up again once it reappears.
+			if target == "" {
+				continue
+			}
+
+			err := callback()
+			if err != nil {
+				return err
+			}
+		case err, ok := <-watcher.Errors:
+			if err != nil {
+				return err
+			}
+			if !ok {
+				return errors.New("File watcher: unexpected error")
 			}
 		}
-	}()
+	}
+}
 
-	err = watcher.Add(filepath)
+func isEventFor(event fsnotify.Event, filePath, target string) bool {
+	return filepath.Clean(event.Name) == filepath.Clean(filePath) ||
+		(target != "" && filepath.Clean(event.Name) == target)
+}
+
+// Returns the path the file resolves to once all symlinks are
+// followed, or "" if it does not exist.
+func resolveFile(filePath string) string {
+	target, err := filepath.EvalSymlinks(filePath)
 	if err != nil {
-		return err
+		return ""
+	}
+
+	absTarget, err := filepath.Abs(target)
+	if err != nil {
+		return ""
 	}
-	readyChan <- true
 
-	return <-watcherErr
+	return absTarget
 }
@@ -3,6 +3,8 @@ package app_test
 import (
 	"fmt"
 	"os"
+	"path/filepath"
+	"runtime"
 
 	"code.cloudfoundry.org/envoy-nginx/app"
 	. "code.cloudfoundry.org/envoy-nginx/testhelpers"
@@ -63,5 +65,103 @@ var _ = Describe("Watcher", func() {
 				Expect(str).Should(Equal("message"))
 			}
 		})
+
+		Context("when watching a file in a directory of its own", func() {
+			var (
+				watchDir  string
+				watchFile string
+				callbacks chan string
+				readyChan chan bool
+				watchErr  chan error
+			)
+
+			BeforeEach(func() {
+				watchDir, err = os.MkdirTemp("", "watchdir")
+				Expect(err).ToNot(HaveOccurred())
+				watchFile = filepath.Join(watchDir, "sds.yaml")
+
+				callbacks = make(chan string, 10)
+				readyChan = make(chan bool)
+				watchErr = make(chan error, 1)
+			})
+
+			AfterEach(func() {
+				Expect(os.RemoveAll(watchDir)).NotTo(HaveOccurred())
+				Eventually(watchErr, "10s").Should(Receive(MatchError(ContainSubstring("watched directory"))))
+			})
+
+			JustBeforeEach(func() {
+				// The next spec reassigns the shared variables, so the watcher only sees its own.
+				callbacks, readyChan, watchErr := callbacks, readyChan, watchErr
+				go func() {
+					watchErr <- app.WatchFile(watchFile, readyChan, func() error {
+						callbacks <- "message"
+						return nil
+					})
+				}()
+				<-readyChan
+			})
+
+			Context("when the file does not exist yet", func() {
+				It("executes the callback once the file appears", func() {
+					Consistently(callbacks, "200ms").ShouldNot(Receive())
+
+					err = os.WriteFile(newFile, []byte("Hello"), 0666)
+					Expect(err).ToNot(HaveOccurred())
+					err = RotateCert(newFile, watchFile)
+					Expect(err).ToNot(HaveOccurred())
+
+					Eventually(callbacks, "10s").Should(Receive())
+				})
+			})
+
+			Context("when the file exists", func() {
+				BeforeEach(func() {
+					err = os.WriteFile(watchFile, []byte("Hello"), 0666)
+					Expect(err).ToNot(HaveOccurred())
+				})
+
+				It("ignores changes to other files in the directory", func() {
+					err = os.WriteFile(filepath.Join(watchDir, "other.yaml"), []byte("Hello"), 0666)
+					Expect(err).ToNot(HaveOccurred())
+
+					Consistently(callbacks, "500ms").ShouldNot(Receive())
+				})
+
+				It("does not execute the callback when the file is removed", func() {
+					Expect(os.Remove(watchFile)).To(Succeed())
+
+					Consistently(callbacks, "500ms").ShouldNot(Receive())
+				})
+			})
+
+			Context("when the file is a symlink into a ..data directory", func() {
+				swapData := func(name, content string) {
+					dataDir := filepath.Join(watchDir, name)
+					Expect(os.Mkdir(dataDir, os.ModePerm)).To(Succeed())
+					Expect(os.WriteFile(filepath.Join(dataDir, "sds.yaml"), []byte(content), 0666)).To(Succeed())
+
+					Expect(os.Symlink(name, filepath.Join(watchDir, "..data_tmp"))).To(Succeed())
+					Expect(os.Rename(filepath.Join(watchDir, "..data_tmp"), filepath.Join(watchDir, "..data"))).To(Succeed())
+				}
+
+				BeforeEach(func() {
+					if runtime.GOOS == "windows" {
+						Skip("creating symlinks requires elevated privileges on windows")
+					}
+
+					swapData("..2024_01", "Hello-0")
+					Expect(os.Symlink(filepath.Join("..data", "sds.yaml"), watchFile)).To(Succeed())
+				})
+
+				It("executes the callback when the ..data symlink is swapped", func() {
+					swapData("..2024_02", "Hello-1")
+					Eventually(callbacks, "10s").Should(Receive())
+
+					swapData("..2024_03", "Hello-2")
+					Eventually(callbacks, "10s").Should(Receive())
+				})
+			})
+		})
 	})
 })
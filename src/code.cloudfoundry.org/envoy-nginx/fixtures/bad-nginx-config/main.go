@@ -0,0 +1,24 @@
+/* Program to simulate an nginx that rejects every config it is asked to test */
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+func main() {
+	fmt.Println(strings.Join(os.Args, ","))
+
+	for _, arg := range os.Args {
+		if arg == "-t" {
+			os.Exit(1)
+		}
+		if arg == "-s" {
+			return
+		}
+	}
+
+	time.Sleep(3 * time.Second)
+}
@@ -1,4 +1,4 @@
-/* Program to simulate an nginx that always fails */
+/* Program to simulate an nginx that always fails to reload */
 package main
 
 import (
@@ -15,7 +15,10 @@ func main() {
 		if arg == "-s" && len(os.Args) > i+1 && os.Args[i+1] == "reload" {
 			os.Exit(1)
 		}
+		if arg == "-t" {
+			return
+		}
 	}
 
-	time.Sleep(1 * time.Second)
+	time.Sleep(3 * time.Second)
 }
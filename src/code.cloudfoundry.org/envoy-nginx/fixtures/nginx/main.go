@@ -10,5 +10,13 @@ import (
 func main() {
 	fmt.Println(strings.Join(os.Args, ","))
 
+	// Like the real nginx, signalling the master process
+	// or testing the config returns straight away.
+	for _, arg := range os.Args {
+		if arg == "-s" || arg == "-t" {
+			return
+		}
+	}
+
 	time.Sleep(3 * time.Second)
 }
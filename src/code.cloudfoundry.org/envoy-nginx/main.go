@@ -1,6 +1,9 @@
 package main
 
 import (
+	"errors"
+	"flag"
+	"fmt"
 	"log"
 	"os"
 
@@ -9,17 +12,75 @@ import (
 
 func main() {
 	flags := app.NewFlags()
-	opts := flags.Parse(os.Args[1:])
+	opts, err := flags.Parse(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		flags.PrintUsage(os.Stdout)
+		os.Exit(0)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "envoy-nginx application: %s\n", err)
+		flags.PrintUsage(os.Stderr)
+		os.Exit(2)
+	}
 
 	stderr := app.NewLogger(os.Stderr)
 	tailer := app.NewLogTailer(stderr)
 
 	cmd := app.NewCmd(os.Stdout, os.Stderr)
 	stdout := app.NewLogger(os.Stdout)
-	application := app.NewApp(stdout, cmd, tailer, opts.EnvoyConfig)
+	if opts.Mode == app.TranslateMode {
+		// stdout is reserved for the translated nginx.conf.
+		cmd = app.NewCmd(os.Stderr, os.Stderr)
+		stdout = stderr
+	}
 
-	nginxBinPath, err := application.GetNginxPath()
+	for _, ignored := range opts.Ignored {
+		stdout.Println(fmt.Sprintf("envoy-nginx application: ignoring %s as it has no nginx equivalent", ignored))
+	}
+
+	envoyConfig := opts.EnvoyConfig
+	if opts.EnvoyConfigYaml != "" {
+		envoyConfig, err = writeEnvoyConfigYaml(opts.EnvoyConfigYaml)
+		if err != nil {
+			log.Fatalf("envoy-nginx application: write --config-yaml: %s", err)
+		}
+	}
+
+	application := app.NewApp(stdout, cmd, tailer, envoyConfig)
+	application.SetReloadQuietPeriod(opts.ReloadQuietPeriod)
+	application.SetDrainTimeout(opts.DrainTimeout)
+	application.SetWorkerProcesses(opts.Concurrency)
+	application.SetErrorLogLevel(opts.ErrorLogLevel)
+	application.SetNjsModule(opts.NjsModule)
+	application.SetVerifySAN(opts.VerifySAN)
+	application.SetLimitConnectionDuration(opts.LimitConnectionDuration)
+	application.SetSdsSecrets(opts.SdsSecrets)
+	application.SetStrict(opts.Strict)
+
+	if opts.Mode == app.TranslateMode {
+		err = application.Translate(".", os.Stdout)
+		removeEnvoyConfigYaml(opts, envoyConfig)
+		if err != nil {
+			log.Fatalf("envoy-nginx application: %s", err)
+		}
+		return
+	}
+
+	application.SetShutdownSignals(app.NotifyShutdown())
+
+	watcher, err := app.NewFileWatcher(opts.Watcher, opts.PollInterval)
 	if err != nil {
+		log.Fatalf("envoy-nginx application: select file watcher: %s", err)
+	}
+	application.SetWatcher(watcher)
+
+	application.SetNginxBin(opts.NginxBin)
+	nginxBinPath, err := application.GetNginxPath()
+	if err != nil && opts.Mode == app.ValidateMode {
+		// Validating without nginx -t is still worth it.
+		stdout.Println(fmt.Sprintf("envoy-nginx application: get nginx-path: %s", err))
+		nginxBinPath = ""
+	} else if err != nil {
 		log.Fatalf("envoy-nginx application: get nginx-path: %s", err)
 	}
 
@@ -28,8 +89,50 @@ func main() {
 		log.Fatalf("envoy-nginx application: create nginx config dir: %s", err)
 	}
 
-	err = application.Run(nginxConfDir, nginxBinPath, opts.SdsIdCreds, opts.SdsC2CCreds, opts.SdsIdValidation)
+	if opts.Mode == app.ValidateMode {
+		err = application.Validate(nginxConfDir, nginxBinPath, opts.SdsIdCreds, opts.SdsC2CCreds, opts.SdsIdValidation)
+	} else {
+		err = application.Run(nginxConfDir, nginxBinPath, opts.SdsIdCreds, opts.SdsC2CCreds, opts.SdsIdValidation)
+	}
+
+	// The nginx config dir holds the private keys, so it
+	// must not outlive us, whether nginx failed or not.
+	removeErr := os.RemoveAll(nginxConfDir)
+	removeEnvoyConfigYaml(opts, envoyConfig)
+
+	if err != nil && opts.Mode == app.ValidateMode {
+		log.Fatalf("envoy-nginx application: validation failed: %s", err)
+	}
 	if err != nil {
 		log.Fatalf("envoy-nginx application: load: %s", err)
 	}
+	if removeErr != nil {
+		log.Fatalf("envoy-nginx application: remove nginx config dir: %s", removeErr)
+	}
+	if opts.Mode == app.ValidateMode {
+		stdout.Println("envoy-nginx application: configuration OK")
+	}
+}
+
+func removeEnvoyConfigYaml(opts app.Options, envoyConfig string) {
+	if opts.EnvoyConfigYaml != "" {
+		os.Remove(envoyConfig)
+	}
+}
+
+// The rest of the app reads and watches the envoy config as a file.
+func writeEnvoyConfigYaml(configYaml string) (string, error) {
+	file, err := os.CreateTemp("", "envoy-config-*.yaml")
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	_, err = file.WriteString(configYaml)
+	if err != nil {
+		os.Remove(file.Name())
+		return "", err
+	}
+
+	return file.Name(), nil
 }
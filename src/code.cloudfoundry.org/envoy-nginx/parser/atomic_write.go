@@ -0,0 +1,105 @@
+package parser
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+type atomicFile struct {
+	path     string
+	contents []byte
+}
+
+// Writes contents to a temp file next to path and renames it into
+// place, so that nginx only ever reads the old or the new contents
+// and never a half written file.
+func writeFileAtomic(path string, contents []byte) error {
+	return writeFilesAtomic([]atomicFile{{path: path, contents: contents}})
+}
+
+// Writes every file to a temp file first and only starts renaming
+// once all of them have been written, so that e.g. a cert and its
+// key are swapped as a unit. If a rename fails, the files that were
+// already renamed get their previous contents back.
+func writeFilesAtomic(files []atomicFile) error {
+	tmpFiles := make([]string, 0, len(files))
+	defer func() {
+		for _, tmpFile := range tmpFiles {
+			os.Remove(tmpFile)
+		}
+	}()
+
+	for _, file := range files {
+		tmpFile, err := writeTempFile(file.path, file.contents)
+		if err != nil {
+			return err
+		}
+		tmpFiles = append(tmpFiles, tmpFile)
+	}
+
+	previous := make([]atomicFile, 0, len(files))
+	for _, file := range files {
+		contents, err := os.ReadFile(file.path)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("read %s: %s", file.path, err)
+		}
+
+		previous = append(previous, atomicFile{path: file.path, contents: contents})
+	}
+
+	for i, file := range files {
+		err := os.Rename(tmpFiles[i], file.path)
+		if err != nil {
+			rollback(previous[:i])
+			return fmt.Errorf("rename %s: %s", file.path, err)
+		}
+	}
+
+	return nil
+}
+
+func writeTempFile(path string, contents []byte) (string, error) {
+	tmp, err := os.CreateTemp(filepath.Dir(path), fmt.Sprintf(".%s.*.tmp", filepath.Base(path)))
+	if err != nil {
+		return "", fmt.Errorf("create temp file for %s: %s", path, err)
+	}
+
+	_, err = tmp.Write(contents)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	closeErr := tmp.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), FilePerm)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", fmt.Errorf("write temp file for %s: %s", path, err)
+	}
+
+	return tmp.Name(), nil
+}
+
+// Best effort: the rename that failed is already being reported.
+func rollback(previous []atomicFile) {
+	for _, file := range previous {
+		if file.contents == nil {
+			os.Remove(file.path)
+			continue
+		}
+
+		tmpFile, err := writeTempFile(file.path, file.contents)
+		if err != nil {
+			continue
+		}
+		if os.Rename(tmpFile, file.path) != nil {
+			os.Remove(tmpFile)
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package parser
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// A Candidate is a complete set of cert, key, ca cert and nginx.conf
+// staged in a directory of its own, so that it can be checked with
+// `nginx -t -p <dir>` before it replaces the live set. The validation
+// contexts are read once when staging, so that what is promoted is
+// what was checked, even if the sds file changes in the meantime.
+type Candidate struct {
+	NginxConfig
+	contexts []SdsValidationContext
+	// The live nginx.conf, rendered from the same model as the
+	// staged one but pointing at the live files.
+	liveConf []byte
+}
+
+// Returns a copy of the nginx config that writes its files to dir.
+func (n NginxConfig) withDir(dir string) NginxConfig {
+	candidate := NewNginxConfig(n.envoyConfParser, n.sdsCredParsers, n.sdsValidationParser, dir)
+	candidate.workerProcesses = n.workerProcesses
+	candidate.errorLogLevel = n.errorLogLevel
+	candidate.njsModule = n.njsModule
+	candidate.verifySAN = n.verifySAN
+	candidate.limitConnectionDuration = n.limitConnectionDuration
+	return candidate
+}
+
+// Files that make up a running nginx config, in a fixed order so
+// that the same file can be looked up across directories: the cert
+// and key of every secret, then the files of the validation contexts
+// in the order of the sds file.
+func (n NginxConfig) files(contexts []SdsValidationContext) []string {
+	files := []string{n.confFile}
+	for _, sdsCredParser := range n.sdsCredParsers {
+		certFile, keyFile := n.certificateFiles(sdsCredParser.Name())
+		files = append(files, certFile, keyFile)
+	}
+	files = append(files, n.connectionDurationFile, n.trustedCAFile, n.sanVerifierFile)
+	// The first validation context is written to the files above.
+	for i := 1; i < len(contexts); i++ {
+		validationFiles := n.validationFiles(i, contexts)
+		files = append(files, validationFiles.caFile, validationFiles.sanVerifierFile)
+	}
+
+	return files
+}
+
+// Writes cert, key, ca cert and nginx.conf generated from the
+// current envoy config and sds files into dir. Anything left in
+// dir from a previous candidate is removed first.
+func (n NginxConfig) Stage(envoyConfFile, dir string) (Candidate, error) {
+	envoyConf, err := n.envoyConfParser.ReadUnmarshalEnvoyConfig(envoyConfFile)
+	if err != nil {
+		return Candidate{}, fmt.Errorf("read and unmarshal Envoy config: %s", err)
+	}
+
+	err = os.RemoveAll(dir)
+	if err != nil {
+		return Candidate{}, fmt.Errorf("remove previous candidate: %s", err)
+	}
+
+	for _, subDir := range []string{"conf", "logs"} {
+		err = os.MkdirAll(filepath.Join(dir, subDir), 0755)
+		if err != nil {
+			return Candidate{}, fmt.Errorf("create candidate %s dir: %s", subDir, err)
+		}
+	}
+
+	contexts, err := n.sdsValidationParser.GetValidationContexts()
+	if err != nil {
+		return Candidate{}, fmt.Errorf("get validation contexts from sds server validation parser: %s", err)
+	}
+
+	candidate := n.withDir(dir)
+
+	err = candidate.writeTLSFiles(contexts)
+	if err != nil {
+		return Candidate{}, fmt.Errorf("write tls files: %s", err)
+	}
+
+	err = candidate.generate(envoyConf, contexts)
+	if err != nil {
+		return Candidate{}, fmt.Errorf("generate nginx config from envoy config: %s", err)
+	}
+
+	liveConf, err := n.render(envoyConf, contexts)
+	if err != nil {
+		return Candidate{}, fmt.Errorf("generate nginx config from envoy config: %s", err)
+	}
+
+	return Candidate{NginxConfig: candidate, contexts: contexts, liveConf: liveConf}, nil
+}
+
+// Moves the staged cert, key and ca cert files over the live ones
+// and writes the live nginx.conf rendered when the candidate was
+// staged. The staged nginx.conf itself is not moved, since it points
+// at the files in the candidate directory.
+func (n NginxConfig) Promote(c Candidate) error {
+	live := n.files(c.contexts)
+	staged := c.files(c.contexts)
+
+	for i, staged := range staged {
+		if staged == c.confFile {
+			continue
+		}
+
+		err := os.Rename(staged, live[i])
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("promote %s: %s", filepath.Base(staged), err)
+		}
+	}
+
+	err := writeFileAtomic(n.confFile, c.liveConf)
+	if err != nil {
+		return fmt.Errorf("%s - write file failed: %s", n.confFile, err)
+	}
+
+	return nil
+}
+
+// Copies the live cert, key, ca cert and nginx.conf that promoting
+// the candidate replaces into dir.
+func (n NginxConfig) Backup(c Candidate, dir string) error {
+	err := os.RemoveAll(dir)
+	if err != nil {
+		return fmt.Errorf("remove previous backup: %s", err)
+	}
+
+	err = os.MkdirAll(filepath.Join(dir, "conf"), 0755)
+	if err != nil {
+		return fmt.Errorf("create backup conf dir: %s", err)
+	}
+
+	return copyFiles(n, n.withDir(dir), c.contexts)
+}
+
+// Copies the cert, key, ca cert and nginx.conf saved by Backup
+// back over the live ones.
+func (n NginxConfig) Restore(c Candidate, dir string) error {
+	return copyFiles(n.withDir(dir), n, c.contexts)
+}
+
+// Files missing from src are skipped, so that e.g. an absent ca
+// cert does not fail the whole copy.
+func copyFiles(from, to NginxConfig, contexts []SdsValidationContext) error {
+	src := from.files(contexts)
+	dst := to.files(contexts)
+
+	files := []atomicFile{}
+	for i := range src {
+		contents, err := os.ReadFile(src[i])
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("read %s: %s", src[i], err)
+		}
+
+		files = append(files, atomicFile{path: dst[i], contents: contents})
+	}
+
+	return writeFilesAtomic(files)
+}
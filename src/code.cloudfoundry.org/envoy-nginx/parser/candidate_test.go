@@ -0,0 +1,258 @@
+package parser_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"code.cloudfoundry.org/envoy-nginx/parser"
+	"code.cloudfoundry.org/envoy-nginx/parser/fakes"
+)
+
+var _ = Describe("Candidate", func() {
+	var (
+		tmpdir       string
+		candidateDir string
+
+		envoyConfParser     *fakes.EnvoyConfParser
+		nginxConfig         parser.NginxConfig
+		sdsIdCredParser     *fakes.SdsCredParser
+		sdsValidationParser *fakes.SdsIdValidationParser
+	)
+
+	BeforeEach(func() {
+		sdsIdCredParser = &fakes.SdsCredParser{}
+		sdsIdCredParser.GetCertAndKeyCall.Returns.Cert = "some-id-cert"
+		sdsIdCredParser.GetCertAndKeyCall.Returns.Key = "some-id-key"
+		sdsIdCredParser.NameCall.Returns.Name = "id-cert-and-key"
+
+		sdsValidationParser = &fakes.SdsIdValidationParser{}
+		sdsValidationParser.GetValidationContextsCall.Returns.ValidationContexts = []parser.SdsValidationContext{{Name: "id-validation-context", CA: "some-ca-cert"}}
+
+		envoyConfParser = &fakes.EnvoyConfParser{}
+		envoyConfParser.GetClustersCall.Returns.Clusters = testClusters()[:1]
+		envoyConfParser.GetClustersCall.Returns.NameToListeners = map[string][]parser.ListenerInfo{
+			"service-cluster-8080": {
+				{Port: "61001", MTLS: true, CertificateSecrets: idSecrets, ValidationContext: "id-validation-context"},
+			},
+		}
+
+		var err error
+		tmpdir, err = os.MkdirTemp("", "nginx")
+		Expect(err).ShouldNot(HaveOccurred())
+		err = os.Mkdir(filepath.Join(tmpdir, "conf"), os.ModePerm)
+		Expect(err).ShouldNot(HaveOccurred())
+
+		candidateDir = filepath.Join(tmpdir, "candidate")
+
+		nginxConfig = parser.NewNginxConfig(envoyConfParser, []parser.SdsCredParser{sdsIdCredParser}, sdsValidationParser, tmpdir)
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(tmpdir)).NotTo(HaveOccurred())
+	})
+
+	Describe("Stage", func() {
+		It("writes the tls files and an nginx.conf pointing at them into the candidate dir", func() {
+			candidate, err := nginxConfig.Stage(EnvoyConfigFixture, candidateDir)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(candidate.GetNginxDir()).To(Equal(candidateDir))
+
+			cert, err := os.ReadFile(filepath.Join(candidateDir, "id-cert.pem"))
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(string(cert)).To(Equal("some-id-cert"))
+
+			ca, err := os.ReadFile(filepath.Join(candidateDir, "id-ca.pem"))
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(string(ca)).To(Equal("some-ca-cert"))
+
+			Expect(filepath.Join(candidateDir, "logs")).To(BeADirectory())
+
+			config, err := os.ReadFile(filepath.Join(candidateDir, "conf", "nginx.conf"))
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(string(config)).To(ContainSubstring(parser.ConvertToUnixPath(filepath.Join(candidateDir, "id-cert.pem"))))
+
+			By("leaving the live files alone", func() {
+				Expect(filepath.Join(tmpdir, "id-cert.pem")).NotTo(BeAnExistingFile())
+				Expect(filepath.Join(tmpdir, "conf", "nginx.conf")).NotTo(BeAnExistingFile())
+			})
+		})
+
+		It("keeps the worker processes and error log level", func() {
+			nginxConfig.SetWorkerProcesses(4)
+			nginxConfig.SetErrorLogLevel("warn")
+
+			_, err := nginxConfig.Stage(EnvoyConfigFixture, candidateDir)
+			Expect(err).ShouldNot(HaveOccurred())
+
+			config, err := os.ReadFile(filepath.Join(candidateDir, "conf", "nginx.conf"))
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(string(config)).To(ContainSubstring("worker_processes 4;"))
+			Expect(string(config)).To(ContainSubstring("error_log logs/error.log warn;"))
+		})
+
+		It("removes files left over from a previous candidate", func() {
+			err := os.MkdirAll(candidateDir, os.ModePerm)
+			Expect(err).ShouldNot(HaveOccurred())
+			err = os.WriteFile(filepath.Join(candidateDir, "c2c-cert.pem"), []byte("stale"), 0644)
+			Expect(err).ShouldNot(HaveOccurred())
+
+			_, err = nginxConfig.Stage(EnvoyConfigFixture, candidateDir)
+			Expect(err).ShouldNot(HaveOccurred())
+
+			Expect(filepath.Join(candidateDir, "c2c-cert.pem")).NotTo(BeAnExistingFile())
+		})
+
+		Context("when the envoy config cannot be read", func() {
+			BeforeEach(func() {
+				envoyConfParser.ReadUnmarshalEnvoyConfigCall.Returns.Error = errors.New("banana")
+			})
+
+			It("returns a helpful error", func() {
+				_, err := nginxConfig.Stage(EnvoyConfigFixture, candidateDir)
+				Expect(err).To(MatchError("read and unmarshal Envoy config: banana"))
+			})
+		})
+
+		Context("when the sds files cannot be read", func() {
+			BeforeEach(func() {
+				sdsIdCredParser.GetCertAndKeyCall.Returns.Error = errors.New("banana")
+			})
+
+			It("returns a helpful error", func() {
+				_, err := nginxConfig.Stage(EnvoyConfigFixture, candidateDir)
+				Expect(err).To(MatchError("write tls files: get cert and key from sds cred parser: banana"))
+			})
+		})
+	})
+
+	Describe("Promote", func() {
+		It("moves the staged tls files into place and regenerates nginx.conf for the live dir", func() {
+			candidate, err := nginxConfig.Stage(EnvoyConfigFixture, candidateDir)
+			Expect(err).ShouldNot(HaveOccurred())
+
+			err = nginxConfig.Promote(candidate)
+			Expect(err).ShouldNot(HaveOccurred())
+
+			cert, err := os.ReadFile(filepath.Join(tmpdir, "id-cert.pem"))
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(string(cert)).To(Equal("some-id-cert"))
+
+			key, err := os.ReadFile(filepath.Join(tmpdir, "id-key.pem"))
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(string(key)).To(Equal("some-id-key"))
+
+			config, err := os.ReadFile(nginxConfig.GetConfFile())
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(string(config)).To(ContainSubstring(parser.ConvertToUnixPath(filepath.Join(tmpdir, "id-cert.pem"))))
+			Expect(string(config)).NotTo(ContainSubstring("candidate"))
+		})
+
+		Context("when a listener has a max connection duration", func() {
+			BeforeEach(func() {
+				envoyConfParser.GetClustersCall.Returns.NameToListeners["service-cluster-8080"][0].MaxConnectionDuration = time.Minute
+				nginxConfig.SetLimitConnectionDuration(true)
+			})
+
+			It("moves the njs module that enforces it into place", func() {
+				candidate, err := nginxConfig.Stage(EnvoyConfigFixture, candidateDir)
+				Expect(err).ShouldNot(HaveOccurred())
+
+				err = nginxConfig.Promote(candidate)
+				Expect(err).ShouldNot(HaveOccurred())
+
+				Expect(filepath.Join(tmpdir, "connection-duration.js")).To(BeAnExistingFile())
+				config, err := os.ReadFile(nginxConfig.GetConfFile())
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(string(config)).To(ContainSubstring("js_import duration from " + parser.ConvertToUnixPath(filepath.Join(tmpdir, "connection-duration.js")) + ";"))
+			})
+		})
+
+		Context("when the sds file has several validation contexts", func() {
+			BeforeEach(func() {
+				sdsValidationParser.GetValidationContextsCall.Returns.ValidationContexts = append(
+					sdsValidationParser.GetValidationContextsCall.Returns.ValidationContexts,
+					parser.SdsValidationContext{Name: "c2c-validation-context", CA: "some-c2c-ca-cert"},
+				)
+			})
+
+			It("moves the ca cert of each of them into place", func() {
+				candidate, err := nginxConfig.Stage(EnvoyConfigFixture, candidateDir)
+				Expect(err).ShouldNot(HaveOccurred())
+
+				err = nginxConfig.Promote(candidate)
+				Expect(err).ShouldNot(HaveOccurred())
+
+				ca, err := os.ReadFile(filepath.Join(tmpdir, "c2c-validation-context-ca.pem"))
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(string(ca)).To(Equal("some-c2c-ca-cert"))
+			})
+
+			Context("when the sds file changes between staging and promoting", func() {
+				It("promotes what was staged", func() {
+					candidate, err := nginxConfig.Stage(EnvoyConfigFixture, candidateDir)
+					Expect(err).ShouldNot(HaveOccurred())
+
+					sdsValidationParser.GetValidationContextsCall.Returns.ValidationContexts = []parser.SdsValidationContext{
+						{Name: "c2c-validation-context", CA: "some-rotated-c2c-ca-cert"},
+						{Name: "id-validation-context", CA: "some-rotated-ca-cert"},
+					}
+
+					err = nginxConfig.Promote(candidate)
+					Expect(err).ShouldNot(HaveOccurred())
+
+					ca, err := os.ReadFile(filepath.Join(tmpdir, "id-ca.pem"))
+					Expect(err).ShouldNot(HaveOccurred())
+					Expect(string(ca)).To(Equal("some-ca-cert"))
+
+					ca, err = os.ReadFile(filepath.Join(tmpdir, "c2c-validation-context-ca.pem"))
+					Expect(err).ShouldNot(HaveOccurred())
+					Expect(string(ca)).To(Equal("some-c2c-ca-cert"))
+
+					config, err := os.ReadFile(nginxConfig.GetConfFile())
+					Expect(err).ShouldNot(HaveOccurred())
+					staged, err := os.ReadFile(candidate.GetConfFile())
+					Expect(err).ShouldNot(HaveOccurred())
+					Expect(string(config)).To(Equal(strings.ReplaceAll(string(staged), parser.ConvertToUnixPath(candidateDir), parser.ConvertToUnixPath(tmpdir))))
+				})
+			})
+		})
+	})
+
+	Describe("Backup and Restore", func() {
+		It("puts back the files that were live at backup time", func() {
+			err := nginxConfig.WriteTLSFiles()
+			Expect(err).ShouldNot(HaveOccurred())
+			err = nginxConfig.Generate(EnvoyConfigFixture)
+			Expect(err).ShouldNot(HaveOccurred())
+
+			candidate, err := nginxConfig.Stage(EnvoyConfigFixture, candidateDir)
+			Expect(err).ShouldNot(HaveOccurred())
+
+			previousDir := filepath.Join(tmpdir, "previous")
+			err = nginxConfig.Backup(candidate, previousDir)
+			Expect(err).ShouldNot(HaveOccurred())
+
+			err = os.WriteFile(filepath.Join(tmpdir, "id-cert.pem"), []byte("some-other-cert"), 0644)
+			Expect(err).ShouldNot(HaveOccurred())
+			err = os.WriteFile(nginxConfig.GetConfFile(), []byte("broken"), 0644)
+			Expect(err).ShouldNot(HaveOccurred())
+
+			err = nginxConfig.Restore(candidate, previousDir)
+			Expect(err).ShouldNot(HaveOccurred())
+
+			cert, err := os.ReadFile(filepath.Join(tmpdir, "id-cert.pem"))
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(string(cert)).To(Equal("some-id-cert"))
+
+			config, err := os.ReadFile(nginxConfig.GetConfFile())
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(string(config)).To(ContainSubstring("upstream service-cluster-8080"))
+		})
+	})
+})
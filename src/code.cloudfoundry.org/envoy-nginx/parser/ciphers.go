@@ -0,0 +1,76 @@
+package parser
+
+import "strings"
+
+// OpenSSL names of the cipher suites BoringSSL, and so envoy,
+// supports, by their standard names. envoy accepts either.
+var openSSLCipherNames = map[string]string{
+	"TLS_RSA_WITH_3DES_EDE_CBC_SHA":                 "DES-CBC3-SHA",
+	"TLS_RSA_WITH_AES_128_CBC_SHA":                  "AES128-SHA",
+	"TLS_RSA_WITH_AES_256_CBC_SHA":                  "AES256-SHA",
+	"TLS_RSA_WITH_AES_128_GCM_SHA256":               "AES128-GCM-SHA256",
+	"TLS_RSA_WITH_AES_256_GCM_SHA384":               "AES256-GCM-SHA384",
+	"TLS_PSK_WITH_AES_128_CBC_SHA":                  "PSK-AES128-CBC-SHA",
+	"TLS_PSK_WITH_AES_256_CBC_SHA":                  "PSK-AES256-CBC-SHA",
+	"TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA":          "ECDHE-ECDSA-AES128-SHA",
+	"TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA":          "ECDHE-ECDSA-AES256-SHA",
+	"TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA":            "ECDHE-RSA-AES128-SHA",
+	"TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA":            "ECDHE-RSA-AES256-SHA",
+	"TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA256":         "ECDHE-RSA-AES128-SHA256",
+	"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256":       "ECDHE-ECDSA-AES128-GCM-SHA256",
+	"TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384":       "ECDHE-ECDSA-AES256-GCM-SHA384",
+	"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256":         "ECDHE-RSA-AES128-GCM-SHA256",
+	"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384":         "ECDHE-RSA-AES256-GCM-SHA384",
+	"TLS_ECDHE_PSK_WITH_AES_128_CBC_SHA":            "ECDHE-PSK-AES128-CBC-SHA",
+	"TLS_ECDHE_PSK_WITH_AES_256_CBC_SHA":            "ECDHE-PSK-AES256-CBC-SHA",
+	"TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256": "ECDHE-ECDSA-CHACHA20-POLY1305",
+	"TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256":   "ECDHE-RSA-CHACHA20-POLY1305",
+	"TLS_ECDHE_PSK_WITH_CHACHA20_POLY1305_SHA256":   "ECDHE-PSK-CHACHA20-POLY1305",
+	"TLS_AES_128_GCM_SHA256":                        "TLS_AES_128_GCM_SHA256",
+	"TLS_AES_256_GCM_SHA384":                        "TLS_AES_256_GCM_SHA384",
+	"TLS_CHACHA20_POLY1305_SHA256":                  "TLS_CHACHA20_POLY1305_SHA256",
+}
+
+// The same cipher suites by their OpenSSL name.
+var openSSLCiphers = func() map[string]bool {
+	ciphers := map[string]bool{}
+	for _, name := range openSSLCipherNames {
+		ciphers[name] = true
+	}
+	return ciphers
+}()
+
+/*
+* Translates an entry of envoy cipher_suites into OpenSSL cipher names.
+* BoringSSL lets an entry be a group of equally preferred ciphers,
+* e.g. [ECDHE-ECDSA-AES128-GCM-SHA256|ECDHE-ECDSA-CHACHA20-POLY1305].
+* OpenSSL has no such thing, so the ciphers of a group are preferred
+* in the order they are listed. Ciphers without an OpenSSL equivalent,
+* such as BoringSSL's pre-standard *-CHACHA20-POLY1305-OLD, are
+* returned apart from the translated ones.
+ */
+func translateCipherSuite(cipherSuite string) (ciphers, unsupported []string) {
+	group := strings.TrimSuffix(strings.TrimPrefix(cipherSuite, "["), "]")
+	for _, name := range strings.Split(group, "|") {
+		name = strings.TrimSpace(name)
+		if openSSLCiphers[name] {
+			ciphers = append(ciphers, name)
+		} else if openSSLName, ok := openSSLCipherNames[name]; ok {
+			ciphers = append(ciphers, openSSLName)
+		} else {
+			unsupported = append(unsupported, name)
+		}
+	}
+	return ciphers, unsupported
+}
+
+// Translates every entry of envoy cipher_suites, leaving out
+// ciphers without an OpenSSL equivalent.
+func translateCipherSuites(cipherSuites []string) []string {
+	translated := []string{}
+	for _, cipherSuite := range cipherSuites {
+		ciphers, _ := translateCipherSuite(cipherSuite)
+		translated = append(translated, ciphers...)
+	}
+	return translated
+}
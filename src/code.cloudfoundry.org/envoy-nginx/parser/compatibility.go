@@ -0,0 +1,216 @@
+package parser
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Fields that change who may connect or what is trusted. Dropping
+// one of them silently weakens the security of a listener.
+var securityFields = map[string]bool{
+	"verify_subject_alt_name":       true,
+	"match_subject_alt_names":       true,
+	"match_typed_subject_alt_names": true,
+	"verify_certificate_hash":       true,
+	"verify_certificate_spki":       true,
+	"trusted_ca":                    true,
+	"crl":                           true,
+	"allow_expired_certificate":     true,
+	"trust_chain_verification":      true,
+	"custom_validator_config":       true,
+	"validation_context":            true,
+	"combined_validation_context":   true,
+	"require_sni":                   true,
+	"tls_minimum_protocol_version":  true,
+	"tls_maximum_protocol_version":  true,
+	// Only translated with an njs filter, see CheckCompatibility.
+	// Otherwise connections would outlive the credentials they were
+	// authenticated with.
+	"max_downstream_connection_duration": true,
+}
+
+// A field of the envoy config that is not translated to nginx,
+// or a value of it, if Reason says why.
+type UnsupportedField struct {
+	Path     string
+	Security bool
+	Reason   string
+}
+
+func (f UnsupportedField) String() string {
+	s := f.Path
+	if f.Reason != "" {
+		s = fmt.Sprintf("%s: %s", s, f.Reason)
+	}
+	if f.Security {
+		s = fmt.Sprintf("%s (security relevant)", s)
+	}
+	return s
+}
+
+/*
+* Loads the whole envoy config and compares it with the fields the
+* EnvoyConf structs model, which are exactly the ones translated to
+* nginx. Every field in the document without a counterpart is reported,
+* in document order. Nested fields of an unsupported field are not
+* reported on their own. Cipher suites without an OpenSSL equivalent
+* are reported last. max_downstream_connection_duration is only
+* translated if limitConnectionDuration is set, since its njs filter
+* fails nginx -t without njs.
+ */
+func CheckCompatibility(envoyConfFile string, limitConnectionDuration bool) ([]UnsupportedField, error) {
+	contents, err := os.ReadFile(envoyConfFile)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read envoy config: %s", err)
+	}
+
+	document := yaml.MapSlice{}
+	err = yaml.Unmarshal(contents, &document)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to unmarshal envoy config: %s", err)
+	}
+
+	untranslated := map[string]bool{}
+	if !limitConnectionDuration {
+		untranslated["max_downstream_connection_duration"] = true
+	}
+
+	unsupported := []UnsupportedField{}
+	compare("", document, reflect.TypeOf(EnvoyConf{}), untranslated, &unsupported)
+
+	conf := EnvoyConf{}
+	err = yaml.Unmarshal(contents, &conf)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to unmarshal envoy config: %s", err)
+	}
+
+	return append(unsupported, unsupportedCipherSuites(conf)...), nil
+}
+
+// Compares the sds file of the validation contexts with the fields
+// SdsIdValidation models the same way CheckCompatibility does, e.g. a
+// crl there is not translated either.
+func CheckValidationContextCompatibility(sdsIdValidationFile string) ([]UnsupportedField, error) {
+	contents, err := os.ReadFile(sdsIdValidationFile)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read sds server validation context: %s", err)
+	}
+
+	document := yaml.MapSlice{}
+	err = yaml.Unmarshal(contents, &document)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to unmarshal sds server validation context: %s", err)
+	}
+
+	unsupported := []UnsupportedField{}
+	compare("", document, reflect.TypeOf(SdsIdValidation{}), map[string]bool{}, &unsupported)
+
+	return unsupported, nil
+}
+
+func unsupportedCipherSuites(conf EnvoyConf) []UnsupportedField {
+	unsupported := []UnsupportedField{}
+	for i, listener := range conf.StaticResources.Listeners {
+		for j, filterChain := range listener.FilterChains {
+			tlsContext, ok := filterChain.TransportSocket.TypedConfig.Config.(*TypedConfigDownstreamTlsContext)
+			if !ok {
+				continue
+			}
+
+			for k, cipherSuite := range tlsContext.CommonTLSContext.TLSParams.CipherSuites {
+				_, names := translateCipherSuite(cipherSuite)
+				for _, name := range names {
+					unsupported = append(unsupported, UnsupportedField{
+						Path:   fmt.Sprintf("static_resources.listeners[%d].filter_chains[%d].transport_socket.typed_config.common_tls_context.tls_params.cipher_suites[%d]", i, j, k),
+						Reason: fmt.Sprintf("cipher %s has no OpenSSL equivalent", name),
+					})
+				}
+			}
+		}
+	}
+	return unsupported
+}
+
+// Fields in untranslated are reported even though EnvoyConf models them.
+func compare(path string, node interface{}, t reflect.Type, untranslated map[string]bool, unsupported *[]UnsupportedField) {
+	// A typed_config is compared with the struct registered for its
+	// @type. Unregistered types are reported by ValidateEnvoyConfig.
+	if t == reflect.TypeOf(TypedConfig{}) {
+		newConfig, ok := typedConfigs[typeName(typeURL(node))]
+		if !ok {
+			return
+		}
+		t = reflect.TypeOf(newConfig()).Elem()
+	}
+
+	// Types that unmarshal themselves accept whatever shape they document.
+	if reflect.PointerTo(t).Implements(reflect.TypeOf((*yaml.Unmarshaler)(nil)).Elem()) {
+		return
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		mapping, ok := node.(yaml.MapSlice)
+		if !ok {
+			return
+		}
+
+		fields := yamlFields(t)
+		for _, item := range mapping {
+			key := fmt.Sprintf("%v", item.Key)
+			if key == "@type" {
+				continue
+			}
+
+			fieldPath := key
+			if path != "" {
+				fieldPath = path + "." + key
+			}
+
+			field, ok := fields[key]
+			if !ok || untranslated[key] {
+				*unsupported = append(*unsupported, UnsupportedField{Path: fieldPath, Security: securityFields[key]})
+				continue
+			}
+			compare(fieldPath, item.Value, field, untranslated, unsupported)
+		}
+	case reflect.Slice:
+		items, ok := node.([]interface{})
+		if !ok {
+			return
+		}
+
+		for i, item := range items {
+			compare(fmt.Sprintf("%s[%d]", path, i), item, t.Elem(), untranslated, unsupported)
+		}
+	}
+}
+
+// Returns the @type of a typed_config, empty if it has none.
+func typeURL(node interface{}) string {
+	mapping, _ := node.(yaml.MapSlice)
+	for _, item := range mapping {
+		if item.Key == "@type" {
+			return fmt.Sprintf("%v", item.Value)
+		}
+	}
+	return ""
+}
+
+// Returns the types of the fields of a struct by their yaml name.
+func yamlFields(t reflect.Type) map[string]reflect.Type {
+	fields := map[string]reflect.Type{}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name := strings.Split(field.Tag.Get("yaml"), ",")[0]
+		if name == "" || name == "-" {
+			continue
+		}
+		fields[name] = field.Type
+	}
+	return fields
+}
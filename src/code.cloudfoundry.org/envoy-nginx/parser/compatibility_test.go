@@ -0,0 +1,183 @@
+package parser_test
+
+import (
+	"os"
+	"path/filepath"
+
+	"code.cloudfoundry.org/envoy-nginx/parser"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("CheckCompatibility", func() {
+	var tmpDir string
+
+	BeforeEach(func() {
+		var err error
+		tmpDir, err = os.MkdirTemp("", "compatibility")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(tmpDir)).To(Succeed())
+	})
+
+	writeConfig := func(envoyConfig string) string {
+		path := filepath.Join(tmpDir, "envoy.yaml")
+		Expect(os.WriteFile(path, []byte(envoyConfig), 0644)).To(Succeed())
+		return path
+	}
+
+	It("reports the fields of the fixture that are not translated", func() {
+		unsupported, err := parser.CheckCompatibility(EnvoyConfigFixture, false)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(unsupported).To(ContainElements(
+			parser.UnsupportedField{Path: "admin"},
+			parser.UnsupportedField{Path: "static_resources.clusters[0].type"},
+			parser.UnsupportedField{Path: "static_resources.listeners[0].filter_chains[0].filters[0].typed_config.stat_prefix"},
+		))
+		for _, field := range unsupported {
+			Expect(field.Security).To(BeFalse(), field.Path)
+		}
+	})
+
+	It("marks fields that affect security and does not descend into unsupported fields", func() {
+		unsupported, err := parser.CheckCompatibility(writeConfig(`
+static_resources:
+  listeners:
+  - address:
+      socket_address:
+        port_value: 61001
+    filter_chains:
+    - filters:
+      - typed_config:
+          "@type": type.googleapis.com/envoy.extensions.filters.network.tcp_proxy.v3.TcpProxy
+          cluster: some-cluster
+          idle_timeout: 3600s
+          max_downstream_connection_duration: 60s
+      transport_socket:
+        typed_config:
+          "@type": type.googleapis.com/envoy.extensions.transport_sockets.tls.v3.DownstreamTlsContext
+          require_client_certificate: true
+          common_tls_context:
+            validation_context:
+              match_subject_alt_names:
+              - exact: some-san
+          require_sni: true
+`), false)
+		Expect(err).NotTo(HaveOccurred())
+
+		tlsContext := "static_resources.listeners[0].filter_chains[0].transport_socket.typed_config"
+		Expect(unsupported).To(Equal([]parser.UnsupportedField{
+			{Path: "static_resources.listeners[0].filter_chains[0].filters[0].typed_config.max_downstream_connection_duration", Security: true},
+			{Path: tlsContext + ".common_tls_context.validation_context", Security: true},
+			{Path: tlsContext + ".require_sni", Security: true},
+		}))
+		Expect(unsupported[1].String()).To(HaveSuffix("validation_context (security relevant)"))
+	})
+
+	Context("when connection durations are limited with njs", func() {
+		It("does not report max_downstream_connection_duration", func() {
+			unsupported, err := parser.CheckCompatibility(writeConfig(`
+static_resources:
+  listeners:
+  - filter_chains:
+    - filters:
+      - typed_config:
+          "@type": type.googleapis.com/envoy.extensions.filters.network.tcp_proxy.v3.TcpProxy
+          cluster: some-cluster
+          max_downstream_connection_duration: 60s
+`), true)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(unsupported).To(BeEmpty())
+		})
+	})
+
+	It("reports cipher suites without an OpenSSL equivalent", func() {
+		unsupported, err := parser.CheckCompatibility(writeConfig(`
+static_resources:
+  listeners:
+  - filter_chains:
+    - transport_socket:
+        typed_config:
+          "@type": type.googleapis.com/envoy.extensions.transport_sockets.tls.v3.DownstreamTlsContext
+          common_tls_context:
+            tls_params:
+              cipher_suites:
+              - ECDHE-RSA-AES128-GCM-SHA256
+              - "[ECDHE-ECDSA-CHACHA20-POLY1305-OLD|ECDHE-ECDSA-CHACHA20-POLY1305]"
+`), false)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(unsupported).To(Equal([]parser.UnsupportedField{{
+			Path:   "static_resources.listeners[0].filter_chains[0].transport_socket.typed_config.common_tls_context.tls_params.cipher_suites[1]",
+			Reason: "cipher ECDHE-ECDSA-CHACHA20-POLY1305-OLD has no OpenSSL equivalent",
+		}}))
+		Expect(unsupported[0].String()).To(HaveSuffix("cipher_suites[1]: cipher ECDHE-ECDSA-CHACHA20-POLY1305-OLD has no OpenSSL equivalent"))
+	})
+
+	Context("when the envoy config cannot be read", func() {
+		It("returns a helpful error", func() {
+			_, err := parser.CheckCompatibility("not-a-real-file", false)
+			Expect(err).To(MatchError(ContainSubstring("Failed to read envoy config: ")))
+		})
+	})
+
+	Context("when the envoy config is not yaml", func() {
+		It("returns a helpful error", func() {
+			_, err := parser.CheckCompatibility(writeConfig("%%%"), false)
+			Expect(err).To(MatchError(ContainSubstring("Failed to unmarshal envoy config: ")))
+		})
+	})
+})
+
+var _ = Describe("CheckValidationContextCompatibility", func() {
+	var sdsFile string
+
+	BeforeEach(func() {
+		tmpFile, err := os.CreateTemp("", "sds-validation-context.yaml")
+		Expect(err).NotTo(HaveOccurred())
+		_, err = tmpFile.Write([]byte(`version_info: "0"
+resources:
+- '@type': type.googleapis.com/envoy.extensions.transport_sockets.tls.v3.Secret
+  name: server-validation-context
+  validation_context:
+    trusted_ca:
+      inline_string: some-ca
+    crl:
+      inline_string: some-crl
+    match_subject_alt_names:
+    - safe_regex:
+        google_re2: {}
+        regex: gorouter
+`))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(tmpFile.Close()).To(Succeed())
+		sdsFile = tmpFile.Name()
+	})
+
+	AfterEach(func() {
+		os.Remove(sdsFile)
+	})
+
+	It("reports the fields of the validation contexts that are not translated", func() {
+		unsupported, err := parser.CheckValidationContextCompatibility(sdsFile)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(unsupported).To(Equal([]parser.UnsupportedField{
+			{Path: "resources[0].validation_context.crl", Security: true},
+			{Path: "resources[0].validation_context.match_subject_alt_names[0].safe_regex.google_re2"},
+		}))
+	})
+
+	It("reports nothing for the fixture", func() {
+		unsupported, err := parser.CheckValidationContextCompatibility("../fixtures/cf_assets_envoy_config/sds-id-validation-context.yaml")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(unsupported).To(BeEmpty())
+	})
+
+	Context("when the sds file cannot be read", func() {
+		It("returns a helpful error", func() {
+			_, err := parser.CheckValidationContextCompatibility("not-a-real-file")
+			Expect(err).To(MatchError(ContainSubstring("Failed to read sds server validation context: ")))
+		})
+	})
+})
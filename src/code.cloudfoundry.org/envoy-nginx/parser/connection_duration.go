@@ -0,0 +1,33 @@
+package parser
+
+// Name the connection duration module is imported as, san verifiers
+// are imported as san, san1 and so on.
+const connectionDurationImport = "duration"
+
+/*
+* nginx has no directive that caps how long a stream connection
+* lives, so an njs filter closes connections that outlive the
+* max_downstream_connection_duration of their listener. This is best
+* effort: njs cannot close a connection from a timer, the filter
+* closes it with the first data sent in either direction once the
+* duration is over. A connection that stays idle is closed by
+* proxy_timeout, which is at most the duration, so a connection lives
+* less than twice its max duration.
+ */
+const connectionDurationModule = `// Generated by envoy-nginx, do not edit.
+function limit(s) {
+    var deadline = Date.now() + Number(s.variables.max_connection_duration);
+
+    function forward(data, flags) {
+        if (Date.now() >= deadline) {
+            throw new Error('envoy-nginx: connection closed after max_downstream_connection_duration');
+        }
+        s.send(data, flags);
+    }
+
+    s.on('upstream', forward);
+    s.on('downstream', forward);
+}
+
+export default {limit};
+`
@@ -0,0 +1,95 @@
+package parser_test
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"code.cloudfoundry.org/envoy-nginx/parser"
+	"code.cloudfoundry.org/envoy-nginx/parser/fakes"
+)
+
+// Runs limit of the connection duration module with a stand-in for
+// the njs stream session and a clock that has advanced by the given
+// milliseconds when data is sent, and prints whether the data was
+// forwarded or the connection closed.
+const connectionDurationHarness = `import duration from './connection-duration.js';
+
+var now = 1000;
+Date.now = function () { return now; };
+
+var handlers = {};
+var sent = [];
+duration.limit({
+    variables: {max_connection_duration: process.argv[2]},
+    on: function (event, handler) { handlers[event] = handler; },
+    send: function (data, flags) { sent.push(data); },
+});
+
+now += Number(process.argv[3]);
+try {
+    handlers[process.argv[4]]('some-data', {last: false});
+    console.log(sent.join() === 'some-data' ? 'forwarded' : 'dropped');
+} catch (e) {
+    console.log('closed');
+}
+`
+
+var _ = Describe("Connection Duration", func() {
+	var (
+		tmpdir string
+		node   string
+	)
+
+	BeforeEach(func() {
+		var err error
+		node, err = exec.LookPath("node")
+		if err != nil {
+			Skip("node is needed to run the njs module")
+		}
+
+		tmpdir, err = os.MkdirTemp("", "connection-duration")
+		Expect(err).ShouldNot(HaveOccurred())
+		DeferCleanup(os.RemoveAll, tmpdir)
+
+		Expect(os.Mkdir(filepath.Join(tmpdir, "conf"), 0755)).To(Succeed())
+		writeFile(tmpdir, "package.json", `{"type": "module"}`)
+		writeFile(tmpdir, "harness.js", connectionDurationHarness)
+
+		envoyConfParser := &fakes.EnvoyConfParser{}
+		envoyConfParser.GetClustersCall.Returns.Clusters = testClusters()
+		envoyConfParser.GetClustersCall.Returns.NameToListeners = map[string][]parser.ListenerInfo{
+			"service-cluster-8080": {{Port: "61001", MaxConnectionDuration: time.Minute}},
+		}
+		nginxConfig := parser.NewNginxConfig(envoyConfParser, nil, &fakes.SdsIdValidationParser{}, tmpdir)
+		nginxConfig.SetLimitConnectionDuration(true)
+		Expect(nginxConfig.Generate(EnvoyConfigFixture)).To(Succeed())
+	})
+
+	send := func(elapsed time.Duration, event string) string {
+		command := exec.Command(node, "harness.js", "60000", strconv.FormatInt(elapsed.Milliseconds(), 10), event)
+		command.Dir = tmpdir
+		command.Stderr = GinkgoWriter
+		out, err := command.Output()
+		Expect(err).ShouldNot(HaveOccurred())
+		return strings.TrimSpace(string(out))
+	}
+
+	DescribeTable("closes connections once the max connection duration is over",
+		func(elapsed time.Duration, event, result string) {
+			Expect(filepath.Join(tmpdir, "connection-duration.js")).To(BeAnExistingFile())
+			Expect(send(elapsed, event)).To(Equal(result))
+		},
+		Entry("data from the client right away", time.Duration(0), "upstream", "forwarded"),
+		Entry("data from the upstream right away", time.Duration(0), "downstream", "forwarded"),
+		Entry("data from the client just before the end", time.Minute-time.Millisecond, "upstream", "forwarded"),
+		Entry("data from the client at the end", time.Minute, "upstream", "closed"),
+		Entry("data from the upstream after the end", time.Hour, "downstream", "closed"),
+	)
+})
@@ -0,0 +1,63 @@
+package parser
+
+import "math"
+
+const (
+	// envoy's max_connections if a cluster has no circuit breaker.
+	defaultMaxConnections = 1024
+	// The largest max_connections, a uint32, which envoy configs use
+	// to turn the circuit breaker off.
+	unlimitedConnections int64 = math.MaxUint32
+
+	minWorkerConnections = 1024
+	maxWorkerConnections = 65536
+
+	// Large enough for the state of every server of an upstream.
+	upstreamZoneSize = "64k"
+)
+
+// Returns the max_connections of the default priority circuit
+// breaker of a cluster, 0 if there is none or it is turned off.
+// Only routes of http connections can have a high priority.
+func maxConnections(c Cluster) int {
+	var limit int64
+	for _, threshold := range c.CircuitBreakers.Thresholds {
+		if threshold.Priority != "" && threshold.Priority != "DEFAULT" {
+			continue
+		}
+		if threshold.MaxConnections > 0 {
+			limit = threshold.MaxConnections
+		}
+	}
+
+	if limit >= unlimitedConnections {
+		return 0
+	}
+	// Where int has 32 bits, more than that is as good as unlimited.
+	if limit > math.MaxInt32 {
+		return math.MaxInt32
+	}
+	return int(limit)
+}
+
+// Every proxied connection takes two nginx connections, one to the
+// client and one to the upstream. A listener whose cluster has no
+// limit counts with as many as envoy would allow without a circuit
+// breaker.
+func workerConnections(limits []int) int {
+	connections := 0
+	for _, limit := range limits {
+		if limit == 0 {
+			limit = defaultMaxConnections
+		}
+		connections += 2 * limit
+	}
+
+	if connections < minWorkerConnections {
+		return minWorkerConnections
+	}
+	if connections > maxWorkerConnections {
+		return maxWorkerConnections
+	}
+	return connections
+}
@@ -0,0 +1,61 @@
+package parser
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// An envoy duration, written as "0.250s", "250ms" or as a protobuf
+// Duration object with seconds and nanos. Negative durations are an
+// error, rather than a timeout that is silently dropped.
+type Duration struct {
+	time.Duration
+}
+
+func (d *Duration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var value string
+	err := unmarshal(&value)
+	if err == nil {
+		d.Duration, err = parseDuration(value)
+		return err
+	}
+
+	object := struct {
+		Seconds int64 `yaml:"seconds"`
+		Nanos   int32 `yaml:"nanos"`
+	}{}
+	err = unmarshal(&object)
+	if err != nil {
+		return fmt.Errorf("invalid duration, expected e.g. 0.250s or seconds and nanos: %s", err)
+	}
+	d.Duration = time.Duration(object.Seconds)*time.Second + time.Duration(object.Nanos)
+	if d.Duration < 0 {
+		return fmt.Errorf("invalid duration of %d seconds and %d nanos, must not be negative", object.Seconds, object.Nanos)
+	}
+	return nil
+}
+
+func parseDuration(value string) (time.Duration, error) {
+	unit := time.Second
+	number := strings.TrimSuffix(value, "s")
+	if strings.HasSuffix(value, "ms") {
+		unit = time.Millisecond
+		number = strings.TrimSuffix(value, "ms")
+	}
+	if number == value {
+		return 0, fmt.Errorf("invalid duration %q, expected a number of s or ms", value)
+	}
+
+	n, err := strconv.ParseFloat(number, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid duration %q, expected a number of s or ms", value)
+	}
+
+	if n < 0 {
+		return 0, fmt.Errorf("invalid duration %q, must not be negative", value)
+	}
+
+	return time.Duration(n * float64(unit)), nil
+}
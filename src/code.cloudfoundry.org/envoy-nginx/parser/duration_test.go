@@ -0,0 +1,39 @@
+package parser_test
+
+import (
+	"time"
+
+	"code.cloudfoundry.org/envoy-nginx/parser"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	yaml "gopkg.in/yaml.v2"
+)
+
+var _ = Describe("Duration", func() {
+	DescribeTable("parses envoy durations",
+		func(value string, expected time.Duration) {
+			duration := parser.Duration{}
+			Expect(yaml.Unmarshal([]byte(value), &duration)).To(Succeed())
+			Expect(duration.Duration).To(Equal(expected))
+		},
+		Entry("in seconds", "0.250s", 250*time.Millisecond),
+		Entry("in whole seconds", "3600s", time.Hour),
+		Entry("in milliseconds", "1500ms", 1500*time.Millisecond),
+		Entry("as a protobuf Duration", "{seconds: 1, nanos: 500000000}", 1500*time.Millisecond),
+		Entry("as a protobuf Duration without nanos", "seconds: 5", 5*time.Second),
+	)
+
+	DescribeTable("returns a helpful error for invalid durations",
+		func(value, message string) {
+			duration := parser.Duration{}
+			Expect(yaml.Unmarshal([]byte(value), &duration)).To(MatchError(ContainSubstring(message)))
+		},
+		Entry("without a unit", "5", `invalid duration "5", expected a number of s or ms`),
+		Entry("with an unsupported unit", "5m", `invalid duration "5m", expected a number of s or ms`),
+		Entry("that is not a number", "fives", `invalid duration "fives", expected a number of s or ms`),
+		Entry("that is negative", "-1s", `invalid duration "-1s", must not be negative`),
+		Entry("that is negative in milliseconds", "-500ms", `invalid duration "-500ms", must not be negative`),
+		Entry("as a negative protobuf Duration", "seconds: -5", "invalid duration of -5 seconds and 0 nanos, must not be negative"),
+		Entry("that is a list", "[5s]", "invalid duration, expected e.g. 0.250s or seconds and nanos: "),
+	)
+})
@@ -3,18 +3,11 @@ package parser
 import (
 	"fmt"
 	"os"
-	"strings"
+	"time"
 
 	yaml "gopkg.in/yaml.v2"
 )
 
-type SdsConfigType int
-
-const (
-	SdsIdConfigType SdsConfigType = iota
-	SdsC2CConfigType
-)
-
 type EnvoyConf struct {
 	StaticResources StaticResources `yaml:"static_resources,omitempty"`
 }
@@ -25,8 +18,20 @@ type StaticResources struct {
 }
 
 type Cluster struct {
-	Name           string         `yaml:"name,omitempty"`
-	LoadAssignment LoadAssignment `yaml:"load_assignment,omitempty"`
+	Name            string          `yaml:"name,omitempty"`
+	LbPolicy        string          `yaml:"lb_policy,omitempty"`
+	ConnectTimeout  Duration        `yaml:"connect_timeout,omitempty"`
+	CircuitBreakers CircuitBreakers `yaml:"circuit_breakers,omitempty"`
+	LoadAssignment  LoadAssignment  `yaml:"load_assignment,omitempty"`
+}
+
+type CircuitBreakers struct {
+	Thresholds []Thresholds `yaml:"thresholds,omitempty"`
+}
+
+type Thresholds struct {
+	Priority       string `yaml:"priority,omitempty"`
+	MaxConnections int64  `yaml:"max_connections,omitempty"`
 }
 
 type LoadAssignment struct {
@@ -34,11 +39,14 @@ type LoadAssignment struct {
 }
 
 type Endpoints struct {
+	// 0 is the highest priority, endpoints of any other are backups.
+	Priority    int           `yaml:"priority,omitempty"`
 	LBEndpoints []LBEndpoints `yaml:"lb_endpoints,omitempty"`
 }
 
 type LBEndpoints struct {
-	Endpoint Endpoint `yaml:"endpoint,omitempty"`
+	Endpoint            Endpoint `yaml:"endpoint,omitempty"`
+	LoadBalancingWeight int      `yaml:"load_balancing_weight,omitempty"`
 }
 
 type Endpoint struct {
@@ -60,20 +68,23 @@ type SocketAddress struct {
 }
 
 type FilterChain struct {
-	Filters         []Filter        `yaml:"filters,omitempty"`
-	TransportSocket TransportSocket `yaml:"transport_socket,omitempty"`
+	Filters                       []Filter        `yaml:"filters,omitempty"`
+	TransportSocket               TransportSocket `yaml:"transport_socket,omitempty"`
+	TransportSocketConnectTimeout Duration        `yaml:"transport_socket_connect_timeout,omitempty"`
 }
 
 type Filter struct {
-	TypedConfig TypedConfigTcpProxy `yaml:"typed_config,omitempty"`
+	TypedConfig TypedConfig `yaml:"typed_config,omitempty"`
 }
 
 type TypedConfigTcpProxy struct {
-	Cluster string `yaml:"cluster,omitempty"`
+	Cluster                         string   `yaml:"cluster,omitempty"`
+	IdleTimeout                     Duration `yaml:"idle_timeout,omitempty"`
+	MaxDownstreamConnectionDuration Duration `yaml:"max_downstream_connection_duration,omitempty"`
 }
 
 type TransportSocket struct {
-	TypedConfig TypedConfigDownstreamTlsContext `yaml:"typed_config,omitempty"`
+	TypedConfig TypedConfig `yaml:"typed_config,omitempty"`
 }
 
 type TypedConfigDownstreamTlsContext struct {
@@ -84,21 +95,52 @@ type TypedConfigDownstreamTlsContext struct {
 type CommonTLSContext struct {
 	TLSCertificateSdsSecretConfigs []TLSCertificateSdsSecretConfig `yaml:"tls_certificate_sds_secret_configs,omitempty"`
 	TLSParams                      TLSParams                       `yaml:"tls_params,omitempty"`
+	// The validation context is looked up by name in the file passed
+	// with --id-validation.
+	ValidationContextSdsSecretConfig ValidationContextSdsSecretConfig `yaml:"validation_context_sds_secret_config,omitempty"`
 }
 
 type TLSCertificateSdsSecretConfig struct {
+	Name      string    `yaml:"name"`
+	SdsConfig SdsConfig `yaml:"sds_config,omitempty"`
+}
+
+type SdsConfig struct {
+	// Only read if it exists, see SdsSecrets.
+	Path string `yaml:"path,omitempty"`
+}
+
+type ValidationContextSdsSecretConfig struct {
 	Name string `yaml:"name"`
 }
 
 type TLSParams struct {
-	CipherSuites []string `yaml:"cipher_suites,omitempty"`
+	TLSMinimumProtocolVersion string   `yaml:"tls_minimum_protocol_version,omitempty"`
+	TLSMaximumProtocolVersion string   `yaml:"tls_maximum_protocol_version,omitempty"`
+	CipherSuites              []string `yaml:"cipher_suites,omitempty"`
+	ECDHCurves                []string `yaml:"ecdh_curves,omitempty"`
 }
 
 type ListenerInfo struct {
-	Port          string
-	MTLS          bool
-	Ciphers       string
-	SdsConfigType SdsConfigType
+	Port    string
+	Cluster string
+	MTLS    bool
+	Ciphers string
+	// Empty if the OpenSSL defaults should be used.
+	TLS13Ciphersuites string
+	Protocols         []string
+	ECDHCurves        string
+	// Every cert and key the listener serves, nginx picks one
+	// that the client supports.
+	CertificateSecrets []TLSCertificateSdsSecretConfig
+	// Name of the validation context client certs are verified
+	// against, if MTLS.
+	ValidationContext string
+	// Zero if the nginx default should be used.
+	IdleTimeout      time.Duration
+	HandshakeTimeout time.Duration
+	// Unlimited if 0.
+	MaxConnectionDuration time.Duration
 }
 
 type EnvoyConfParser struct{}
@@ -121,6 +163,11 @@ func (e EnvoyConfParser) ReadUnmarshalEnvoyConfig(envoyConfFile string) (EnvoyCo
 		return conf, fmt.Errorf("Failed to unmarshal envoy config: %s", err)
 	}
 
+	err = ValidateEnvoyConfig(conf)
+	if err != nil {
+		return conf, fmt.Errorf("Invalid envoy config: %s", err)
+	}
+
 	return conf, nil
 }
 
@@ -132,26 +179,40 @@ func (e EnvoyConfParser) GetClusters(conf EnvoyConf) (clusters []Cluster, nameTo
 
 	nameToListeners = make(map[string][]ListenerInfo)
 	for i := 0; i < len(conf.StaticResources.Listeners); i++ {
-		clusterName := conf.StaticResources.Listeners[i].FilterChains[0].Filters[0].TypedConfig.Cluster
-		listenerPort := conf.StaticResources.Listeners[i].Address.SocketAddress.PortValue
-		mTLS := conf.StaticResources.Listeners[i].FilterChains[0].TransportSocket.TypedConfig.RequireClientCertificate
-
-		ciphersArray := conf.StaticResources.Listeners[i].FilterChains[0].TransportSocket.TypedConfig.CommonTLSContext.TLSParams.CipherSuites
-		ciphers := strings.Join(ciphersArray, ":")
-
-		var sdsConfigType SdsConfigType
-		if conf.StaticResources.Listeners[i].FilterChains[0].TransportSocket.TypedConfig.CommonTLSContext.TLSCertificateSdsSecretConfigs[0].Name == "c2c-cert-and-key" {
-			sdsConfigType = SdsC2CConfigType
-		} else {
-			sdsConfigType = SdsIdConfigType
+		listener := ListenerInfo{
+			Port: conf.StaticResources.Listeners[i].Address.SocketAddress.PortValue,
 		}
-		nameToListeners[clusterName] = append(nameToListeners[clusterName], ListenerInfo{
-			Port:          listenerPort,
-			MTLS:          mTLS,
-			Ciphers:       ciphers,
-			SdsConfigType: sdsConfigType,
-		})
+
+		filterChain := conf.StaticResources.Listeners[i].FilterChains[0]
+		for _, filter := range filterChain.Filters {
+			filter.TypedConfig.Config.Translate(&listener)
+		}
+		filterChain.TransportSocket.TypedConfig.Config.Translate(&listener)
+		listener.HandshakeTimeout = filterChain.TransportSocketConnectTimeout.Duration
+
+		nameToListeners[listener.Cluster] = append(nameToListeners[listener.Cluster], listener)
 	}
 
 	return clusters, nameToListeners
 }
+
+// Returns the tls certificate secrets of every listener, each
+// name once, in the order listeners first refer to them.
+func (e EnvoyConfParser) GetCertificateSecrets(conf EnvoyConf) []TLSCertificateSdsSecretConfig {
+	_, nameToListeners := e.GetClusters(conf)
+
+	secrets := []TLSCertificateSdsSecretConfig{}
+	seen := map[string]bool{}
+	for _, cluster := range conf.StaticResources.Clusters {
+		for _, listener := range nameToListeners[cluster.Name] {
+			for _, secret := range listener.CertificateSecrets {
+				if !seen[secret.Name] {
+					seen[secret.Name] = true
+					secrets = append(secrets, secret)
+				}
+			}
+		}
+	}
+
+	return secrets
+}
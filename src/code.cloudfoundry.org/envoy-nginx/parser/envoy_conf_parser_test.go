@@ -62,6 +62,44 @@ var _ = Describe("EnvoyConfigParser", func() {
 				})
 			})
 		})
+
+		Context("when envoy conf is only partially written", func() {
+			var partialYamlFile string
+
+			BeforeEach(func() {
+				tmpFile, err := os.CreateTemp(os.TempDir(), "envoy-partial.yaml")
+				Expect(err).NotTo(HaveOccurred())
+
+				partialYamlFile = tmpFile.Name()
+			})
+
+			AfterEach(func() {
+				os.Remove(partialYamlFile)
+			})
+
+			It("returns an error when there are no listeners", func() {
+				err := os.WriteFile(partialYamlFile, []byte("static_resources:\n  clusters: []\n"), 0644)
+				Expect(err).NotTo(HaveOccurred())
+
+				_, err = envoyConfParser.ReadUnmarshalEnvoyConfig(partialYamlFile)
+				Expect(err).To(MatchError("Invalid envoy config: 1 problem(s): static_resources.listeners: no listeners found"))
+			})
+
+			It("returns an error when a listener is missing its filter chains", func() {
+				err := os.WriteFile(partialYamlFile, []byte(`
+static_resources:
+  listeners:
+  - address:
+      socket_address:
+        address: 0.0.0.0
+        port_value: 61001
+`), 0644)
+				Expect(err).NotTo(HaveOccurred())
+
+				_, err = envoyConfParser.ReadUnmarshalEnvoyConfig(partialYamlFile)
+				Expect(err).To(MatchError("Invalid envoy config: 1 problem(s): static_resources.listeners[0].filter_chains: missing"))
+			})
+		})
 	})
 
 	Describe("GetClusters", func() {
@@ -76,11 +114,11 @@ var _ = Describe("EnvoyConfigParser", func() {
 
 				Expect(nameToListeners["service-cluster-8080"]).To(HaveLen(2))
 				Expect(nameToListeners["service-cluster-8080"]).To(Equal([]parser.ListenerInfo{
-					{Port: "61001", MTLS: true, Ciphers: "ECDHE-RSA-AES256-GCM-SHA384:ECDHE-RSA-AES128-GCM-SHA256", SdsConfigType: parser.SdsIdConfigType},
-					{Port: "61443", MTLS: false, Ciphers: "ECDHE-RSA-AES256-GCM-SHA384:ECDHE-RSA-AES128-GCM-SHA256", SdsConfigType: parser.SdsC2CConfigType},
+					{Port: "61001", Cluster: "service-cluster-8080", MTLS: true, Ciphers: "ECDHE-RSA-AES256-GCM-SHA384:ECDHE-RSA-AES128-GCM-SHA256", Protocols: []string{"TLSv1.2", "TLSv1.3"}, CertificateSecrets: []parser.TLSCertificateSdsSecretConfig{{Name: "id-cert-and-key", SdsConfig: parser.SdsConfig{Path: "/etc/cf-assets/envoy_config/sds-id-cert-and-key.yaml"}}}, ValidationContext: "id-validation-context"},
+					{Port: "61443", Cluster: "service-cluster-8080", MTLS: false, Ciphers: "ECDHE-RSA-AES256-GCM-SHA384:ECDHE-RSA-AES128-GCM-SHA256", Protocols: []string{"TLSv1.2", "TLSv1.3"}, CertificateSecrets: []parser.TLSCertificateSdsSecretConfig{{Name: "c2c-cert-and-key", SdsConfig: parser.SdsConfig{Path: "/etc/cf-assets/envoy_config/sds-c2c-cert-and-key.yaml"}}}},
 				}))
 				Expect(nameToListeners["service-cluster-2222"]).To(Equal([]parser.ListenerInfo{
-					{Port: "61002", MTLS: true, Ciphers: "ECDHE-RSA-AES256-GCM-SHA384:ECDHE-RSA-AES128-GCM-SHA256", SdsConfigType: parser.SdsIdConfigType},
+					{Port: "61002", Cluster: "service-cluster-2222", MTLS: true, Ciphers: "ECDHE-RSA-AES256-GCM-SHA384:ECDHE-RSA-AES128-GCM-SHA256", Protocols: []string{"TLSv1.2", "TLSv1.3"}, CertificateSecrets: []parser.TLSCertificateSdsSecretConfig{{Name: "id-cert-and-key", SdsConfig: parser.SdsConfig{Path: "/etc/cf-assets/envoy_config/sds-id-cert-and-key.yaml"}}}, ValidationContext: "id-validation-context"},
 				}))
 			})
 
@@ -93,10 +131,10 @@ var _ = Describe("EnvoyConfigParser", func() {
 				Expect(nameToListeners).To(HaveLen(2))
 
 				Expect(nameToListeners["0-service-cluster"]).To(Equal([]parser.ListenerInfo{
-					{Port: "61001", MTLS: true, Ciphers: "ECDHE-RSA-AES256-GCM-SHA384:ECDHE-RSA-AES128-GCM-SHA256", SdsConfigType: parser.SdsIdConfigType},
+					{Port: "61001", Cluster: "0-service-cluster", MTLS: true, Ciphers: "ECDHE-RSA-AES256-GCM-SHA384:ECDHE-RSA-AES128-GCM-SHA256", Protocols: []string{"TLSv1.2", "TLSv1.3"}, CertificateSecrets: []parser.TLSCertificateSdsSecretConfig{{Name: "server-cert-and-key", SdsConfig: parser.SdsConfig{Path: "/etc/cf-assets/envoy_config/sds-server-cert-and-key.yaml"}}}, ValidationContext: "server-validation-context"},
 				}))
 				Expect(nameToListeners["1-service-cluster"]).To(Equal([]parser.ListenerInfo{
-					{Port: "61002", MTLS: true, Ciphers: "ECDHE-RSA-AES256-GCM-SHA384", SdsConfigType: parser.SdsIdConfigType},
+					{Port: "61002", Cluster: "1-service-cluster", MTLS: true, Ciphers: "ECDHE-RSA-AES256-GCM-SHA384", Protocols: []string{"TLSv1.2", "TLSv1.3"}, CertificateSecrets: []parser.TLSCertificateSdsSecretConfig{{Name: "server-cert-and-key", SdsConfig: parser.SdsConfig{Path: "/etc/cf-assets/envoy_config/sds-server-cert-and-key.yaml"}}}, ValidationContext: "server-validation-context"},
 				}))
 			})
 		})
@@ -111,4 +149,16 @@ var _ = Describe("EnvoyConfigParser", func() {
 			})
 		})
 	})
+
+	Describe("GetCertificateSecrets", func() {
+		It("returns the tls certificate secrets of the listeners, each name once", func() {
+			conf, err := envoyConfParser.ReadUnmarshalEnvoyConfig(EnvoyConfigFixture)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(envoyConfParser.GetCertificateSecrets(conf)).To(Equal([]parser.TLSCertificateSdsSecretConfig{
+				{Name: "id-cert-and-key", SdsConfig: parser.SdsConfig{Path: "/etc/cf-assets/envoy_config/sds-id-cert-and-key.yaml"}},
+				{Name: "c2c-cert-and-key", SdsConfig: parser.SdsConfig{Path: "/etc/cf-assets/envoy_config/sds-c2c-cert-and-key.yaml"}},
+			}))
+		})
+	})
 })
@@ -0,0 +1,255 @@
+package parser
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// A problem found in the envoy config, located by its yaml path,
+// e.g. static_resources.listeners[2].filter_chains[0].transport_socket.
+type ValidationProblem struct {
+	Path    string
+	Message string
+}
+
+func (p ValidationProblem) String() string {
+	return fmt.Sprintf("%s: %s", p.Path, p.Message)
+}
+
+// Every problem found in an envoy config, returned as one error.
+type ValidationError struct {
+	Problems []ValidationProblem
+}
+
+func (e ValidationError) Error() string {
+	problems := []string{}
+	for _, problem := range e.Problems {
+		problems = append(problems, problem.String())
+	}
+	return fmt.Sprintf("%d problem(s): %s", len(e.Problems), strings.Join(problems, "; "))
+}
+
+type validator struct {
+	problems []ValidationProblem
+}
+
+// A tls certificate secret and where it is first referred to.
+type certificateSecret struct {
+	name string
+	path string
+}
+
+func (v *validator) add(path, format string, args ...interface{}) {
+	v.problems = append(v.problems, ValidationProblem{Path: path, Message: fmt.Sprintf(format, args...)})
+}
+
+/*
+* Checks everything GetClusters and Generate rely on, so that neither
+* has to guard against missing sections. A partially written envoy
+* config can still be valid yaml. Rather than stopping at the first
+* problem, all of them are collected.
+ */
+func ValidateEnvoyConfig(conf EnvoyConf) error {
+	v := &validator{}
+
+	clusters := map[string]string{}
+	for i, cluster := range conf.StaticResources.Clusters {
+		v.validateCluster(fmt.Sprintf("static_resources.clusters[%d]", i), cluster, clusters)
+	}
+
+	if len(conf.StaticResources.Listeners) == 0 {
+		v.add("static_resources.listeners", "no listeners found")
+	}
+
+	ports := map[string]string{}
+	secrets := map[string]certificateSecret{}
+	for i, listener := range conf.StaticResources.Listeners {
+		v.validateListener(fmt.Sprintf("static_resources.listeners[%d]", i), listener, clusters, ports, secrets)
+	}
+
+	if len(v.problems) > 0 {
+		return ValidationError{Problems: v.problems}
+	}
+
+	return nil
+}
+
+func (v *validator) validateCluster(path string, cluster Cluster, clusters map[string]string) {
+	if cluster.Name == "" {
+		v.add(path+".name", "missing")
+	} else if previous, ok := clusters[cluster.Name]; ok {
+		v.add(path+".name", "cluster %q is already defined by %s", cluster.Name, previous)
+	} else {
+		clusters[cluster.Name] = path
+	}
+
+	for i, threshold := range cluster.CircuitBreakers.Thresholds {
+		if threshold.MaxConnections < 0 {
+			v.add(fmt.Sprintf("%s.circuit_breakers.thresholds[%d].max_connections", path, i), "must not be negative, got %d", threshold.MaxConnections)
+		}
+	}
+
+	method, ok := lbPolicies[cluster.LbPolicy]
+	if !ok {
+		v.add(path+".lb_policy", "unsupported lb_policy %q", cluster.LbPolicy)
+	}
+
+	endpointsPath := path + ".load_assignment.endpoints"
+	if len(cluster.LoadAssignment.Endpoints) == 0 {
+		v.add(endpointsPath, "no endpoints")
+		return
+	}
+
+	for i, endpoints := range cluster.LoadAssignment.Endpoints {
+		if endpoints.Priority < 0 {
+			v.add(fmt.Sprintf("%s[%d].priority", endpointsPath, i), "must not be negative, got %d", endpoints.Priority)
+		} else if endpoints.Priority > 0 && ok && !allowsBackup(method) {
+			v.add(fmt.Sprintf("%s[%d].priority", endpointsPath, i), "priorities other than 0 cannot be combined with lb_policy %s", cluster.LbPolicy)
+		}
+
+		lbEndpointsPath := fmt.Sprintf("%s[%d].lb_endpoints", endpointsPath, i)
+		if len(endpoints.LBEndpoints) == 0 {
+			v.add(lbEndpointsPath, "no endpoints")
+			continue
+		}
+
+		for j, lbEndpoint := range endpoints.LBEndpoints {
+			socketAddressPath := fmt.Sprintf("%s[%d].endpoint.address.socket_address", lbEndpointsPath, j)
+			socketAddress := lbEndpoint.Endpoint.Address.SocketAddress
+			if socketAddress.Address == "" {
+				v.add(socketAddressPath+".address", "missing")
+			}
+			if socketAddress.PortValue == "" {
+				v.add(socketAddressPath+".port_value", "missing")
+			}
+			if lbEndpoint.LoadBalancingWeight < 0 {
+				v.add(fmt.Sprintf("%s[%d].load_balancing_weight", lbEndpointsPath, j), "must not be negative, got %d", lbEndpoint.LoadBalancingWeight)
+			}
+		}
+	}
+}
+
+func (v *validator) validateListener(path string, listener Listener, clusters, ports map[string]string, secrets map[string]certificateSecret) {
+	portPath := path + ".address.socket_address.port_value"
+	port := listener.Address.SocketAddress.PortValue
+	if port == "" {
+		v.add(portPath, "missing")
+	} else if previous, ok := ports[port]; ok {
+		v.add(portPath, "port %s is already used by %s", port, previous)
+	} else {
+		ports[port] = path
+	}
+
+	// Only the first filter chain is translated.
+	if len(listener.FilterChains) == 0 {
+		v.add(path+".filter_chains", "missing")
+		return
+	}
+	filterChainPath := path + ".filter_chains[0]"
+	filterChain := listener.FilterChains[0]
+
+	filtersPath := filterChainPath + ".filters"
+	if len(filterChain.Filters) == 0 {
+		v.add(filtersPath, "missing")
+	}
+
+	// Any registered filter may pick the cluster, not only tcp_proxy,
+	// whose cluster is checked where it is set.
+	translated := ListenerInfo{}
+	tcpProxy := false
+	for j, filter := range filterChain.Filters {
+		typedConfigPath := fmt.Sprintf("%s[%d].typed_config", filtersPath, j)
+		switch config := filter.TypedConfig.Config.(type) {
+		case nil:
+			v.validateType(typedConfigPath, filter.TypedConfig.Type)
+		case *TypedConfigDownstreamTlsContext:
+			v.add(typedConfigPath+".@type", "%s is not a network filter", filter.TypedConfig.Type)
+		case *TypedConfigTcpProxy:
+			tcpProxy = true
+			clusterPath := typedConfigPath + ".cluster"
+			if config.Cluster == "" {
+				v.add(clusterPath, "missing")
+			} else if _, ok := clusters[config.Cluster]; !ok {
+				v.add(clusterPath, "undefined cluster %q", config.Cluster)
+			}
+		}
+		if filter.TypedConfig.Config != nil {
+			filter.TypedConfig.Config.Translate(&translated)
+		}
+	}
+	if len(filterChain.Filters) > 0 && !tcpProxy && translated.Cluster == "" {
+		v.add(filtersPath, "no filter proxies to a cluster")
+	}
+
+	transportSocketPath := filterChainPath + ".transport_socket"
+	if reflect.ValueOf(filterChain.TransportSocket).IsZero() {
+		v.add(transportSocketPath, "missing")
+		return
+	}
+
+	typedConfigPath := transportSocketPath + ".typed_config"
+	typedConfig := filterChain.TransportSocket.TypedConfig
+	if typedConfig.Config == nil {
+		v.validateType(typedConfigPath, typedConfig.Type)
+		return
+	}
+
+	// nginx listens with ssl, other transport sockets cannot be translated.
+	tlsContext, ok := typedConfig.Config.(*TypedConfigDownstreamTlsContext)
+	if !ok {
+		v.add(typedConfigPath+".@type", "%s is not a tls transport socket", typedConfig.Type)
+		return
+	}
+
+	sdsSecretConfigsPath := typedConfigPath + ".common_tls_context.tls_certificate_sds_secret_configs"
+	if len(tlsContext.CommonTLSContext.TLSCertificateSdsSecretConfigs) == 0 {
+		v.add(sdsSecretConfigsPath, "missing")
+	}
+	for i, secret := range tlsContext.CommonTLSContext.TLSCertificateSdsSecretConfigs {
+		// The cert and key are written to files named after the secret.
+		namePath := fmt.Sprintf("%s[%d].name", sdsSecretConfigsPath, i)
+		if !secretName.MatchString(secret.Name) {
+			v.add(namePath, "invalid name %q, expected letters, digits, '.', '-' and '_'", secret.Name)
+			continue
+		}
+
+		prefix := certificateFilePrefix(secret.Name)
+		if previous, ok := secrets[prefix]; !ok {
+			secrets[prefix] = certificateSecret{name: secret.Name, path: namePath}
+		} else if previous.name != secret.Name {
+			v.add(namePath, "secret %q would be written to the same %s-cert.pem and %s-key.pem as %q of %s", secret.Name, prefix, prefix, previous.name, previous.path)
+		}
+	}
+
+	v.validateTLSParams(typedConfigPath+".common_tls_context.tls_params", tlsContext.CommonTLSContext.TLSParams)
+}
+
+func (v *validator) validateTLSParams(path string, params TLSParams) {
+	min := tlsVersionIndex(params.TLSMinimumProtocolVersion, defaultTLSMinimumProtocolVersion)
+	if min < 0 {
+		v.add(path+".tls_minimum_protocol_version", "unsupported version %q", params.TLSMinimumProtocolVersion)
+	}
+	max := tlsVersionIndex(params.TLSMaximumProtocolVersion, defaultTLSMaximumProtocolVersion)
+	if max < 0 {
+		v.add(path+".tls_maximum_protocol_version", "unsupported version %q", params.TLSMaximumProtocolVersion)
+	}
+	if min >= 0 && max >= 0 && min > max {
+		v.add(path, "tls_minimum_protocol_version %s is newer than tls_maximum_protocol_version %s", tlsVersions[min].envoy, tlsVersions[max].envoy)
+	}
+
+	// Ciphers without an OpenSSL equivalent are reported by
+	// CheckCompatibility, but nginx needs at least one.
+	if len(params.CipherSuites) > 0 && len(translateCipherSuites(params.CipherSuites)) == 0 {
+		v.add(path+".cipher_suites", "none of %s has an OpenSSL equivalent", strings.Join(params.CipherSuites, ", "))
+	}
+}
+
+// Reports the @type of a typed_config that no struct is registered for.
+func (v *validator) validateType(path, typeURL string) {
+	if typeURL == "" {
+		v.add(path+".@type", "missing")
+	} else {
+		v.add(path+".@type", "unsupported type %q", typeURL)
+	}
+}
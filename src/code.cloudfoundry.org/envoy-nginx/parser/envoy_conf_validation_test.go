@@ -0,0 +1,285 @@
+package parser_test
+
+import (
+	"code.cloudfoundry.org/envoy-nginx/parser"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	yaml "gopkg.in/yaml.v2"
+)
+
+var _ = Describe("ValidateEnvoyConfig", func() {
+	validate := func(envoyConfig string) error {
+		conf := parser.EnvoyConf{}
+		Expect(yaml.Unmarshal([]byte(envoyConfig), &conf)).To(Succeed())
+		return parser.ValidateEnvoyConfig(conf)
+	}
+
+	It("accepts the fixtures", func() {
+		for _, fixture := range []string{EnvoyConfigFixture, EnvoyOneListenerPerServerConfigFixture} {
+			conf, err := parser.NewEnvoyConfParser().ReadUnmarshalEnvoyConfig(fixture)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(parser.ValidateEnvoyConfig(conf)).To(Succeed())
+		}
+	})
+
+	It("collects every problem with its location", func() {
+		err := validate(`
+static_resources:
+  clusters:
+  - name: 0-service-cluster
+    load_assignment:
+      endpoints:
+      - lb_endpoints:
+        - endpoint:
+            address:
+              socket_address:
+                address: 10.255.0.1
+                port_value: 8080
+  - name: 0-service-cluster
+    load_assignment:
+      endpoints:
+      - lb_endpoints: []
+  - name: 1-service-cluster
+    load_assignment:
+      endpoints:
+      - lb_endpoints:
+        - endpoint:
+            address:
+              socket_address:
+                port_value: 2222
+  - name: 2-service-cluster
+  listeners:
+  - address:
+      socket_address:
+        port_value: 61001
+    filter_chains:
+    - filters:
+      - typed_config:
+          "@type": type.googleapis.com/envoy.extensions.filters.network.tcp_proxy.v3.TcpProxy
+          cluster: 0-service-cluster
+      transport_socket:
+        typed_config:
+          "@type": type.googleapis.com/envoy.extensions.transport_sockets.tls.v3.DownstreamTlsContext
+          common_tls_context:
+            tls_certificate_sds_secret_configs:
+            - name: id-cert-and-key
+  - address:
+      socket_address:
+        port_value: 61001
+    filter_chains:
+    - filters:
+      - typed_config:
+          "@type": type.googleapis.com/envoy.extensions.filters.network.tcp_proxy.v3.TcpProxy
+          cluster: 3-service-cluster
+      transport_socket:
+        typed_config:
+          "@type": type.googleapis.com/envoy.extensions.transport_sockets.tls.v3.DownstreamTlsContext
+          common_tls_context:
+            tls_certificate_sds_secret_configs:
+            - name: ../id-cert-and-key
+  - address:
+      socket_address:
+        port_value: 61002
+    filter_chains:
+    - filters:
+      - typed_config:
+          "@type": type.googleapis.com/envoy.extensions.filters.network.tcp_proxy.v3.TcpProxy
+          cluster: 1-service-cluster
+  - address:
+      socket_address:
+        port_value: 61003
+    filter_chains:
+    - filters: []
+      transport_socket:
+        typed_config:
+          "@type": type.googleapis.com/envoy.extensions.transport_sockets.tls.v3.DownstreamTlsContext
+          require_client_certificate: true
+  - address:
+      socket_address:
+        port_value: 61004
+  - address:
+      socket_address:
+        port_value: 61005
+    filter_chains:
+    - filters:
+      - typed_config:
+          "@type": type.googleapis.com/envoy.extensions.filters.network.http_connection_manager.v3.HttpConnectionManager
+      - typed_config:
+          "@type": type.googleapis.com/envoy.extensions.transport_sockets.tls.v3.DownstreamTlsContext
+      transport_socket:
+        typed_config:
+          "@type": type.googleapis.com/envoy.config.filter.network.tcp_proxy.v2.TcpProxy
+          cluster: 0-service-cluster
+`)
+
+		Expect(err).To(BeAssignableToTypeOf(parser.ValidationError{}))
+		Expect(err.(parser.ValidationError).Problems).To(Equal([]parser.ValidationProblem{
+			{Path: "static_resources.clusters[1].name", Message: `cluster "0-service-cluster" is already defined by static_resources.clusters[0]`},
+			{Path: "static_resources.clusters[1].load_assignment.endpoints[0].lb_endpoints", Message: "no endpoints"},
+			{Path: "static_resources.clusters[2].load_assignment.endpoints[0].lb_endpoints[0].endpoint.address.socket_address.address", Message: "missing"},
+			{Path: "static_resources.clusters[3].load_assignment.endpoints", Message: "no endpoints"},
+			{Path: "static_resources.listeners[1].address.socket_address.port_value", Message: "port 61001 is already used by static_resources.listeners[0]"},
+			{Path: "static_resources.listeners[1].filter_chains[0].filters[0].typed_config.cluster", Message: `undefined cluster "3-service-cluster"`},
+			{Path: "static_resources.listeners[1].filter_chains[0].transport_socket.typed_config.common_tls_context.tls_certificate_sds_secret_configs[0].name", Message: `invalid name "../id-cert-and-key", expected letters, digits, '.', '-' and '_'`},
+			{Path: "static_resources.listeners[2].filter_chains[0].transport_socket", Message: "missing"},
+			{Path: "static_resources.listeners[3].filter_chains[0].filters", Message: "missing"},
+			{Path: "static_resources.listeners[3].filter_chains[0].transport_socket.typed_config.common_tls_context.tls_certificate_sds_secret_configs", Message: "missing"},
+			{Path: "static_resources.listeners[4].filter_chains", Message: "missing"},
+			{Path: "static_resources.listeners[5].filter_chains[0].filters[0].typed_config.@type", Message: `unsupported type "type.googleapis.com/envoy.extensions.filters.network.http_connection_manager.v3.HttpConnectionManager"`},
+			{Path: "static_resources.listeners[5].filter_chains[0].filters[1].typed_config.@type", Message: "type.googleapis.com/envoy.extensions.transport_sockets.tls.v3.DownstreamTlsContext is not a network filter"},
+			{Path: "static_resources.listeners[5].filter_chains[0].filters", Message: "no filter proxies to a cluster"},
+			{Path: "static_resources.listeners[5].filter_chains[0].transport_socket.typed_config.@type", Message: "type.googleapis.com/envoy.config.filter.network.tcp_proxy.v2.TcpProxy is not a tls transport socket"},
+		}))
+	})
+
+	It("returns all problems as one error", func() {
+		err := validate(`
+static_resources:
+  listeners:
+  - address:
+      socket_address:
+        address: 0.0.0.0
+  - address:
+      socket_address:
+        port_value: 61001
+`)
+		Expect(err).To(MatchError("3 problem(s): " +
+			"static_resources.listeners[0].address.socket_address.port_value: missing; " +
+			"static_resources.listeners[0].filter_chains: missing; " +
+			"static_resources.listeners[1].filter_chains: missing"))
+	})
+
+	It("reports lb_policies, priorities and limits nginx cannot balance with", func() {
+		err := validate(`
+static_resources:
+  clusters:
+  - name: 0-service-cluster
+    lb_policy: CLUSTER_PROVIDED
+    circuit_breakers:
+      thresholds:
+      - max_connections: -1
+    load_assignment:
+      endpoints:
+      - lb_endpoints:
+        - endpoint:
+            address:
+              socket_address:
+                address: 10.255.0.1
+                port_value: 8080
+          load_balancing_weight: -1
+  - name: 1-service-cluster
+    lb_policy: RANDOM
+    load_assignment:
+      endpoints:
+      - priority: -1
+        lb_endpoints:
+        - endpoint:
+            address:
+              socket_address:
+                address: 10.255.0.1
+                port_value: 8080
+      - priority: 1
+        lb_endpoints:
+        - endpoint:
+            address:
+              socket_address:
+                address: 10.255.0.2
+                port_value: 8080
+  listeners: []
+`)
+		Expect(err).To(BeAssignableToTypeOf(parser.ValidationError{}))
+		Expect(err.(parser.ValidationError).Problems).To(Equal([]parser.ValidationProblem{
+			{Path: "static_resources.clusters[0].circuit_breakers.thresholds[0].max_connections", Message: "must not be negative, got -1"},
+			{Path: "static_resources.clusters[0].lb_policy", Message: `unsupported lb_policy "CLUSTER_PROVIDED"`},
+			{Path: "static_resources.clusters[0].load_assignment.endpoints[0].lb_endpoints[0].load_balancing_weight", Message: "must not be negative, got -1"},
+			{Path: "static_resources.clusters[1].load_assignment.endpoints[0].priority", Message: "must not be negative, got -1"},
+			{Path: "static_resources.clusters[1].load_assignment.endpoints[1].priority", Message: "priorities other than 0 cannot be combined with lb_policy RANDOM"},
+			{Path: "static_resources.listeners", Message: "no listeners found"},
+		}))
+	})
+
+	It("reports tls protocol versions and cipher suites nginx does not know", func() {
+		err := validate(`
+static_resources:
+  listeners:
+  - address:
+      socket_address:
+        port_value: 61001
+    filter_chains:
+    - transport_socket:
+        typed_config:
+          "@type": type.googleapis.com/envoy.extensions.transport_sockets.tls.v3.DownstreamTlsContext
+          common_tls_context:
+            tls_certificate_sds_secret_configs:
+            - name: id-cert-and-key
+            tls_params:
+              tls_minimum_protocol_version: SSLv3
+              tls_maximum_protocol_version: TLSv1_4
+  - address:
+      socket_address:
+        port_value: 61002
+    filter_chains:
+    - transport_socket:
+        typed_config:
+          "@type": type.googleapis.com/envoy.extensions.transport_sockets.tls.v3.DownstreamTlsContext
+          common_tls_context:
+            tls_certificate_sds_secret_configs:
+            - name: id-cert-and-key
+            tls_params:
+              tls_minimum_protocol_version: TLSv1_3
+              tls_maximum_protocol_version: TLSv1_2
+              cipher_suites:
+              - ECDHE-RSA-CHACHA20-POLY1305-OLD
+              - banana
+`)
+		tlsParams := ".filter_chains[0].transport_socket.typed_config.common_tls_context.tls_params"
+		Expect(err).To(BeAssignableToTypeOf(parser.ValidationError{}))
+		Expect(err.(parser.ValidationError).Problems).To(ContainElements(
+			parser.ValidationProblem{Path: "static_resources.listeners[0]" + tlsParams + ".tls_minimum_protocol_version", Message: `unsupported version "SSLv3"`},
+			parser.ValidationProblem{Path: "static_resources.listeners[0]" + tlsParams + ".tls_maximum_protocol_version", Message: `unsupported version "TLSv1_4"`},
+			parser.ValidationProblem{Path: "static_resources.listeners[1]" + tlsParams, Message: "tls_minimum_protocol_version TLSv1_3 is newer than tls_maximum_protocol_version TLSv1_2"},
+			parser.ValidationProblem{Path: "static_resources.listeners[1]" + tlsParams + ".cipher_suites", Message: "none of ECDHE-RSA-CHACHA20-POLY1305-OLD, banana has an OpenSSL equivalent"},
+		))
+	})
+
+	It("reports secrets whose cert and key would be written to the same files", func() {
+		err := validate(`
+static_resources:
+  listeners:
+  - address:
+      socket_address:
+        port_value: 61001
+    filter_chains:
+    - transport_socket:
+        typed_config:
+          "@type": type.googleapis.com/envoy.extensions.transport_sockets.tls.v3.DownstreamTlsContext
+          common_tls_context:
+            tls_certificate_sds_secret_configs:
+            - name: id-cert-and-key
+  - address:
+      socket_address:
+        port_value: 61002
+    filter_chains:
+    - transport_socket:
+        typed_config:
+          "@type": type.googleapis.com/envoy.extensions.transport_sockets.tls.v3.DownstreamTlsContext
+          common_tls_context:
+            tls_certificate_sds_secret_configs:
+            - name: id-cert-and-key
+            - name: id
+`)
+		Expect(err).To(BeAssignableToTypeOf(parser.ValidationError{}))
+		Expect(err.(parser.ValidationError).Problems).To(ContainElement(parser.ValidationProblem{
+			Path:    "static_resources.listeners[1].filter_chains[0].transport_socket.typed_config.common_tls_context.tls_certificate_sds_secret_configs[1].name",
+			Message: `secret "id" would be written to the same id-cert.pem and id-key.pem as "id-cert-and-key" of static_resources.listeners[0].filter_chains[0].transport_socket.typed_config.common_tls_context.tls_certificate_sds_secret_configs[0].name`,
+		}))
+		Expect(err.(parser.ValidationError).Problems).NotTo(ContainElement(HaveField("Path", ContainSubstring("tls_certificate_sds_secret_configs[0].name"))))
+	})
+
+	Context("when there are no listeners", func() {
+		It("returns a helpful error", func() {
+			err := validate("static_resources:\n  clusters: []\n")
+			Expect(err).To(MatchError("1 problem(s): static_resources.listeners: no listeners found"))
+		})
+	})
+})
@@ -12,10 +12,18 @@ type SdsCredParser struct {
 		}
 	}
 
-	ConfigTypeCall struct {
+	FingerprintCall struct {
 		CallCount int
 		Returns   struct {
-			ConfigType parser.SdsConfigType
+			Fingerprint parser.SdsFingerprint
+			Error       error
+		}
+	}
+
+	NameCall struct {
+		CallCount int
+		Returns   struct {
+			Name string
 		}
 	}
 }
@@ -26,8 +34,14 @@ func (e SdsCredParser) GetCertAndKey() (string, string, error) {
 	return e.GetCertAndKeyCall.Returns.Cert, e.GetCertAndKeyCall.Returns.Key, e.GetCertAndKeyCall.Returns.Error
 }
 
-func (e SdsCredParser) ConfigType() parser.SdsConfigType {
-	e.ConfigTypeCall.CallCount++
+func (e SdsCredParser) Fingerprint() (parser.SdsFingerprint, error) {
+	e.FingerprintCall.CallCount++
+
+	return e.FingerprintCall.Returns.Fingerprint, e.FingerprintCall.Returns.Error
+}
+
+func (e SdsCredParser) Name() string {
+	e.NameCall.CallCount++
 
-	return e.ConfigTypeCall.Returns.ConfigType
+	return e.NameCall.Returns.Name
 }
@@ -1,17 +1,33 @@
 package fakes
 
+import "code.cloudfoundry.org/envoy-nginx/parser"
+
 type SdsIdValidationParser struct {
-	GetCACertCall struct {
+	GetValidationContextsCall struct {
 		CallCount int
 		Returns   struct {
-			CA    string
-			Error error
+			ValidationContexts []parser.SdsValidationContext
+			Error              error
 		}
 	}
+
+	FingerprintCall struct {
+		CallCount int
+		Returns   struct {
+			Fingerprint parser.SdsFingerprint
+			Error       error
+		}
+	}
+}
+
+func (s SdsIdValidationParser) GetValidationContexts() ([]parser.SdsValidationContext, error) {
+	s.GetValidationContextsCall.CallCount++
+
+	return s.GetValidationContextsCall.Returns.ValidationContexts, s.GetValidationContextsCall.Returns.Error
 }
 
-func (s SdsIdValidationParser) GetCACert() (string, error) {
-	s.GetCACertCall.CallCount++
+func (s SdsIdValidationParser) Fingerprint() (parser.SdsFingerprint, error) {
+	s.FingerprintCall.CallCount++
 
-	return s.GetCACertCall.Returns.CA, s.GetCACertCall.Returns.Error
+	return s.FingerprintCall.Returns.Fingerprint, s.FingerprintCall.Returns.Error
 }
@@ -0,0 +1,17 @@
+package parser
+
+// envoy lb_policies and the nginx directive that balances an upstream
+// the same way. Round robin is the nginx default and needs none.
+var lbPolicies = map[string][]string{
+	"":              nil,
+	"ROUND_ROBIN":   nil,
+	"LEAST_REQUEST": {"least_conn"},
+	"RING_HASH":     {"hash", "$remote_addr", "consistent"},
+	"MAGLEV":        {"hash", "$remote_addr", "consistent"},
+	"RANDOM":        {"random"},
+}
+
+// nginx rejects backup servers in upstreams balanced by hash or random.
+func allowsBackup(method []string) bool {
+	return len(method) == 0 || method[0] == "least_conn"
+}
@@ -0,0 +1,295 @@
+package parser
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The nginx.conf generated from an envoy config. Only the
+// directives envoy-nginx emits are modelled.
+type NginxConf struct {
+	// Paths of dynamic modules to load, e.g. njs.
+	LoadModules     []string
+	WorkerProcesses int
+	// nginx stays in the foreground, so that the master process
+	// is the one started by the supervisor.
+	Daemon bool
+	// nginx's default (error) if empty.
+	ErrorLogLevel string
+	ErrorLog      string
+	Pid           string
+	Events        NginxEvents
+	Stream        NginxStream
+}
+
+type NginxEvents struct {
+	WorkerConnections int
+}
+
+type NginxStream struct {
+	// njs modules by the name they are imported as.
+	JSImports []NginxJSImport
+	Upstreams []NginxUpstream
+	Servers   []NginxServer
+}
+
+type NginxJSImport struct {
+	Name string
+	Path string
+}
+
+func (s NginxStream) imports(name string) bool {
+	for _, jsImport := range s.JSImports {
+		if jsImport.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+type NginxUpstream struct {
+	Name string
+	// The directive choosing a server, e.g. least_conn,
+	// round robin if empty.
+	Method []string
+	// Size of the shared memory zone that keeps the state of the
+	// servers, without one every worker keeps its own.
+	ZoneSize string
+	Servers  []NginxUpstreamServer
+}
+
+type NginxUpstreamServer struct {
+	Address string
+	Port    string
+	// nginx's default (1) if 0.
+	Weight int
+	// Unlimited if 0.
+	MaxConns int
+	Backup   bool
+}
+
+type NginxServer struct {
+	Listen string
+	// Name of the upstream connections are proxied to.
+	ProxyPass string
+	// nginx picks the first one the client supports.
+	SSLCertificates []NginxSSLCertificate
+	// Client certs are only verified if set.
+	SSLClientCertificate string
+	// njs function that accepts or rejects a connection once the
+	// handshake is done, e.g. to verify client cert SANs.
+	JSPreread string
+	// njs function that sees the data of a connection in both
+	// directions, e.g. to close it after MaxConnectionDuration.
+	JSFilter string
+	// Passed to JSFilter as $max_connection_duration in
+	// milliseconds, unlimited if 0.
+	MaxConnectionDuration  time.Duration
+	SSLPreferServerCiphers bool
+	SSLProtocols           []string
+	// The OpenSSL defaults are used for any of these if empty.
+	SSLCiphers   string
+	SSLECDHCurve string
+	// TLS 1.3 cipher suites, which OpenSSL configures apart from
+	// ssl_ciphers.
+	SSLCiphersuites string
+	// The nginx defaults are used for timeouts of 0.
+	ProxyConnectTimeout time.Duration
+	ProxyTimeout        time.Duration
+	SSLHandshakeTimeout time.Duration
+}
+
+type NginxSSLCertificate struct {
+	Certificate string
+	Key         string
+}
+
+// A simple directive, or a block directive if it has a block.
+type directive struct {
+	name  string
+	args  []string
+	block []directive
+}
+
+func simple(name string, args ...string) directive {
+	return directive{name: name, args: args}
+}
+
+func onOff(on bool) string {
+	if on {
+		return "on"
+	}
+	return "off"
+}
+
+// Renders the nginx.conf. The same NginxConf always renders the same
+// bytes, directives are written in a fixed order, one per line, with
+// nested blocks indented by four spaces.
+func (c NginxConf) Render() []byte {
+	out := &bytes.Buffer{}
+	renderDirectives(out, c.directives(), 0)
+	return out.Bytes()
+}
+
+func (c NginxConf) directives() []directive {
+	errorLog := simple("error_log", c.ErrorLog)
+	if c.ErrorLogLevel != "" {
+		errorLog.args = append(errorLog.args, c.ErrorLogLevel)
+	}
+
+	directives := []directive{}
+	for _, module := range c.LoadModules {
+		directives = append(directives, simple("load_module", module))
+	}
+
+	return append(directives,
+		simple("worker_processes", strconv.Itoa(c.WorkerProcesses)),
+		simple("daemon", onOff(c.Daemon)),
+		errorLog,
+		simple("pid", c.Pid),
+		directive{name: "events", block: []directive{
+			simple("worker_connections", strconv.Itoa(c.Events.WorkerConnections)),
+		}},
+		directive{name: "stream", block: c.Stream.directives()},
+	)
+}
+
+func (s NginxStream) directives() []directive {
+	directives := []directive{}
+	for _, jsImport := range s.JSImports {
+		directives = append(directives, simple("js_import", jsImport.Name, "from", jsImport.Path))
+	}
+	for _, upstream := range s.Upstreams {
+		directives = append(directives, upstream.directive())
+	}
+	for _, server := range s.Servers {
+		directives = append(directives, server.directive())
+	}
+	return directives
+}
+
+func (u NginxUpstream) directive() directive {
+	directives := []directive{}
+	if len(u.Method) > 0 {
+		directives = append(directives, simple(u.Method[0], u.Method[1:]...))
+	}
+	if u.ZoneSize != "" {
+		directives = append(directives, simple("zone", u.Name, u.ZoneSize))
+	}
+	for _, server := range u.Servers {
+		args := []string{server.Address + ":" + server.Port}
+		if server.Weight > 0 {
+			args = append(args, "weight="+strconv.Itoa(server.Weight))
+		}
+		if server.MaxConns > 0 {
+			args = append(args, "max_conns="+strconv.Itoa(server.MaxConns))
+		}
+		if server.Backup {
+			args = append(args, "backup")
+		}
+		directives = append(directives, simple("server", args...))
+	}
+	return directive{name: "upstream", args: []string{u.Name}, block: directives}
+}
+
+func (s NginxServer) directive() directive {
+	directives := []directive{simple("listen", s.Listen, "ssl")}
+	for _, certificate := range s.SSLCertificates {
+		directives = append(directives,
+			simple("ssl_certificate", certificate.Certificate),
+			simple("ssl_certificate_key", certificate.Key),
+		)
+	}
+	if s.SSLClientCertificate != "" {
+		directives = append(directives,
+			simple("ssl_client_certificate", s.SSLClientCertificate),
+			simple("ssl_verify_client", "on"),
+		)
+	}
+	if s.JSPreread != "" {
+		directives = append(directives, simple("js_preread", s.JSPreread))
+	}
+	if s.MaxConnectionDuration > 0 {
+		directives = append(directives, simple("set", "$max_connection_duration", strconv.FormatInt(milliseconds(s.MaxConnectionDuration), 10)))
+	}
+	if s.JSFilter != "" {
+		directives = append(directives, simple("js_filter", s.JSFilter))
+	}
+	directives = append(directives, simple("ssl_prefer_server_ciphers", onOff(s.SSLPreferServerCiphers)))
+	if len(s.SSLProtocols) > 0 {
+		directives = append(directives, simple("ssl_protocols", s.SSLProtocols...))
+	}
+	if s.SSLCiphers != "" {
+		directives = append(directives, simple("ssl_ciphers", s.SSLCiphers))
+	}
+	if s.SSLCiphersuites != "" {
+		directives = append(directives, simple("ssl_conf_command", "Ciphersuites", s.SSLCiphersuites))
+	}
+	if s.SSLECDHCurve != "" {
+		directives = append(directives, simple("ssl_ecdh_curve", s.SSLECDHCurve))
+	}
+	directives = append(directives, simple("proxy_pass", s.ProxyPass))
+	for _, timeout := range []struct {
+		name     string
+		duration time.Duration
+	}{
+		{"proxy_connect_timeout", s.ProxyConnectTimeout},
+		{"proxy_timeout", s.ProxyTimeout},
+		{"ssl_handshake_timeout", s.SSLHandshakeTimeout},
+	} {
+		if timeout.duration > 0 {
+			directives = append(directives, simple(timeout.name, nginxTime(timeout.duration)))
+		}
+	}
+
+	return directive{name: "server", block: directives}
+}
+
+// nginx times have millisecond resolution, shorter ones are rounded up.
+func nginxTime(d time.Duration) string {
+	if d%time.Second == 0 {
+		return fmt.Sprintf("%ds", d/time.Second)
+	}
+	return fmt.Sprintf("%dms", milliseconds(d))
+}
+
+func milliseconds(d time.Duration) int64 {
+	return int64((d + time.Millisecond - 1) / time.Millisecond)
+}
+
+func renderDirectives(out *bytes.Buffer, directives []directive, depth int) {
+	indent := strings.Repeat("    ", depth)
+	for i, d := range directives {
+		// Blocks are set apart from what comes before them.
+		if d.block != nil && i > 0 {
+			out.WriteString("\n")
+		}
+
+		out.WriteString(indent + d.name)
+		for _, arg := range d.args {
+			out.WriteString(" " + quote(arg))
+		}
+
+		if d.block == nil {
+			out.WriteString(";\n")
+			continue
+		}
+
+		out.WriteString(" {\n")
+		renderDirectives(out, d.block, depth+1)
+		out.WriteString(indent + "}\n")
+	}
+}
+
+// Quotes an argument if nginx would otherwise split it or read part
+// of it as syntax. Variables are expanded in quoted arguments as well,
+// so $ is left alone.
+func quote(arg string) string {
+	if arg != "" && !strings.ContainsAny(arg, " \t\r\n;{}\"'#\\") {
+		return arg
+	}
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(arg) + `"`
+}
@@ -0,0 +1,174 @@
+package parser_test
+
+import (
+	"time"
+
+	"code.cloudfoundry.org/envoy-nginx/parser"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("NginxConf", func() {
+	Describe("Render", func() {
+		var conf parser.NginxConf
+
+		BeforeEach(func() {
+			conf = parser.NginxConf{
+				WorkerProcesses: 2,
+				ErrorLog:        "logs/error.log",
+				ErrorLogLevel:   "warn",
+				Pid:             "/tmp/nginx/nginx.pid",
+				Events:          parser.NginxEvents{WorkerConnections: 1024},
+				Stream: parser.NginxStream{
+					Upstreams: []parser.NginxUpstream{
+						{Name: "service-cluster-8080", Servers: []parser.NginxUpstreamServer{{Address: "10.255.0.1", Port: "8080"}}},
+					},
+					Servers: []parser.NginxServer{
+						{
+							Listen:                 "61001",
+							ProxyPass:              "service-cluster-8080",
+							SSLCertificates:        []parser.NginxSSLCertificate{{Certificate: "/tmp/nginx/id-cert.pem", Key: "/tmp/nginx/id-key.pem"}},
+							SSLClientCertificate:   "/tmp/nginx/id-ca.pem",
+							SSLPreferServerCiphers: true,
+							SSLCiphers:             "ECDHE-RSA-AES256-GCM-SHA384:ECDHE-RSA-AES128-GCM-SHA256",
+						},
+						{
+							Listen:          "61443",
+							ProxyPass:       "service-cluster-8080",
+							SSLCertificates: []parser.NginxSSLCertificate{{Certificate: "/tmp/nginx/c2c-cert.pem", Key: "/tmp/nginx/c2c-key.pem"}},
+						},
+					},
+				},
+			}
+		})
+
+		It("renders every directive in a fixed order", func() {
+			Expect(string(conf.Render())).To(Equal(`worker_processes 2;
+daemon off;
+error_log logs/error.log warn;
+pid /tmp/nginx/nginx.pid;
+
+events {
+    worker_connections 1024;
+}
+
+stream {
+    upstream service-cluster-8080 {
+        server 10.255.0.1:8080;
+    }
+
+    server {
+        listen 61001 ssl;
+        ssl_certificate /tmp/nginx/id-cert.pem;
+        ssl_certificate_key /tmp/nginx/id-key.pem;
+        ssl_client_certificate /tmp/nginx/id-ca.pem;
+        ssl_verify_client on;
+        ssl_prefer_server_ciphers on;
+        ssl_ciphers ECDHE-RSA-AES256-GCM-SHA384:ECDHE-RSA-AES128-GCM-SHA256;
+        proxy_pass service-cluster-8080;
+    }
+
+    server {
+        listen 61443 ssl;
+        ssl_certificate /tmp/nginx/c2c-cert.pem;
+        ssl_certificate_key /tmp/nginx/c2c-key.pem;
+        ssl_prefer_server_ciphers off;
+        proxy_pass service-cluster-8080;
+    }
+}
+`))
+		})
+
+		It("renders the balancing method, zone, weights, limits and backups of an upstream", func() {
+			conf.Stream.Upstreams[0].Method = []string{"hash", "$remote_addr", "consistent"}
+			conf.Stream.Upstreams[0].ZoneSize = "64k"
+			conf.Stream.Upstreams[0].Servers = []parser.NginxUpstreamServer{
+				{Address: "10.255.0.1", Port: "8080", Weight: 3, MaxConns: 100},
+				{Address: "10.255.0.2", Port: "8080", MaxConns: 100, Backup: true},
+			}
+			Expect(string(conf.Render())).To(ContainSubstring(`
+    upstream service-cluster-8080 {
+        hash $remote_addr consistent;
+        zone service-cluster-8080 64k;
+        server 10.255.0.1:8080 weight=3 max_conns=100;
+        server 10.255.0.2:8080 max_conns=100 backup;
+    }
+`))
+		})
+
+		It("renders the tls protocols, TLS 1.3 cipher suites and curves", func() {
+			conf.Stream.Servers[1].SSLProtocols = []string{"TLSv1.2", "TLSv1.3"}
+			conf.Stream.Servers[1].SSLCiphers = "ECDHE-RSA-AES128-GCM-SHA256"
+			conf.Stream.Servers[1].SSLCiphersuites = "TLS_AES_256_GCM_SHA384:TLS_CHACHA20_POLY1305_SHA256"
+			conf.Stream.Servers[1].SSLECDHCurve = "X25519:P-256"
+			Expect(string(conf.Render())).To(ContainSubstring(`
+        ssl_prefer_server_ciphers off;
+        ssl_protocols TLSv1.2 TLSv1.3;
+        ssl_ciphers ECDHE-RSA-AES128-GCM-SHA256;
+        ssl_conf_command Ciphersuites TLS_AES_256_GCM_SHA384:TLS_CHACHA20_POLY1305_SHA256;
+        ssl_ecdh_curve X25519:P-256;
+`))
+		})
+
+		It("renders timeouts in nginx time units", func() {
+			conf.Stream.Servers[1].ProxyConnectTimeout = 250 * time.Millisecond
+			conf.Stream.Servers[1].ProxyTimeout = time.Hour
+			conf.Stream.Servers[1].SSLHandshakeTimeout = 1500 * time.Microsecond
+			Expect(string(conf.Render())).To(ContainSubstring(`
+        proxy_pass service-cluster-8080;
+        proxy_connect_timeout 250ms;
+        proxy_timeout 3600s;
+        ssl_handshake_timeout 2ms;
+    }
+`))
+		})
+
+		It("renders the njs module, imports and preread handlers", func() {
+			conf.LoadModules = []string{"modules/ngx_stream_js_module.so"}
+			conf.Stream.JSImports = []parser.NginxJSImport{{Name: "san", Path: "/tmp/nginx/san-verifier.js"}}
+			conf.Stream.Servers[0].JSPreread = "san.verify"
+			rendered := string(conf.Render())
+			Expect(rendered).To(HavePrefix("load_module modules/ngx_stream_js_module.so;\nworker_processes 2;\n"))
+			Expect(rendered).To(ContainSubstring(`
+stream {
+    js_import san from /tmp/nginx/san-verifier.js;
+
+    upstream service-cluster-8080 {
+`))
+			Expect(rendered).To(ContainSubstring(`
+        ssl_verify_client on;
+        js_preread san.verify;
+`))
+		})
+
+		It("renders the max connection duration in milliseconds for the njs filter", func() {
+			conf.Stream.Servers[0].MaxConnectionDuration = 90 * time.Second
+			conf.Stream.Servers[0].JSFilter = "duration.limit"
+			Expect(string(conf.Render())).To(ContainSubstring(`
+        ssl_verify_client on;
+        set $max_connection_duration 90000;
+        js_filter duration.limit;
+`))
+		})
+
+		It("leaves out the error log level if it is not set", func() {
+			conf.ErrorLogLevel = ""
+			Expect(string(conf.Render())).To(ContainSubstring("\nerror_log logs/error.log;\n"))
+		})
+
+		DescribeTable("quotes arguments nginx would otherwise misread",
+			func(pid, expected string) {
+				conf.Pid = pid
+				Expect(string(conf.Render())).To(ContainSubstring("\npid " + expected + ";\n"))
+			},
+			Entry("with a space", "/tmp/my nginx/nginx.pid", `"/tmp/my nginx/nginx.pid"`),
+			Entry("with a semicolon", "/tmp/nginx;/nginx.pid", `"/tmp/nginx;/nginx.pid"`),
+			Entry("with a brace", "/tmp/{nginx}/nginx.pid", `"/tmp/{nginx}/nginx.pid"`),
+			Entry("with a comment", "/tmp/#nginx/nginx.pid", `"/tmp/#nginx/nginx.pid"`),
+			Entry("with quotes", `/tmp/"nginx'/nginx.pid`, `"/tmp/\"nginx'/nginx.pid"`),
+			Entry("with a backslash", `C:\nginx\nginx.pid`, `"C:\\nginx\\nginx.pid"`),
+			Entry("that is empty", "", `""`),
+			Entry("with a variable", "$pid_file", "$pid_file"),
+		)
+	})
+})
@@ -1,32 +1,13 @@
 package parser
 
 import (
-	"bytes"
 	"fmt"
-	"os"
 	"path/filepath"
 	"strings"
-	"text/template"
 )
 
 const FilePerm = 0644
 
-type BaseTemplate struct {
-	Name            string
-	UpstreamAddress string
-	UpstreamPort    string
-	TrustedCA       string
-	Servers         []TemplateServer
-}
-
-type TemplateServer struct {
-	Port    string
-	MTLS    bool
-	Key     string
-	Cert    string
-	Ciphers string
-}
-
 type envoyConfParser interface {
 	ReadUnmarshalEnvoyConfig(envoyConfFile string) (EnvoyConf, error)
 	GetClusters(conf EnvoyConf) ([]Cluster, map[string][]ListenerInfo)
@@ -34,11 +15,13 @@ type envoyConfParser interface {
 
 type SdsCredParser interface {
 	GetCertAndKey() (string, string, error)
-	ConfigType() SdsConfigType
+	Fingerprint() (SdsFingerprint, error)
+	Name() string
 }
 
 type SdsValidationParser interface {
-	GetCACert() (string, error)
+	GetValidationContexts() ([]SdsValidationContext, error)
+	Fingerprint() (SdsFingerprint, error)
 }
 
 type NginxConfig struct {
@@ -47,30 +30,83 @@ type NginxConfig struct {
 	sdsValidationParser SdsValidationParser
 	nginxDir            string
 	confFile            string
-	idCertFile          string
-	idKeyFile           string
-	c2cCertFile         string
-	c2cKeyFile          string
 	trustedCAFile       string
-	pidFile             string
+	sanVerifierFile     string
+	// njs module that closes connections after their max duration.
+	connectionDurationFile  string
+	pidFile                 string
+	workerProcesses         int
+	errorLogLevel           string
+	njsModule               string
+	verifySAN               bool
+	limitConnectionDuration bool
 }
 
 func NewNginxConfig(envoyConfParser envoyConfParser, sdsCredParsers []SdsCredParser, sdsValidationParser SdsValidationParser, nginxDir string) NginxConfig {
 	return NginxConfig{
-		envoyConfParser:     envoyConfParser,
-		sdsCredParsers:      sdsCredParsers,
-		sdsValidationParser: sdsValidationParser,
-		nginxDir:            nginxDir,
-		confFile:            filepath.Join(nginxDir, "conf", "nginx.conf"),
-		idCertFile:          filepath.Join(nginxDir, "id-cert.pem"),
-		idKeyFile:           filepath.Join(nginxDir, "id-key.pem"),
-		trustedCAFile:       filepath.Join(nginxDir, "id-ca.pem"),
-		c2cCertFile:         filepath.Join(nginxDir, "c2c-cert.pem"),
-		c2cKeyFile:          filepath.Join(nginxDir, "c2c-key.pem"),
-		pidFile:             filepath.Join(nginxDir, "nginx.pid"),
+		envoyConfParser:        envoyConfParser,
+		sdsCredParsers:         sdsCredParsers,
+		sdsValidationParser:    sdsValidationParser,
+		nginxDir:               nginxDir,
+		confFile:               filepath.Join(nginxDir, "conf", "nginx.conf"),
+		trustedCAFile:          filepath.Join(nginxDir, reservedValidationContextName+"-ca.pem"),
+		sanVerifierFile:        filepath.Join(nginxDir, "san-verifier.js"),
+		connectionDurationFile: filepath.Join(nginxDir, "connection-duration.js"),
+		pidFile:                filepath.Join(nginxDir, "nginx.pid"),
+		workerProcesses:        1,
 	}
 }
 
+// Number of nginx worker processes.
+func (n *NginxConfig) SetWorkerProcesses(workerProcesses int) {
+	n.workerProcesses = workerProcesses
+}
+
+// Minimum level of messages written to the nginx error log,
+// nginx's default (error) if empty.
+func (n *NginxConfig) SetErrorLogLevel(level string) {
+	n.errorLogLevel = level
+}
+
+// Path of the njs dynamic module, loaded if client certs are verified
+// against subject alt names or connection durations are limited. njs
+// has to be built into nginx if empty.
+func (n *NginxConfig) SetNjsModule(path string) {
+	n.njsModule = path
+}
+
+// Verify client certs of mTLS listeners against the subject alt name
+// matchers of their validation context. Needs njs.
+func (n *NginxConfig) SetVerifySAN(verifySAN bool) {
+	n.verifySAN = verifySAN
+}
+
+// Close connections to listeners with a max_downstream_connection_duration
+// once it is over. Needs njs, so the duration is ignored if not set.
+func (n *NginxConfig) SetLimitConnectionDuration(limitConnectionDuration bool) {
+	n.limitConnectionDuration = limitConnectionDuration
+}
+
+// Reports whether a validation context has subject alt name matchers
+// that are not verified, because SetVerifySAN is not set.
+func (n NginxConfig) IgnoresSANMatchers() (bool, error) {
+	if n.verifySAN {
+		return false, nil
+	}
+
+	contexts, err := n.sdsValidationParser.GetValidationContexts()
+	if err != nil {
+		return false, fmt.Errorf("get validation contexts from sds server validation parser: %s", err)
+	}
+
+	for _, context := range contexts {
+		if len(context.SANMatchers) > 0 {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
 func (n NginxConfig) GetNginxDir() string {
 	return n.nginxDir
 }
@@ -79,11 +115,12 @@ func (n NginxConfig) GetConfFile() string {
 	return n.confFile
 }
 
-// Convert windows paths to unix paths
-func convertToUnixPath(path string) string {
-	path = strings.Replace(path, "C:", "", -1)
-	path = strings.Replace(path, "\\", "/", -1)
-	return path
+// Converts a path to the forward slashes nginx expects in its config
+// on every platform. Drive letters are kept, so that the path still
+// resolves when it is on a different drive than nginx. UNC paths
+// become //server/share/... which nginx on windows understands as well.
+func ConvertToUnixPath(path string) string {
+	return strings.ReplaceAll(path, "\\", "/")
 }
 
 // Generates NGINX config file.
@@ -93,140 +130,354 @@ func (n NginxConfig) Generate(envoyConfFile string) error {
 		return fmt.Errorf("read and unmarshal Envoy config: %s", err)
 	}
 
+	contexts, err := n.sdsValidationParser.GetValidationContexts()
+	if err != nil {
+		return fmt.Errorf("get validation contexts from sds server validation parser: %s", err)
+	}
+
+	return n.generate(envoyConf, contexts)
+}
+
+// Returns the nginx config generated from the envoy config without
+// writing any files, e.g. to print it. The sds validation context is
+// not read either, so client certs are not verified against subject
+// alt names in it.
+func (n NginxConfig) Translate(envoyConfFile string) ([]byte, error) {
+	envoyConf, err := n.envoyConfParser.ReadUnmarshalEnvoyConfig(envoyConfFile)
+	if err != nil {
+		return nil, fmt.Errorf("read and unmarshal Envoy config: %s", err)
+	}
+
+	return n.render(envoyConf, nil)
+}
+
+// Writes nginx.conf generated from the envoy config and the given
+// validation contexts, along with the njs module that closes
+// connections after their max duration if a listener has one.
+func (n NginxConfig) generate(envoyConf EnvoyConf, contexts []SdsValidationContext) error {
+	conf, err := n.model(envoyConf, contexts)
+	if err != nil {
+		return err
+	}
+
+	files := []atomicFile{}
+	if conf.Stream.imports(connectionDurationImport) {
+		files = append(files, atomicFile{path: n.connectionDurationFile, contents: []byte(connectionDurationModule)})
+	}
+	files = append(files, atomicFile{path: n.confFile, contents: conf.Render()})
+
+	err = writeFilesAtomic(files)
+	if err != nil {
+		return fmt.Errorf("%s - write file failed: %s", n.confFile, err)
+	}
+
+	return nil
+}
+
+func (n NginxConfig) render(envoyConf EnvoyConf, contexts []SdsValidationContext) ([]byte, error) {
+	conf, err := n.model(envoyConf, contexts)
+	if err != nil {
+		return nil, err
+	}
+
+	return conf.Render(), nil
+}
+
+// Returns the nginx config generated from the envoy config as a model,
+// e.g. to inspect it.
+func (n NginxConfig) Model(envoyConfFile string) (NginxConf, error) {
+	envoyConf, err := n.envoyConfParser.ReadUnmarshalEnvoyConfig(envoyConfFile)
+	if err != nil {
+		return NginxConf{}, fmt.Errorf("read and unmarshal Envoy config: %s", err)
+	}
+
+	contexts, err := n.sdsValidationParser.GetValidationContexts()
+	if err != nil {
+		return NginxConf{}, fmt.Errorf("get validation contexts from sds server validation parser: %s", err)
+	}
+
+	return n.model(envoyConf, contexts)
+}
+
+// Client certs of mTLS listeners are verified against the ca cert of
+// their validation context and, if it has any, its subject alt name
+// matchers by an njs verifier.
+// If SetLimitConnectionDuration is set, connections to listeners with
+// a max connection duration are closed by an njs filter with their
+// first data once it is over, or after being idle for that long.
+func (n NginxConfig) model(envoyConf EnvoyConf, contexts []SdsValidationContext) (NginxConf, error) {
 	clusters, nameToListeners := n.envoyConfParser.GetClusters(envoyConf)
 
-	const baseTemplate = `
-    upstream {{.Name}} {
-      server {{.UpstreamAddress}}:{{.UpstreamPort}};
-    }
-
-    {{range .Servers}}
-    server {
-        listen {{.Port}} ssl;
-        ssl_certificate        {{.Cert}};
-        ssl_certificate_key    {{.Key}};
-        {{ if .MTLS }}
-        ssl_client_certificate {{$.TrustedCA}};
-        ssl_verify_client on;
-        {{ end }}
-        proxy_pass {{$.Name}};
-
-				ssl_prefer_server_ciphers on;
-				ssl_ciphers {{.Ciphers}};
-    }
-	{{end}}
-	`
-	//create buffer to store template output
-	out := &bytes.Buffer{}
-
-	//Create a new template and parse the conf template into it
-	t := template.Must(template.New("baseTemplate").Parse(baseTemplate))
-
-	unixIdCert := convertToUnixPath(n.idCertFile)
-	unixIdKey := convertToUnixPath(n.idKeyFile)
-	unixC2CCert := convertToUnixPath(n.c2cCertFile)
-	unixC2CKey := convertToUnixPath(n.c2cKeyFile)
-	unixCA := convertToUnixPath(n.trustedCAFile)
-
-	//Execute the template for each socket address
+	conf := NginxConf{
+		WorkerProcesses: n.workerProcesses,
+		ErrorLog:        "logs/error.log",
+		ErrorLogLevel:   n.errorLogLevel,
+		Pid:             ConvertToUnixPath(n.pidFile),
+	}
+
+	verified := map[int]bool{}
+	limited := false
+	limits := []int{}
 	for _, c := range clusters {
-		bts := BaseTemplate{
-			Name:            c.Name,
-			UpstreamAddress: c.LoadAssignment.Endpoints[0].LBEndpoints[0].Endpoint.Address.SocketAddress.Address,
-			UpstreamPort:    c.LoadAssignment.Endpoints[0].LBEndpoints[0].Endpoint.Address.SocketAddress.PortValue,
-			TrustedCA:       unixCA,
-		}
+		conf.Stream.Upstreams = append(conf.Stream.Upstreams, upstream(c))
 
 		for _, listener := range nameToListeners[c.Name] {
-			var cert, key string
-			if listener.SdsConfigType == SdsIdConfigType {
-				cert = unixIdCert
-				key = unixIdKey
-			} else {
-				cert = unixC2CCert
-				key = unixC2CKey
+			certificates, ok := n.sslCertificates(listener)
+			if !ok {
+				continue
 			}
-			bts.Servers = append(bts.Servers, TemplateServer{
-				Port:    listener.Port,
-				MTLS:    listener.MTLS,
-				Cert:    cert,
-				Key:     key,
-				Ciphers: listener.Ciphers,
-			})
+
+			server := NginxServer{
+				Listen:                 listener.Port,
+				ProxyPass:              c.Name,
+				SSLCertificates:        certificates,
+				SSLPreferServerCiphers: true,
+				SSLProtocols:           listener.Protocols,
+				SSLCiphers:             listener.Ciphers,
+				SSLCiphersuites:        listener.TLS13Ciphersuites,
+				SSLECDHCurve:           listener.ECDHCurves,
+				ProxyConnectTimeout:    c.ConnectTimeout.Duration,
+				ProxyTimeout:           listener.IdleTimeout,
+				SSLHandshakeTimeout:    listener.HandshakeTimeout,
+			}
+			if n.limitConnectionDuration && listener.MaxConnectionDuration > 0 {
+				server.JSFilter = connectionDurationImport + ".limit"
+				server.MaxConnectionDuration = listener.MaxConnectionDuration
+				// A connection idle for that long is past its max
+				// duration anyway.
+				if server.ProxyTimeout == 0 || server.ProxyTimeout > listener.MaxConnectionDuration {
+					server.ProxyTimeout = listener.MaxConnectionDuration
+				}
+				limited = true
+			}
+			if listener.MTLS {
+				i, err := validationContextIndex(contexts, listener.ValidationContext)
+				if err != nil {
+					return NginxConf{}, fmt.Errorf("listener on port %s: %s", listener.Port, err)
+				}
+				files := n.validationFiles(i, contexts)
+				server.SSLClientCertificate = ConvertToUnixPath(files.caFile)
+				if n.verifySAN && i < len(contexts) && len(contexts[i].SANMatchers) > 0 {
+					server.JSPreread = files.jsImport + ".verify"
+					verified[i] = true
+				}
+			}
+			conf.Stream.Servers = append(conf.Stream.Servers, server)
+			limits = append(limits, maxConnections(c))
 		}
+	}
+	conf.Events.WorkerConnections = workerConnections(limits)
 
-		err = t.Execute(out, bts)
-		if err != nil {
-			return fmt.Errorf("executing envoy-nginx config template: %s", err)
+	for i := range contexts {
+		if !verified[i] {
+			continue
 		}
+		files := n.validationFiles(i, contexts)
+		conf.Stream.JSImports = append(conf.Stream.JSImports, NginxJSImport{Name: files.jsImport, Path: ConvertToUnixPath(files.sanVerifierFile)})
+	}
+	if limited {
+		conf.Stream.JSImports = append(conf.Stream.JSImports, NginxJSImport{Name: connectionDurationImport, Path: ConvertToUnixPath(n.connectionDurationFile)})
+	}
+	if len(conf.Stream.JSImports) > 0 && n.njsModule != "" {
+		conf.LoadModules = []string{ConvertToUnixPath(n.njsModule)}
 	}
 
-	confTemplate := fmt.Sprintf(`
-worker_processes  1;
-daemon on;
+	return conf, nil
+}
 
-error_log logs/error.log;
-pid %s;
+/*
+* Returns the cert and key files of every tls certificate secret of
+* the listener. Listeners with a secret there is no sds cred parser
+* for are left out, like envoy does not start a listener whose secrets
+* it cannot fetch.
+ */
+func (n NginxConfig) sslCertificates(listener ListenerInfo) ([]NginxSSLCertificate, bool) {
+	certificates := []NginxSSLCertificate{}
+	for _, secret := range listener.CertificateSecrets {
+		if !n.hasSdsCredParser(secret.Name) {
+			return nil, false
+		}
 
-events {
-    worker_connections  1024;
+		certFile, keyFile := n.certificateFiles(secret.Name)
+		certificates = append(certificates, NginxSSLCertificate{
+			Certificate: ConvertToUnixPath(certFile),
+			Key:         ConvertToUnixPath(keyFile),
+		})
+	}
+	return certificates, true
 }
 
-stream {
-	%s
+func (n NginxConfig) hasSdsCredParser(name string) bool {
+	for _, sdsCredParser := range n.sdsCredParsers {
+		if sdsCredParser.Name() == name {
+			return true
+		}
+	}
+	return false
 }
-`, convertToUnixPath(n.pidFile),
-		out)
 
-	err = os.WriteFile(n.confFile, []byte(confTemplate), FilePerm)
+// Files the cert and key of a tls certificate secret are written to,
+// named after the secret without its -cert-and-key suffix, e.g.
+// id-cert.pem and id-key.pem for id-cert-and-key.
+func (n NginxConfig) certificateFiles(name string) (string, string) {
+	prefix := certificateFilePrefix(name)
+	return filepath.Join(n.nginxDir, prefix+"-cert.pem"), filepath.Join(n.nginxDir, prefix+"-key.pem")
+}
+
+// Secrets whose names differ only in the suffix, e.g. id and
+// id-cert-and-key, share it, which ValidateEnvoyConfig rejects.
+func certificateFilePrefix(name string) string {
+	return strings.TrimSuffix(name, "-cert-and-key")
+}
+
+// Every endpoint of every locality is a server of the upstream.
+// Endpoints of a lower priority than 0 are only used when none
+// of priority 0 are available. The max_connections of the cluster
+// apply to each server.
+func upstream(c Cluster) NginxUpstream {
+	u := NginxUpstream{
+		Name:   c.Name,
+		Method: lbPolicies[c.LbPolicy],
+	}
+
+	limit := maxConnections(c)
+	if limit > 0 {
+		// Otherwise each worker would allow max_conns on its own.
+		u.ZoneSize = upstreamZoneSize
+	}
+
+	for _, endpoints := range c.LoadAssignment.Endpoints {
+		for _, lbEndpoint := range endpoints.LBEndpoints {
+			socketAddress := lbEndpoint.Endpoint.Address.SocketAddress
+			u.Servers = append(u.Servers, NginxUpstreamServer{
+				Address:  socketAddress.Address,
+				Port:     socketAddress.PortValue,
+				Weight:   lbEndpoint.LoadBalancingWeight,
+				MaxConns: limit,
+				Backup:   endpoints.Priority > 0,
+			})
+		}
+	}
+
+	return u
+}
+
+// Returns the fingerprint of every sds file, cred files first and
+// the validation context last.
+func (n NginxConfig) SdsFingerprints() ([]SdsFingerprint, error) {
+	fingerprints := []SdsFingerprint{}
+	for _, sdsCredParser := range n.sdsCredParsers {
+		fingerprint, err := sdsCredParser.Fingerprint()
+		if err != nil {
+			return nil, fmt.Errorf("fingerprint sds creds: %s", err)
+		}
+		fingerprints = append(fingerprints, fingerprint)
+	}
+
+	fingerprint, err := n.sdsValidationParser.Fingerprint()
 	if err != nil {
-		return fmt.Errorf("%s - write file failed: %s", n.confFile, err)
+		return nil, fmt.Errorf("fingerprint sds validation context: %s", err)
 	}
 
-	return nil
+	return append(fingerprints, fingerprint), nil
 }
 
+// Writes cert, key, and the ca cert and san verifier of every
+// validation context to the nginx config directory.
+// All of them are swapped in together, so nginx never sees a cert
+// next to a key it does not match.
 func (n NginxConfig) WriteTLSFiles() error {
+	contexts, err := n.sdsValidationParser.GetValidationContexts()
+	if err != nil {
+		return fmt.Errorf("get validation contexts from sds server validation parser: %s", err)
+	}
+
+	return n.writeTLSFiles(contexts)
+}
+
+func (n NginxConfig) writeTLSFiles(contexts []SdsValidationContext) error {
+	files := []atomicFile{}
+
 	for _, sdsCredParser := range n.sdsCredParsers {
 		cert, key, err := sdsCredParser.GetCertAndKey()
 		if err != nil {
 			return fmt.Errorf("get cert and key from sds cred parser: %s", err)
 		}
 
-		var certFile, keyFile string
-		if sdsCredParser.ConfigType() == SdsIdConfigType {
-			certFile = n.idCertFile
-			keyFile = n.idKeyFile
-		} else {
-			certFile = n.c2cCertFile
-			keyFile = n.c2cKeyFile
-		}
+		certFile, keyFile := n.certificateFiles(sdsCredParser.Name())
+		files = append(files,
+			atomicFile{path: certFile, contents: []byte(cert)},
+			atomicFile{path: keyFile, contents: []byte(key)},
+		)
+	}
 
-		err = os.WriteFile(certFile, []byte(cert), FilePerm)
-		if err != nil {
-			return fmt.Errorf("write cert: %s", err)
+	for i, context := range contexts {
+		validationFiles := n.validationFiles(i, contexts)
+
+		// If there is no CA Cert, do not write the ca.pem.
+		if len(context.CA) > 0 {
+			files = append(files, atomicFile{path: validationFiles.caFile, contents: []byte(context.CA)})
 		}
 
-		err = os.WriteFile(keyFile, []byte(key), FilePerm)
-		if err != nil {
-			return fmt.Errorf("write key: %s", err)
+		// Without matchers or SetVerifySAN nginx.conf does not
+		// import the verifier.
+		if n.verifySAN && len(context.SANMatchers) > 0 {
+			verifier, err := sanVerifier(context.SANMatchers)
+			if err != nil {
+				return err
+			}
+			files = append(files, atomicFile{path: validationFiles.sanVerifierFile, contents: verifier})
 		}
 	}
 
-	caCert, err := n.sdsValidationParser.GetCACert()
+	err := writeFilesAtomic(files)
 	if err != nil {
-		return fmt.Errorf("get ca cert from sds server validation parser: %s", err)
+		return fmt.Errorf("swap tls files: %s", err)
 	}
 
-	// If there is no CA Cert, do not write the ca.pem.
-	if len(caCert) == 0 {
-		return nil
+	return nil
+}
+
+// Files a validation context is written to and the name its san
+// verifier is imported as.
+type validationFiles struct {
+	caFile          string
+	sanVerifierFile string
+	jsImport        string
+}
+
+/*
+* Returns the index of the validation context with the given name. If
+* there is only one, every listener is verified against it whatever
+* its name, which is how every listener was verified before validation
+* contexts had names, e.g. diego names it server-validation-context in
+* the sds file but id-validation-context in the envoy config. Among
+* several, falling back to another one would trust the wrong ca.
+ */
+func validationContextIndex(contexts []SdsValidationContext, name string) (int, error) {
+	if len(contexts) <= 1 {
+		return 0, nil
 	}
 
-	err = os.WriteFile(n.trustedCAFile, []byte(caCert), FilePerm)
-	if err != nil {
-		return fmt.Errorf("write ca cert file: %s", err)
+	for i, context := range contexts {
+		if context.Name == name {
+			return i, nil
+		}
 	}
+	return 0, fmt.Errorf("validation context %q not found in sds server validation context file", name)
+}
 
-	return nil
+// The first validation context keeps the id-ca.pem it has always
+// been written to, the others get files named after them.
+func (n NginxConfig) validationFiles(i int, contexts []SdsValidationContext) validationFiles {
+	if i == 0 {
+		return validationFiles{caFile: n.trustedCAFile, sanVerifierFile: n.sanVerifierFile, jsImport: "san"}
+	}
+
+	name := contexts[i].Name
+	return validationFiles{
+		caFile:          filepath.Join(n.nginxDir, name+"-ca.pem"),
+		sanVerifierFile: filepath.Join(n.nginxDir, name+"-san-verifier.js"),
+		jsImport:        fmt.Sprintf("san%d", i),
+	}
 }
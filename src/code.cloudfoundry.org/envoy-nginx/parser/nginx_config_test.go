@@ -4,9 +4,7 @@ import (
 	"errors"
 	"os"
 	"path/filepath"
-	"regexp"
-	"strconv"
-	"strings"
+	"time"
 
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
@@ -18,7 +16,6 @@ import (
 var _ = Describe("Nginx Config", func() {
 	var (
 		tmpdir string
-		config []byte
 
 		envoyConfParser     *fakes.EnvoyConfParser
 		nginxConfig         parser.NginxConfig
@@ -29,7 +26,9 @@ var _ = Describe("Nginx Config", func() {
 
 	BeforeEach(func() {
 		sdsIdCredParser = &fakes.SdsCredParser{}
+		sdsIdCredParser.NameCall.Returns.Name = "id-cert-and-key"
 		sdsC2CCredParser = &fakes.SdsCredParser{}
+		sdsC2CCredParser.NameCall.Returns.Name = "c2c-cert-and-key"
 		sdsValidationParser = &fakes.SdsIdValidationParser{}
 		envoyConfParser = &fakes.EnvoyConfParser{}
 
@@ -46,15 +45,53 @@ var _ = Describe("Nginx Config", func() {
 		Expect(os.RemoveAll(tmpdir)).NotTo(HaveOccurred())
 	})
 
+	Describe("SdsFingerprints", func() {
+		BeforeEach(func() {
+			sdsIdCredParser.FingerprintCall.Returns.Fingerprint = parser.SdsFingerprint{VersionInfo: "1", Hash: "id"}
+			sdsC2CCredParser.FingerprintCall.Returns.Fingerprint = parser.SdsFingerprint{VersionInfo: "2", Hash: "c2c"}
+			sdsValidationParser.FingerprintCall.Returns.Fingerprint = parser.SdsFingerprint{VersionInfo: "3", Hash: "ca"}
+		})
+
+		It("returns the fingerprints of the cred files followed by the validation context", func() {
+			fingerprints, err := nginxConfig.SdsFingerprints()
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(fingerprints).To(Equal([]parser.SdsFingerprint{
+				{VersionInfo: "1", Hash: "id"},
+				{VersionInfo: "2", Hash: "c2c"},
+				{VersionInfo: "3", Hash: "ca"},
+			}))
+		})
+
+		Context("when a cred file cannot be fingerprinted", func() {
+			BeforeEach(func() {
+				sdsC2CCredParser.FingerprintCall.Returns.Error = errors.New("banana")
+			})
+
+			It("returns a helpful error message", func() {
+				_, err := nginxConfig.SdsFingerprints()
+				Expect(err).To(MatchError("fingerprint sds creds: banana"))
+			})
+		})
+
+		Context("when the validation context cannot be fingerprinted", func() {
+			BeforeEach(func() {
+				sdsValidationParser.FingerprintCall.Returns.Error = errors.New("banana")
+			})
+
+			It("returns a helpful error message", func() {
+				_, err := nginxConfig.SdsFingerprints()
+				Expect(err).To(MatchError("fingerprint sds validation context: banana"))
+			})
+		})
+	})
+
 	Describe("WriteTLSFiles", func() {
 		BeforeEach(func() {
 			sdsIdCredParser.GetCertAndKeyCall.Returns.Cert = "some-id-cert"
 			sdsIdCredParser.GetCertAndKeyCall.Returns.Key = "some-id-key"
-			sdsIdCredParser.ConfigTypeCall.Returns.ConfigType = parser.SdsIdConfigType
 			sdsC2CCredParser.GetCertAndKeyCall.Returns.Cert = "some-c2c-cert"
 			sdsC2CCredParser.GetCertAndKeyCall.Returns.Key = "some-c2c-key"
-			sdsC2CCredParser.ConfigTypeCall.Returns.ConfigType = parser.SdsC2CConfigType
-			sdsValidationParser.GetCACertCall.Returns.CA = "some-ca-cert"
+			sdsValidationParser.GetValidationContextsCall.Returns.ValidationContexts = []parser.SdsValidationContext{{Name: "id-validation-context", CA: "some-ca-cert"}}
 		})
 
 		It("should have written cert, key, and ca", func() {
@@ -89,6 +126,43 @@ var _ = Describe("Nginx Config", func() {
 			Expect(string(ca)).To(Equal("some-ca-cert"))
 		})
 
+		It("does not leave temp files behind", func() {
+			err := nginxConfig.WriteTLSFiles()
+			Expect(err).ShouldNot(HaveOccurred())
+
+			files, err := os.ReadDir(tmpdir)
+			Expect(err).ShouldNot(HaveOccurred())
+
+			names := []string{}
+			for _, file := range files {
+				names = append(names, file.Name())
+			}
+			Expect(names).To(ConsistOf("conf", "id-cert.pem", "id-key.pem", "c2c-cert.pem", "c2c-key.pem", "id-ca.pem"))
+		})
+
+		Context("when one of the tls files cannot be swapped in", func() {
+			BeforeEach(func() {
+				err := nginxConfig.WriteTLSFiles()
+				Expect(err).ShouldNot(HaveOccurred())
+
+				sdsIdCredParser.GetCertAndKeyCall.Returns.Cert = "some-new-id-cert"
+				sdsIdCredParser.GetCertAndKeyCall.Returns.Key = "some-new-id-key"
+
+				keyPath := filepath.Join(tmpdir, "id-key.pem")
+				Expect(os.Remove(keyPath)).To(Succeed())
+				Expect(os.MkdirAll(filepath.Join(keyPath, "not-empty"), os.ModePerm)).To(Succeed())
+			})
+
+			It("keeps the previous cert so it still matches the key", func() {
+				err := nginxConfig.WriteTLSFiles()
+				Expect(err).To(MatchError(ContainSubstring("swap tls files: ")))
+
+				cert, err := os.ReadFile(filepath.Join(tmpdir, "id-cert.pem"))
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(string(cert)).To(Equal("some-id-cert"))
+			})
+		})
+
 		Context("when c2c sds cred parser is not provided", func() {
 			BeforeEach(func() {
 				nginxConfig = parser.NewNginxConfig(envoyConfParser, []parser.SdsCredParser{sdsIdCredParser}, sdsValidationParser, tmpdir)
@@ -147,20 +221,20 @@ var _ = Describe("Nginx Config", func() {
 			})
 		})
 
-		Context("when sds validation context parser fails to get ca", func() {
+		Context("when sds validation context parser fails to get validation contexts", func() {
 			BeforeEach(func() {
-				sdsValidationParser.GetCACertCall.Returns.Error = errors.New("banana")
+				sdsValidationParser.GetValidationContextsCall.Returns.Error = errors.New("banana")
 			})
 
 			It("returns a helpful error message", func() {
 				err := nginxConfig.WriteTLSFiles()
-				Expect(err).To(MatchError("get ca cert from sds server validation parser: banana"))
+				Expect(err).To(MatchError("get validation contexts from sds server validation parser: banana"))
 			})
 		})
 
 		Context("when sds validation context parser returns an empty ca", func() {
 			BeforeEach(func() {
-				sdsValidationParser.GetCACertCall.Returns.CA = ""
+				sdsValidationParser.GetValidationContextsCall.Returns.ValidationContexts[0].CA = ""
 			})
 
 			It("does not create a ca.pem", func() {
@@ -172,6 +246,84 @@ var _ = Describe("Nginx Config", func() {
 				Expect(err).To(HaveOccurred())
 			})
 		})
+
+		Context("when the validation context has san matchers", func() {
+			BeforeEach(func() {
+				sdsValidationParser.GetValidationContextsCall.Returns.ValidationContexts[0].SANMatchers = []parser.SANMatcher{
+					{Kind: "exact", Value: "gorouter.service.cf.internal"},
+					{Type: "URI", Kind: "prefix", Value: "spiffe://cf/"},
+				}
+				nginxConfig.SetVerifySAN(true)
+			})
+
+			It("writes the njs verifier with the matchers", func() {
+				err := nginxConfig.WriteTLSFiles()
+				Expect(err).ShouldNot(HaveOccurred())
+
+				verifier, err := os.ReadFile(filepath.Join(tmpdir, "san-verifier.js"))
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(string(verifier)).To(ContainSubstring(`var matchers = [{"kind":"exact","value":"gorouter.service.cf.internal"},{"type":"URI","kind":"prefix","value":"spiffe://cf/"}];`))
+				Expect(string(verifier)).To(ContainSubstring("export default {verify};"))
+			})
+
+			Context("when san verification is off", func() {
+				BeforeEach(func() {
+					nginxConfig.SetVerifySAN(false)
+				})
+
+				It("does not write the njs verifier", func() {
+					err := nginxConfig.WriteTLSFiles()
+					Expect(err).ShouldNot(HaveOccurred())
+
+					_, err = os.Stat(filepath.Join(tmpdir, "san-verifier.js"))
+					Expect(err).To(HaveOccurred())
+				})
+			})
+		})
+
+		Context("when the validation context has no san matchers", func() {
+			It("does not write the njs verifier", func() {
+				err := nginxConfig.WriteTLSFiles()
+				Expect(err).ShouldNot(HaveOccurred())
+
+				_, err = os.Stat(filepath.Join(tmpdir, "san-verifier.js"))
+				Expect(err).To(HaveOccurred())
+			})
+		})
+
+		Context("when the sds file has several validation contexts", func() {
+			BeforeEach(func() {
+				sdsValidationParser.GetValidationContextsCall.Returns.ValidationContexts = []parser.SdsValidationContext{
+					{Name: "id-validation-context", CA: "some-ca-cert"},
+					{
+						Name:        "c2c-validation-context",
+						CA:          "some-c2c-ca-cert",
+						SANMatchers: []parser.SANMatcher{{Type: "URI", Kind: "prefix", Value: "spiffe://cf/"}},
+					},
+				}
+				nginxConfig.SetVerifySAN(true)
+			})
+
+			It("writes the first one to id-ca.pem and the others to files named after them", func() {
+				err := nginxConfig.WriteTLSFiles()
+				Expect(err).ShouldNot(HaveOccurred())
+
+				ca, err := os.ReadFile(filepath.Join(tmpdir, "id-ca.pem"))
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(string(ca)).To(Equal("some-ca-cert"))
+
+				ca, err = os.ReadFile(filepath.Join(tmpdir, "c2c-validation-context-ca.pem"))
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(string(ca)).To(Equal("some-c2c-ca-cert"))
+
+				verifier, err := os.ReadFile(filepath.Join(tmpdir, "c2c-validation-context-san-verifier.js"))
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(string(verifier)).To(ContainSubstring(`var matchers = [{"type":"URI","kind":"prefix","value":"spiffe://cf/"}];`))
+
+				_, err = os.Stat(filepath.Join(tmpdir, "san-verifier.js"))
+				Expect(err).To(HaveOccurred())
+			})
+		})
 	})
 
 	Describe("Generate", func() {
@@ -180,204 +332,634 @@ var _ = Describe("Nginx Config", func() {
 			envoyConfParser.GetClustersCall.Returns.Clusters = testClusters()
 			envoyConfParser.GetClustersCall.Returns.NameToListeners = map[string][]parser.ListenerInfo{
 				"service-cluster-8080": {
-					{Port: "61001", MTLS: true, Ciphers: "ECDHE-RSA-AES256-GCM-SHA384:ECDHE-RSA-AES128-GCM-SHA256", SdsConfigType: parser.SdsIdConfigType},
+					{Port: "61001", MTLS: true, Ciphers: "ECDHE-RSA-AES256-GCM-SHA384:ECDHE-RSA-AES128-GCM-SHA256", CertificateSecrets: idSecrets},
 				},
 				"service-cluster-2222": {
-					{Port: "61002", MTLS: true, Ciphers: "banana_ciphers", SdsConfigType: parser.SdsIdConfigType},
+					{Port: "61002", MTLS: true, Ciphers: "banana_ciphers", CertificateSecrets: idSecrets},
 				},
 				"service-cluster-1234": {
-					{Port: "61003", MTLS: true, Ciphers: "", SdsConfigType: parser.SdsIdConfigType},
-					{Port: "61004", MTLS: false, Ciphers: "", SdsConfigType: parser.SdsC2CConfigType},
+					{Port: "61003", MTLS: true, Ciphers: "", CertificateSecrets: idSecrets},
+					{Port: "61004", MTLS: false, Ciphers: "", CertificateSecrets: c2cSecrets},
 				},
 			}
 		})
 
-		Context("when envoyConf and sdsCreds files are configured correctly", func() {
-			It("should generate a valid nginx.conf", func() {
-				var err error
-				err = nginxConfig.Generate(EnvoyConfigFixture)
-				Expect(err).ShouldNot(HaveOccurred())
+		It("writes the rendered model to nginx.conf", func() {
+			err := nginxConfig.Generate(EnvoyConfigFixture)
+			Expect(err).ShouldNot(HaveOccurred())
+
+			model, err := nginxConfig.Model(EnvoyConfigFixture)
+			Expect(err).ShouldNot(HaveOccurred())
+
+			config, err := os.ReadFile(nginxConfig.GetConfFile())
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(config).To(Equal(model.Render()))
+			Expect(filepath.Join(tmpdir, "connection-duration.js")).NotTo(BeAnExistingFile())
+		})
 
-				config, err = os.ReadFile(nginxConfig.GetConfFile())
+		Context("when a listener has a max connection duration", func() {
+			BeforeEach(func() {
+				envoyConfParser.GetClustersCall.Returns.NameToListeners["service-cluster-8080"][0].MaxConnectionDuration = time.Minute
+				nginxConfig.SetLimitConnectionDuration(true)
+			})
+
+			It("writes the njs module that enforces it", func() {
+				err := nginxConfig.Generate(EnvoyConfigFixture)
 				Expect(err).ShouldNot(HaveOccurred())
 
-				By("having a valid pid directive", func() {
-					// e.g. pid /Temp/nginx_024.pid;
-					re := regexp.MustCompile(`[\r\n]pid\s*[\w/.]+;`)
-					match := re.Find(config)
-					Expect(match).NotTo(BeNil())
-				})
+				module, err := os.ReadFile(filepath.Join(tmpdir, "connection-duration.js"))
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(string(module)).To(ContainSubstring("export default {limit};"))
+			})
+		})
 
-				By("having an upstream server with addr 172.30.2.245:8080", func() {
-					re := regexp.MustCompile(`[\r\n]\s*server\s*172.30.2.245:8080;`)
-					match := re.Find(config)
-					Expect(match).NotTo(BeNil())
-				})
+		Context("when ReadUnmarshalEnvoyConfig fails", func() {
+			BeforeEach(func() {
+				envoyConfParser.ReadUnmarshalEnvoyConfigCall.Returns.Error = errors.New("banana")
+			})
+			It("should return a custom error", func() {
+				err := nginxConfig.Generate(EnvoyConfigFixture)
+				Expect(err).To(MatchError("read and unmarshal Envoy config: banana"))
+			})
+		})
 
-				By("having an upstream server with addr 172.30.2.245:2222", func() {
-					re := regexp.MustCompile(`[\r\n]\s*server\s*172.30.2.245:2222;`)
-					match := re.Find(config)
-					Expect(match).NotTo(BeNil())
-				})
+		Context("when ioutil fails to write the nginx.conf", func() {
+			BeforeEach(func() {
+				nginxConfig = parser.NewNginxConfig(envoyConfParser, []parser.SdsCredParser{sdsIdCredParser, sdsC2CCredParser}, sdsValidationParser, "not-a-real-dir")
+			})
+			// We do not test that os.WriteFile fails for cert/key because
+			// our trick to cause that function to fail only works once!
+			// The trick is to pass a directory that isn't real.
+			It("returns a helpful error message", func() {
+				err := nginxConfig.Generate(EnvoyConfigFixture)
+				Expect(err.Error()).To(ContainSubstring("nginx.conf - write file failed:"))
+			})
+		})
+	})
 
-				By("having an upstream server with addr 172.30.2.245:1234", func() {
-					re := regexp.MustCompile(`[\r\n]\s*server\s*172.30.2.245:1234;`)
-					match := re.Find(config)
-					Expect(match).NotTo(BeNil())
-				})
+	Describe("Model", func() {
+		BeforeEach(func() {
+			envoyConfParser.GetClustersCall.Returns.Clusters = testClusters()
+			envoyConfParser.GetClustersCall.Returns.NameToListeners = map[string][]parser.ListenerInfo{
+				"service-cluster-8080": {
+					{Port: "61001", MTLS: true, Ciphers: "ECDHE-RSA-AES256-GCM-SHA384:ECDHE-RSA-AES128-GCM-SHA256", CertificateSecrets: idSecrets},
+				},
+				"service-cluster-2222": {
+					{Port: "61002", MTLS: true, Ciphers: "banana_ciphers", CertificateSecrets: idSecrets},
+				},
+				"service-cluster-1234": {
+					{Port: "61003", MTLS: true, Ciphers: "", CertificateSecrets: idSecrets},
+					{Port: "61004", MTLS: false, Ciphers: "", CertificateSecrets: c2cSecrets},
+				},
+			}
+		})
 
-				clusterToListeners := parseNginxConfig(config)
+		It("models the nginx config generated from the envoy config", func() {
+			model, err := nginxConfig.Model(EnvoyConfigFixture)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(envoyConfParser.ReadUnmarshalEnvoyConfigCall.Receives.EnvoyConfFile).To(Equal(EnvoyConfigFixture))
 
-				expectedClientCertPath := convertToUnixPath(filepath.Join(tmpdir, "id-ca.pem"))
+			idCert := parser.ConvertToUnixPath(filepath.Join(tmpdir, "id-cert.pem"))
+			idKey := parser.ConvertToUnixPath(filepath.Join(tmpdir, "id-key.pem"))
+			c2cCert := parser.ConvertToUnixPath(filepath.Join(tmpdir, "c2c-cert.pem"))
+			c2cKey := parser.ConvertToUnixPath(filepath.Join(tmpdir, "c2c-key.pem"))
+			ca := parser.ConvertToUnixPath(filepath.Join(tmpdir, "id-ca.pem"))
 
-				By("having valid listeners for server 8080", func() {
-					Expect(clusterToListeners["service-cluster-8080"]).To(Equal([]listenerInfo{
+			Expect(model).To(Equal(parser.NginxConf{
+				WorkerProcesses: 1,
+				ErrorLog:        "logs/error.log",
+				Pid:             parser.ConvertToUnixPath(filepath.Join(tmpdir, "nginx.pid")),
+				// Four listeners, without circuit breakers.
+				Events: parser.NginxEvents{WorkerConnections: 4 * 2 * 1024},
+				Stream: parser.NginxStream{
+					Upstreams: []parser.NginxUpstream{
+						{Name: "service-cluster-8080", Servers: []parser.NginxUpstreamServer{{Address: "172.30.2.245", Port: "8080"}}},
+						{Name: "service-cluster-2222", Servers: []parser.NginxUpstreamServer{{Address: "172.30.2.245", Port: "2222"}}},
+						{Name: "service-cluster-1234", Servers: []parser.NginxUpstreamServer{{Address: "172.30.2.245", Port: "1234"}}},
+					},
+					Servers: []parser.NginxServer{
 						{
-							Port:           61001,
-							ClientVerify:   true,
-							ClientCertPath: expectedClientCertPath,
-							Ciphers:        "ECDHE-RSA-AES256-GCM-SHA384:ECDHE-RSA-AES128-GCM-SHA256",
-							Cert:           convertToUnixPath(filepath.Join(tmpdir, "id-cert.pem")),
-							Key:            convertToUnixPath(filepath.Join(tmpdir, "id-key.pem")),
+							Listen:                 "61001",
+							ProxyPass:              "service-cluster-8080",
+							SSLCertificates:        []parser.NginxSSLCertificate{{Certificate: idCert, Key: idKey}},
+							SSLClientCertificate:   ca,
+							SSLPreferServerCiphers: true,
+							SSLCiphers:             "ECDHE-RSA-AES256-GCM-SHA384:ECDHE-RSA-AES128-GCM-SHA256",
 						},
-					}))
-				})
-				By("having valid listeners for server 2222", func() {
-					Expect(clusterToListeners["service-cluster-2222"]).To(Equal([]listenerInfo{
 						{
-							Port:           61002,
-							ClientVerify:   true,
-							ClientCertPath: expectedClientCertPath,
-							Ciphers:        "banana_ciphers",
-							Cert:           convertToUnixPath(filepath.Join(tmpdir, "id-cert.pem")),
-							Key:            convertToUnixPath(filepath.Join(tmpdir, "id-key.pem")),
+							Listen:                 "61002",
+							ProxyPass:              "service-cluster-2222",
+							SSLCertificates:        []parser.NginxSSLCertificate{{Certificate: idCert, Key: idKey}},
+							SSLClientCertificate:   ca,
+							SSLPreferServerCiphers: true,
+							SSLCiphers:             "banana_ciphers",
 						},
-					}))
-				})
-				By("having valid listeners for server 1234", func() {
-					Expect(clusterToListeners["service-cluster-1234"]).To(Equal([]listenerInfo{
 						{
-							Port:           61003,
-							ClientVerify:   true,
-							ClientCertPath: expectedClientCertPath,
-							Cert:           convertToUnixPath(filepath.Join(tmpdir, "id-cert.pem")),
-							Key:            convertToUnixPath(filepath.Join(tmpdir, "id-key.pem")),
+							Listen:                 "61003",
+							ProxyPass:              "service-cluster-1234",
+							SSLCertificates:        []parser.NginxSSLCertificate{{Certificate: idCert, Key: idKey}},
+							SSLClientCertificate:   ca,
+							SSLPreferServerCiphers: true,
 						},
 						{
-							Port:         61004,
-							ClientVerify: false,
-							Cert:         convertToUnixPath(filepath.Join(tmpdir, "c2c-cert.pem")),
-							Key:          convertToUnixPath(filepath.Join(tmpdir, "c2c-key.pem")),
+							Listen:                 "61004",
+							ProxyPass:              "service-cluster-1234",
+							SSLCertificates:        []parser.NginxSSLCertificate{{Certificate: c2cCert, Key: c2cKey}},
+							SSLPreferServerCiphers: true,
 						},
-					}))
+					},
+				},
+			}))
+		})
+
+		Context("when a cluster has several localities and an lb_policy", func() {
+			endpoint := func(address string, weight int) parser.LBEndpoints {
+				return parser.LBEndpoints{
+					Endpoint:            parser.Endpoint{Address: parser.Address{SocketAddress: parser.SocketAddress{Address: address, PortValue: "8080"}}},
+					LoadBalancingWeight: weight,
+				}
+			}
+
+			BeforeEach(func() {
+				envoyConfParser.GetClustersCall.Returns.Clusters = []parser.Cluster{{
+					Name:     "service-cluster-8080",
+					LbPolicy: "LEAST_REQUEST",
+					LoadAssignment: parser.LoadAssignment{Endpoints: []parser.Endpoints{
+						{LBEndpoints: []parser.LBEndpoints{endpoint("10.0.0.1", 3), endpoint("10.0.0.2", 0)}},
+						{LBEndpoints: []parser.LBEndpoints{endpoint("10.0.1.1", 1)}},
+						{Priority: 1, LBEndpoints: []parser.LBEndpoints{endpoint("10.0.2.1", 0)}},
+					}},
+				}}
+			})
+
+			It("balances across every endpoint", func() {
+				model, err := nginxConfig.Model(EnvoyConfigFixture)
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(model.Stream.Upstreams).To(Equal([]parser.NginxUpstream{{
+					Name:   "service-cluster-8080",
+					Method: []string{"least_conn"},
+					Servers: []parser.NginxUpstreamServer{
+						{Address: "10.0.0.1", Port: "8080", Weight: 3},
+						{Address: "10.0.0.2", Port: "8080"},
+						{Address: "10.0.1.1", Port: "8080", Weight: 1},
+						{Address: "10.0.2.1", Port: "8080", Backup: true},
+					},
+				}}))
+			})
+
+			DescribeTable("maps the lb_policy to the nginx balancing method",
+				func(lbPolicy string, method []string) {
+					envoyConfParser.GetClustersCall.Returns.Clusters[0].LbPolicy = lbPolicy
+					model, err := nginxConfig.Model(EnvoyConfigFixture)
+					Expect(err).ShouldNot(HaveOccurred())
+					Expect(model.Stream.Upstreams[0].Method).To(Equal(method))
+				},
+				Entry(nil, "", nil),
+				Entry(nil, "ROUND_ROBIN", nil),
+				Entry(nil, "LEAST_REQUEST", []string{"least_conn"}),
+				Entry(nil, "RING_HASH", []string{"hash", "$remote_addr", "consistent"}),
+				Entry(nil, "MAGLEV", []string{"hash", "$remote_addr", "consistent"}),
+				Entry(nil, "RANDOM", []string{"random"}),
+			)
+		})
+
+		Context("when clusters have circuit breakers", func() {
+			BeforeEach(func() {
+				envoyConfParser.GetClustersCall.Returns.Clusters[0].CircuitBreakers = parser.CircuitBreakers{Thresholds: []parser.Thresholds{
+					{MaxConnections: 3000},
+					{Priority: "HIGH", MaxConnections: 10},
+				}}
+				envoyConfParser.GetClustersCall.Returns.Clusters[1].CircuitBreakers = parser.CircuitBreakers{Thresholds: []parser.Thresholds{
+					{Priority: "DEFAULT", MaxConnections: 500},
+				}}
+				envoyConfParser.GetClustersCall.Returns.Clusters[2].CircuitBreakers = parser.CircuitBreakers{Thresholds: []parser.Thresholds{
+					{MaxConnections: 4294967295},
+				}}
+			})
+
+			It("limits the connections to each server and sizes worker_connections from the limits", func() {
+				model, err := nginxConfig.Model(EnvoyConfigFixture)
+				Expect(err).ShouldNot(HaveOccurred())
+
+				Expect(model.Stream.Upstreams[0].ZoneSize).To(Equal("64k"))
+				Expect(model.Stream.Upstreams[0].Servers[0].MaxConns).To(Equal(3000))
+				Expect(model.Stream.Upstreams[1].Servers[0].MaxConns).To(Equal(500))
+
+				By("leaving turned off circuit breakers unlimited", func() {
+					Expect(model.Stream.Upstreams[2].ZoneSize).To(BeEmpty())
+					Expect(model.Stream.Upstreams[2].Servers[0].MaxConns).To(BeZero())
+				})
+
+				// 3000 and 500, and 1024 for each of the two listeners of the unlimited cluster.
+				Expect(model.Events.WorkerConnections).To(Equal(2 * (3000 + 500 + 1024 + 1024)))
+			})
+
+			Context("when the limits add up to more than nginx should handle", func() {
+				BeforeEach(func() {
+					envoyConfParser.GetClustersCall.Returns.Clusters[0].CircuitBreakers.Thresholds[0].MaxConnections = 100000
+				})
+
+				It("caps worker_connections", func() {
+					model, err := nginxConfig.Model(EnvoyConfigFixture)
+					Expect(err).ShouldNot(HaveOccurred())
+					Expect(model.Events.WorkerConnections).To(Equal(65536))
+				})
+			})
+
+			Context("when the limits add up to less than 1024", func() {
+				BeforeEach(func() {
+					envoyConfParser.GetClustersCall.Returns.NameToListeners = map[string][]parser.ListenerInfo{
+						"service-cluster-2222": {{Port: "61002", Cluster: "service-cluster-2222"}},
+					}
+					envoyConfParser.GetClustersCall.Returns.Clusters[1].CircuitBreakers.Thresholds[0].MaxConnections = 10
+				})
+
+				It("keeps the nginx default", func() {
+					model, err := nginxConfig.Model(EnvoyConfigFixture)
+					Expect(err).ShouldNot(HaveOccurred())
+					Expect(model.Events.WorkerConnections).To(Equal(1024))
 				})
 			})
 		})
 
-		Context("when ReadUnmarshalEnvoyConfig fails", func() {
+		Context("when listeners have tls params", func() {
+			BeforeEach(func() {
+				listener := &envoyConfParser.GetClustersCall.Returns.NameToListeners["service-cluster-8080"][0]
+				listener.Protocols = []string{"TLSv1.3"}
+				listener.TLS13Ciphersuites = "TLS_AES_256_GCM_SHA384"
+				listener.ECDHCurves = "X25519"
+			})
+
+			It("models them on the server of the listener", func() {
+				model, err := nginxConfig.Model(EnvoyConfigFixture)
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(model.Stream.Servers[0].SSLProtocols).To(Equal([]string{"TLSv1.3"}))
+				Expect(model.Stream.Servers[0].SSLCiphersuites).To(Equal("TLS_AES_256_GCM_SHA384"))
+				Expect(model.Stream.Servers[0].SSLECDHCurve).To(Equal("X25519"))
+			})
+		})
+
+		Context("when the envoy config has timeouts", func() {
+			BeforeEach(func() {
+				envoyConfParser.GetClustersCall.Returns.Clusters[0].ConnectTimeout = parser.Duration{Duration: 250 * time.Millisecond}
+				envoyConfParser.GetClustersCall.Returns.NameToListeners["service-cluster-8080"][0].IdleTimeout = time.Hour
+				envoyConfParser.GetClustersCall.Returns.NameToListeners["service-cluster-8080"][0].HandshakeTimeout = 10 * time.Second
+			})
+
+			It("models them as nginx timeouts of the servers proxying to the cluster", func() {
+				model, err := nginxConfig.Model(EnvoyConfigFixture)
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(model.Stream.Servers[0].ProxyConnectTimeout).To(Equal(250 * time.Millisecond))
+				Expect(model.Stream.Servers[0].ProxyTimeout).To(Equal(time.Hour))
+				Expect(model.Stream.Servers[0].SSLHandshakeTimeout).To(Equal(10 * time.Second))
+				Expect(model.Stream.Servers[1].ProxyConnectTimeout).To(BeZero())
+			})
+		})
+
+		Context("when a listener has a max connection duration", func() {
+			BeforeEach(func() {
+				envoyConfParser.GetClustersCall.Returns.NameToListeners["service-cluster-8080"][0].MaxConnectionDuration = time.Minute
+				nginxConfig.SetLimitConnectionDuration(true)
+				nginxConfig.SetNjsModule("modules/ngx_stream_js_module.so")
+			})
+
+			It("closes its connections with the njs filter once it is over", func() {
+				model, err := nginxConfig.Model(EnvoyConfigFixture)
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(model.LoadModules).To(Equal([]string{"modules/ngx_stream_js_module.so"}))
+				Expect(model.Stream.JSImports).To(Equal([]parser.NginxJSImport{
+					{Name: "duration", Path: parser.ConvertToUnixPath(filepath.Join(tmpdir, "connection-duration.js"))},
+				}))
+				Expect(model.Stream.Servers[0].MaxConnectionDuration).To(Equal(time.Minute))
+				Expect(model.Stream.Servers[0].JSFilter).To(Equal("duration.limit"))
+				Expect(model.Stream.Servers[1].MaxConnectionDuration).To(BeZero())
+				Expect(model.Stream.Servers[1].JSFilter).To(BeEmpty())
+			})
+
+			It("closes its idle connections once it is over", func() {
+				model, err := nginxConfig.Model(EnvoyConfigFixture)
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(model.Stream.Servers[0].ProxyTimeout).To(Equal(time.Minute))
+				Expect(model.Stream.Servers[1].ProxyTimeout).To(BeZero())
+			})
+
+			Context("when the listener has a shorter idle timeout", func() {
+				BeforeEach(func() {
+					envoyConfParser.GetClustersCall.Returns.NameToListeners["service-cluster-8080"][0].IdleTimeout = 30 * time.Second
+				})
+
+				It("keeps it", func() {
+					model, err := nginxConfig.Model(EnvoyConfigFixture)
+					Expect(err).ShouldNot(HaveOccurred())
+					Expect(model.Stream.Servers[0].ProxyTimeout).To(Equal(30 * time.Second))
+				})
+			})
+
+			Context("when connection durations are not limited", func() {
+				BeforeEach(func() {
+					nginxConfig.SetLimitConnectionDuration(false)
+				})
+
+				It("does not need njs", func() {
+					model, err := nginxConfig.Model(EnvoyConfigFixture)
+					Expect(err).ShouldNot(HaveOccurred())
+					Expect(model.LoadModules).To(BeEmpty())
+					Expect(model.Stream.JSImports).To(BeEmpty())
+					Expect(model.Stream.Servers[0].MaxConnectionDuration).To(BeZero())
+					Expect(model.Stream.Servers[0].JSFilter).To(BeEmpty())
+				})
+			})
+		})
+
+		Context("when the validation context has san matchers", func() {
+			BeforeEach(func() {
+				sdsValidationParser.GetValidationContextsCall.Returns.ValidationContexts = []parser.SdsValidationContext{
+					{Name: "id-validation-context", SANMatchers: []parser.SANMatcher{{Kind: "exact", Value: "gorouter.service.cf.internal"}}},
+				}
+				nginxConfig.SetVerifySAN(true)
+			})
+
+			It("verifies client certs of mTLS listeners with the njs verifier", func() {
+				model, err := nginxConfig.Model(EnvoyConfigFixture)
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(model.LoadModules).To(BeEmpty())
+				Expect(model.Stream.JSImports).To(Equal([]parser.NginxJSImport{
+					{Name: "san", Path: parser.ConvertToUnixPath(filepath.Join(tmpdir, "san-verifier.js"))},
+				}))
+				Expect(model.Stream.Servers[0].JSPreread).To(Equal("san.verify"))
+				Expect(model.Stream.Servers[2].JSPreread).To(Equal("san.verify"))
+				Expect(model.Stream.Servers[3].JSPreread).To(BeEmpty())
+			})
+
+			Context("when san verification is off", func() {
+				BeforeEach(func() {
+					nginxConfig.SetVerifySAN(false)
+					nginxConfig.SetNjsModule("modules/ngx_stream_js_module.so")
+				})
+
+				It("does not need njs", func() {
+					model, err := nginxConfig.Model(EnvoyConfigFixture)
+					Expect(err).ShouldNot(HaveOccurred())
+					Expect(model.LoadModules).To(BeEmpty())
+					Expect(model.Stream.JSImports).To(BeEmpty())
+					Expect(model.Stream.Servers[0].JSPreread).To(BeEmpty())
+				})
+			})
+
+			Context("when an njs module is set", func() {
+				BeforeEach(func() {
+					nginxConfig.SetNjsModule("modules/ngx_stream_js_module.so")
+				})
+
+				It("loads it", func() {
+					model, err := nginxConfig.Model(EnvoyConfigFixture)
+					Expect(err).ShouldNot(HaveOccurred())
+					Expect(model.LoadModules).To(Equal([]string{"modules/ngx_stream_js_module.so"}))
+				})
+			})
+
+			Context("when no listener is mTLS", func() {
+				BeforeEach(func() {
+					for _, listeners := range envoyConfParser.GetClustersCall.Returns.NameToListeners {
+						for i := range listeners {
+							listeners[i].MTLS = false
+						}
+					}
+					nginxConfig.SetNjsModule("modules/ngx_stream_js_module.so")
+				})
+
+				It("does not need njs", func() {
+					model, err := nginxConfig.Model(EnvoyConfigFixture)
+					Expect(err).ShouldNot(HaveOccurred())
+					Expect(model.LoadModules).To(BeEmpty())
+					Expect(model.Stream.JSImports).To(BeEmpty())
+				})
+			})
+		})
+
+		Context("when listeners name different validation contexts", func() {
+			BeforeEach(func() {
+				sdsValidationParser.GetValidationContextsCall.Returns.ValidationContexts = []parser.SdsValidationContext{
+					{Name: "id-validation-context"},
+					{Name: "c2c-validation-context", SANMatchers: []parser.SANMatcher{{Type: "URI", Kind: "prefix", Value: "spiffe://cf/"}}},
+				}
+				listeners := envoyConfParser.GetClustersCall.Returns.NameToListeners
+				listeners["service-cluster-8080"][0].ValidationContext = "id-validation-context"
+				listeners["service-cluster-2222"][0].ValidationContext = "c2c-validation-context"
+				listeners["service-cluster-1234"][0].ValidationContext = "id-validation-context"
+				nginxConfig.SetVerifySAN(true)
+			})
+
+			It("verifies client certs of each listener against its own validation context", func() {
+				model, err := nginxConfig.Model(EnvoyConfigFixture)
+				Expect(err).ShouldNot(HaveOccurred())
+
+				idCA := parser.ConvertToUnixPath(filepath.Join(tmpdir, "id-ca.pem"))
+				c2cCA := parser.ConvertToUnixPath(filepath.Join(tmpdir, "c2c-validation-context-ca.pem"))
+				Expect(model.Stream.Servers[0].SSLClientCertificate).To(Equal(idCA))
+				Expect(model.Stream.Servers[0].JSPreread).To(BeEmpty())
+				Expect(model.Stream.Servers[1].SSLClientCertificate).To(Equal(c2cCA))
+				Expect(model.Stream.Servers[1].JSPreread).To(Equal("san1.verify"))
+				Expect(model.Stream.JSImports).To(Equal([]parser.NginxJSImport{
+					{Name: "san1", Path: parser.ConvertToUnixPath(filepath.Join(tmpdir, "c2c-validation-context-san-verifier.js"))},
+				}))
+			})
+
+			Context("when a listener names a validation context the sds file does not have", func() {
+				BeforeEach(func() {
+					envoyConfParser.GetClustersCall.Returns.NameToListeners["service-cluster-1234"][0].ValidationContext = "unknown-validation-context"
+				})
+
+				It("returns a helpful error instead of trusting another ca", func() {
+					_, err := nginxConfig.Model(EnvoyConfigFixture)
+					Expect(err).To(MatchError(`listener on port 61003: validation context "unknown-validation-context" not found in sds server validation context file`))
+				})
+			})
+		})
+
+		Context("when the sds file has a single validation context", func() {
+			BeforeEach(func() {
+				sdsValidationParser.GetValidationContextsCall.Returns.ValidationContexts = []parser.SdsValidationContext{{Name: "server-validation-context"}}
+				envoyConfParser.GetClustersCall.Returns.NameToListeners["service-cluster-8080"][0].ValidationContext = "id-validation-context"
+			})
+
+			It("verifies client certs of every listener against it whatever its name", func() {
+				model, err := nginxConfig.Model(EnvoyConfigFixture)
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(model.Stream.Servers[0].SSLClientCertificate).To(Equal(parser.ConvertToUnixPath(filepath.Join(tmpdir, "id-ca.pem"))))
+			})
+		})
+
+		Context("when a listener has several tls certificate secrets", func() {
+			BeforeEach(func() {
+				listener := &envoyConfParser.GetClustersCall.Returns.NameToListeners["service-cluster-8080"][0]
+				listener.CertificateSecrets = append(idSecrets, c2cSecrets...)
+			})
+
+			It("models a certificate for each of them", func() {
+				model, err := nginxConfig.Model(EnvoyConfigFixture)
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(model.Stream.Servers[0].SSLCertificates).To(Equal([]parser.NginxSSLCertificate{
+					{Certificate: parser.ConvertToUnixPath(filepath.Join(tmpdir, "id-cert.pem")), Key: parser.ConvertToUnixPath(filepath.Join(tmpdir, "id-key.pem"))},
+					{Certificate: parser.ConvertToUnixPath(filepath.Join(tmpdir, "c2c-cert.pem")), Key: parser.ConvertToUnixPath(filepath.Join(tmpdir, "c2c-key.pem"))},
+				}))
+			})
+		})
+
+		Context("when there is no sds cred parser for a tls certificate secret", func() {
+			BeforeEach(func() {
+				nginxConfig = parser.NewNginxConfig(envoyConfParser, []parser.SdsCredParser{sdsIdCredParser}, sdsValidationParser, tmpdir)
+			})
+
+			It("leaves out the listeners that use it", func() {
+				model, err := nginxConfig.Model(EnvoyConfigFixture)
+				Expect(err).ShouldNot(HaveOccurred())
+
+				ports := []string{}
+				for _, server := range model.Stream.Servers {
+					ports = append(ports, server.Listen)
+				}
+				Expect(ports).To(Equal([]string{"61001", "61002", "61003"}))
+			})
+		})
+
+		Context("when the validation contexts cannot be read", func() {
+			BeforeEach(func() {
+				sdsValidationParser.GetValidationContextsCall.Returns.Error = errors.New("banana")
+			})
+
+			It("returns a helpful error message", func() {
+				_, err := nginxConfig.Model(EnvoyConfigFixture)
+				Expect(err).To(MatchError("get validation contexts from sds server validation parser: banana"))
+			})
+		})
+
+		Context("when worker processes and an error log level are set", func() {
+			BeforeEach(func() {
+				nginxConfig.SetWorkerProcesses(4)
+				nginxConfig.SetErrorLogLevel("warn")
+			})
+
+			It("models them", func() {
+				model, err := nginxConfig.Model(EnvoyConfigFixture)
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(model.WorkerProcesses).To(Equal(4))
+				Expect(model.ErrorLogLevel).To(Equal("warn"))
+			})
+		})
+
+		Context("when the envoy config cannot be read", func() {
 			BeforeEach(func() {
 				envoyConfParser.ReadUnmarshalEnvoyConfigCall.Returns.Error = errors.New("banana")
 			})
-			It("should return a custom error", func() {
-				err := nginxConfig.Generate(EnvoyConfigFixture)
+
+			It("returns a helpful error message", func() {
+				_, err := nginxConfig.Model(EnvoyConfigFixture)
 				Expect(err).To(MatchError("read and unmarshal Envoy config: banana"))
 			})
 		})
+	})
 
-		Context("when ioutil fails to write the nginx.conf", func() {
+	Describe("IgnoresSANMatchers", func() {
+		BeforeEach(func() {
+			sdsValidationParser.GetValidationContextsCall.Returns.ValidationContexts = []parser.SdsValidationContext{
+				{Name: "id-validation-context"},
+				{Name: "c2c-validation-context", SANMatchers: []parser.SANMatcher{{Type: "URI", Kind: "prefix", Value: "spiffe://cf/"}}},
+			}
+		})
+
+		It("reports san matchers that are not verified", func() {
+			ignored, err := nginxConfig.IgnoresSANMatchers()
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(ignored).To(BeTrue())
+		})
+
+		Context("when san verification is on", func() {
 			BeforeEach(func() {
-				nginxConfig = parser.NewNginxConfig(envoyConfParser, []parser.SdsCredParser{sdsIdCredParser, sdsC2CCredParser}, sdsValidationParser, "not-a-real-dir")
+				nginxConfig.SetVerifySAN(true)
 			})
-			// We do not test that os.WriteFile fails for cert/key because
-			// our trick to cause that function to fail only works once!
-			// The trick is to pass a directory that isn't real.
+
+			It("reports nothing", func() {
+				ignored, err := nginxConfig.IgnoresSANMatchers()
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(ignored).To(BeFalse())
+			})
+		})
+
+		Context("when no validation context has san matchers", func() {
+			BeforeEach(func() {
+				sdsValidationParser.GetValidationContextsCall.Returns.ValidationContexts = []parser.SdsValidationContext{{Name: "id-validation-context"}}
+			})
+
+			It("reports nothing", func() {
+				ignored, err := nginxConfig.IgnoresSANMatchers()
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(ignored).To(BeFalse())
+			})
+		})
+
+		Context("when the validation contexts cannot be read", func() {
+			BeforeEach(func() {
+				sdsValidationParser.GetValidationContextsCall.Returns.Error = errors.New("banana")
+			})
+
 			It("returns a helpful error message", func() {
-				err := nginxConfig.Generate(EnvoyConfigFixture)
-				Expect(err.Error()).To(ContainSubstring("nginx.conf - write file failed:"))
+				_, err := nginxConfig.IgnoresSANMatchers()
+				Expect(err).To(MatchError("get validation contexts from sds server validation parser: banana"))
 			})
 		})
 	})
-})
 
-func convertToUnixPath(path string) string {
-	path = strings.Replace(path, "C:", "", -1)
-	path = strings.Replace(path, "\\", "/", -1)
-	return path
-}
+	Describe("Translate", func() {
+		BeforeEach(func() {
+			envoyConfParser.GetClustersCall.Returns.Clusters = testClusters()
+			envoyConfParser.GetClustersCall.Returns.NameToListeners = map[string][]parser.ListenerInfo{
+				"service-cluster-8080": {
+					{Port: "61001", MTLS: true, Ciphers: "ECDHE-RSA-AES256-GCM-SHA384", CertificateSecrets: idSecrets},
+				},
+			}
+		})
 
-type listenerInfo struct {
-	Port           int
-	ClientVerify   bool
-	ClientCertPath string
-	Ciphers        string
-	Cert           string
-	Key            string
-}
+		It("returns the nginx config without writing it", func() {
+			config, err := nginxConfig.Translate(EnvoyConfigFixture)
+			Expect(err).ShouldNot(HaveOccurred())
 
-func parseNginxConfig(config []byte) map[string][]listenerInfo {
-	serverConfigs := strings.Split(string(config), "server {")
-	portsToClientCertificateMap := map[string][]listenerInfo{}
-	for i := 1; i < len(serverConfigs); i++ {
-		serverConfig := serverConfigs[i]
-
-		re := regexp.MustCompile(`proxy_pass\s*(.*);`)
-		matches := re.FindStringSubmatch(serverConfig)
-		Expect(matches).To(HaveLen(2))
-		name := matches[1]
-
-		re = regexp.MustCompile(`listen (.*) ssl;`)
-		matches = re.FindStringSubmatch(serverConfig)
-		Expect(matches).To(HaveLen(2))
-		portStr := matches[1]
-		port, err := strconv.Atoi(portStr)
-		Expect(err).NotTo(HaveOccurred())
-
-		re = regexp.MustCompile(`ssl_verify_client\s*(.*);`)
-		matches = re.FindStringSubmatch(serverConfig)
-		var verify bool
-		if len(matches) > 0 && matches[1] == "on" {
-			verify = true
-		}
-
-		re = regexp.MustCompile(`ssl_client_certificate\s*(.*);`)
-		matches = re.FindStringSubmatch(serverConfig)
-		var certPath string
-		if len(matches) > 1 {
-			certPath = matches[1]
-		}
-
-		re = regexp.MustCompile(`ssl_ciphers\s*(.*);`)
-		matches = re.FindStringSubmatch(serverConfig)
-		var ciphers string
-		if len(matches) > 1 {
-			ciphers = matches[1]
-		}
-
-		re = regexp.MustCompile(`ssl_certificate\s*(.*);`)
-		matches = re.FindStringSubmatch(serverConfig)
-		var cert string
-		if len(matches) > 1 {
-			cert = matches[1]
-		}
-
-		re = regexp.MustCompile(`ssl_certificate_key\s*(.*);`)
-		matches = re.FindStringSubmatch(serverConfig)
-		var key string
-		if len(matches) > 1 {
-			key = matches[1]
-		}
-
-		portsToClientCertificateMap[name] = append(portsToClientCertificateMap[name], listenerInfo{
-			Port:           port,
-			ClientVerify:   verify,
-			ClientCertPath: certPath,
-			Ciphers:        ciphers,
-			Cert:           cert,
-			Key:            key,
+			model, err := nginxConfig.Model(EnvoyConfigFixture)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(config).To(Equal(model.Render()))
+			Expect(nginxConfig.GetConfFile()).NotTo(BeAnExistingFile())
+			Expect(filepath.Join(tmpdir, "id-cert.pem")).NotTo(BeAnExistingFile())
 		})
-	}
-	return portsToClientCertificateMap
-}
+
+		Context("when the envoy config cannot be read", func() {
+			BeforeEach(func() {
+				envoyConfParser.ReadUnmarshalEnvoyConfigCall.Returns.Error = errors.New("banana")
+			})
+
+			It("returns a helpful error message", func() {
+				_, err := nginxConfig.Translate(EnvoyConfigFixture)
+				Expect(err).To(MatchError("read and unmarshal Envoy config: banana"))
+			})
+		})
+	})
+
+	Describe("ConvertToUnixPath", func() {
+		DescribeTable("converts paths to forward slashes",
+			func(path, expected string) {
+				Expect(parser.ConvertToUnixPath(path)).To(Equal(expected))
+			},
+			Entry("on the C: drive", `C:\Users\vcap\nginx\id-cert.pem`, "C:/Users/vcap/nginx/id-cert.pem"),
+			Entry("on another drive", `D:\tmp\nginx\id-cert.pem`, "D:/tmp/nginx/id-cert.pem"),
+			Entry("on a UNC share", `\\server\share\nginx\id-cert.pem`, "//server/share/nginx/id-cert.pem"),
+			Entry("that are unix paths already", "/tmp/nginx/id-cert.pem", "/tmp/nginx/id-cert.pem"),
+		)
+	})
+})
+
+var (
+	idSecrets  = []parser.TLSCertificateSdsSecretConfig{{Name: "id-cert-and-key"}}
+	c2cSecrets = []parser.TLSCertificateSdsSecretConfig{{Name: "c2c-cert-and-key"}}
+)
 
 func testClusters() []parser.Cluster {
 	return []parser.Cluster{
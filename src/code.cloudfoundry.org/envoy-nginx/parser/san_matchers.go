@@ -0,0 +1,348 @@
+package parser
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// SAN types as envoy names them in match_typed_subject_alt_names.
+var sanTypes = map[string]bool{
+	"DNS":        true,
+	"URI":        true,
+	"EMAIL":      true,
+	"IP_ADDRESS": true,
+}
+
+type StringMatcher struct {
+	Exact      string    `yaml:"exact,omitempty"`
+	Prefix     string    `yaml:"prefix,omitempty"`
+	Suffix     string    `yaml:"suffix,omitempty"`
+	Contains   string    `yaml:"contains,omitempty"`
+	SafeRegex  SafeRegex `yaml:"safe_regex,omitempty"`
+	IgnoreCase bool      `yaml:"ignore_case,omitempty"`
+}
+
+type SafeRegex struct {
+	Regex string `yaml:"regex,omitempty"`
+}
+
+type TypedSANMatcher struct {
+	SANType string        `yaml:"san_type,omitempty"`
+	Matcher StringMatcher `yaml:"matcher,omitempty"`
+}
+
+// A client cert is accepted if any of its subject alt names matches.
+// The matchers are handed to the njs verifier as json.
+type SANMatcher struct {
+	// Any SAN type if empty.
+	Type string `json:"type,omitempty"`
+	// exact, prefix, suffix, contains or regex.
+	Kind       string `json:"kind"`
+	Value      string `json:"value"`
+	IgnoreCase bool   `json:"ignoreCase,omitempty"`
+}
+
+/*
+* Collects the matchers of verify_subject_alt_name,
+* match_subject_alt_names and match_typed_subject_alt_names. Matchers
+* that the verifier could not apply the way envoy does are errors,
+* so that a listener never accepts more client certs than intended.
+ */
+func (v ValidationContext) sanMatchers() ([]SANMatcher, error) {
+	matchers := []SANMatcher{}
+
+	for _, san := range v.VerifySubjectAltName {
+		matchers = append(matchers, SANMatcher{Kind: "exact", Value: san})
+	}
+
+	for i, m := range v.MatchSubjectAltNames {
+		matcher, err := m.sanMatcher()
+		if err != nil {
+			return nil, fmt.Errorf("match_subject_alt_names[%d]: %s", i, err)
+		}
+		matchers = append(matchers, matcher)
+	}
+
+	for i, m := range v.MatchTypedSubjectAltNames {
+		if !sanTypes[m.SANType] {
+			return nil, fmt.Errorf("match_typed_subject_alt_names[%d]: unsupported san_type %q, expected DNS, URI, EMAIL or IP_ADDRESS", i, m.SANType)
+		}
+
+		matcher, err := m.Matcher.sanMatcher()
+		if err != nil {
+			return nil, fmt.Errorf("match_typed_subject_alt_names[%d].matcher: %s", i, err)
+		}
+		matcher.Type = m.SANType
+		matchers = append(matchers, matcher)
+	}
+
+	return matchers, nil
+}
+
+func (m StringMatcher) sanMatcher() (SANMatcher, error) {
+	kinds := []SANMatcher{}
+	for _, kind := range []SANMatcher{
+		{Kind: "exact", Value: m.Exact},
+		{Kind: "prefix", Value: m.Prefix},
+		{Kind: "suffix", Value: m.Suffix},
+		{Kind: "contains", Value: m.Contains},
+		{Kind: "regex", Value: m.SafeRegex.Regex},
+	} {
+		if kind.Value != "" {
+			kinds = append(kinds, kind)
+		}
+	}
+
+	if len(kinds) != 1 {
+		return SANMatcher{}, fmt.Errorf("expected exactly one of exact, prefix, suffix, contains or safe_regex, got %d", len(kinds))
+	}
+
+	matcher := kinds[0]
+	if matcher.Kind == "regex" {
+		if m.IgnoreCase {
+			return SANMatcher{}, fmt.Errorf("ignore_case cannot be combined with safe_regex")
+		}
+
+		_, err := regexp.Compile(matcher.Value)
+		if err != nil {
+			return SANMatcher{}, fmt.Errorf("invalid safe_regex: %s", err)
+		}
+
+		err = checkJSRegex(matcher.Value)
+		if err != nil {
+			return SANMatcher{}, fmt.Errorf("unsupported safe_regex: %s", err)
+		}
+	}
+	matcher.IgnoreCase = m.IgnoreCase
+
+	return matcher, nil
+}
+
+/*
+* The verifier runs the regex as a javascript RegExp, which rejects some
+* RE2 syntax and reads some differently, e.g. \z as a literal z. Such
+* regexes could accept client certs envoy would not, so they are errors.
+ */
+func checkJSRegex(expr string) error {
+	inClass := false
+	for i := 0; i < len(expr); i++ {
+		switch {
+		case expr[i] == '\\' && i+1 < len(expr):
+			if strings.IndexByte("ACEPQpz", expr[i+1]) != -1 {
+				return fmt.Errorf("\\%c is not supported in javascript", expr[i+1])
+			}
+			i++
+		case inClass && strings.HasPrefix(expr[i:], "[:"):
+			return fmt.Errorf("ascii character classes are not supported in javascript")
+		case inClass && expr[i] == ']':
+			inClass = false
+		case expr[i] == '[':
+			inClass = true
+		case strings.HasPrefix(expr[i:], "(?") && !strings.HasPrefix(expr[i:], "(?:"):
+			return fmt.Errorf("flag and named groups are not supported in javascript")
+		}
+	}
+
+	return nil
+}
+
+// Returns the njs module that rejects client certs none of whose
+// subject alt names match.
+func sanVerifier(matchers []SANMatcher) ([]byte, error) {
+	encoded, err := json.Marshal(matchers)
+	if err != nil {
+		return nil, fmt.Errorf("marshal san matchers: %s", err)
+	}
+
+	return []byte(fmt.Sprintf(sanVerifierTemplate, encoded)), nil
+}
+
+/*
+* njs has no x509 api, so the verifier reads the subject alt names out
+* of the DER of the client cert itself. nginx has already verified the
+* cert against the trusted ca by the time the preread phase runs.
+* DNS SANs with a wildcard match the way envoy matches them, exact
+* matchers accept any name the wildcard covers.
+ */
+const sanVerifierTemplate = `// Generated by envoy-nginx, do not edit.
+var matchers = %s;
+
+var SAN_OID = '551d11';
+
+function verify(s) {
+    var sans;
+    try {
+        sans = subjectAltNames(der(s.variables.ssl_client_raw_cert || ''));
+    } catch (e) {
+        s.error('envoy-nginx: client certificate rejected: ' + e.message);
+        s.deny();
+        return;
+    }
+
+    try {
+        for (var i = 0; i < sans.length; i++) {
+            for (var j = 0; j < matchers.length; j++) {
+                if (matches(matchers[j], sans[i])) {
+                    s.allow();
+                    return;
+                }
+            }
+        }
+    } catch (e) {
+        s.error('envoy-nginx: client certificate rejected: cannot apply subject alt name matcher: ' + e.message);
+        s.deny();
+        return;
+    }
+
+    s.error('envoy-nginx: client certificate rejected: no subject alt name matches, got [' +
+        sans.map(function (san) { return san.type + ':' + san.value; }).join(', ') + ']');
+    s.deny();
+}
+
+function matches(m, san) {
+    if (m.type && m.type !== san.type) {
+        return false;
+    }
+    if (m.kind === 'regex') {
+        return new RegExp('^(?:' + m.value + ')$').test(san.value);
+    }
+
+    var value = san.value;
+    var expected = m.value;
+    if (m.ignoreCase) {
+        value = value.toLowerCase();
+        expected = expected.toLowerCase();
+    }
+
+    switch (m.kind) {
+    case 'exact':
+        if (san.type === 'DNS' && value.indexOf('*.') === 0) {
+            var dot = expected.indexOf('.');
+            return dot > 0 && expected.slice(dot) === value.slice(1);
+        }
+        return value === expected;
+    case 'prefix':
+        return value.indexOf(expected) === 0;
+    case 'suffix':
+        return value.length >= expected.length &&
+            value.slice(value.length - expected.length) === expected;
+    case 'contains':
+        return value.indexOf(expected) !== -1;
+    }
+    return false;
+}
+
+function der(pem) {
+    var b64 = pem.replace(/-----[^-]+-----/g, '').replace(/\s+/g, '');
+    if (b64 === '') {
+        throw new Error('no client certificate');
+    }
+    return Buffer.from(b64, 'base64');
+}
+
+function tlv(buf, pos, end) {
+    if (pos + 2 > end) {
+        throw new Error('truncated certificate');
+    }
+    var tag = buf[pos];
+    var len = buf[pos + 1];
+    var start = pos + 2;
+    if (len & 0x80) {
+        var n = len & 0x7f;
+        len = 0;
+        for (var i = 0; i < n; i++) {
+            len = len * 256 + buf[start + i];
+        }
+        start += n;
+    }
+    if (start + len > end) {
+        throw new Error('truncated certificate');
+    }
+    return {tag: tag, start: start, end: start + len};
+}
+
+function children(buf, parent) {
+    var out = [];
+    for (var pos = parent.start; pos < parent.end; pos = out[out.length - 1].end) {
+        out.push(tlv(buf, pos, parent.end));
+    }
+    return out;
+}
+
+function subjectAltNames(buf) {
+    var tbs = children(buf, tlv(buf, 0, buf.length))[0];
+    var sans = [];
+    children(buf, tbs).forEach(function (field) {
+        // [3] extensions
+        if (field.tag !== 0xa3) {
+            return;
+        }
+        children(buf, children(buf, field)[0]).forEach(function (extension) {
+            var parts = children(buf, extension);
+            if (buf.slice(parts[0].start, parts[0].end).toString('hex') !== SAN_OID) {
+                return;
+            }
+            var value = parts[parts.length - 1];
+            children(buf, tlv(buf, value.start, value.end)).forEach(function (name) {
+                var san = generalName(buf, name);
+                if (san) {
+                    sans.push(san);
+                }
+            });
+        });
+    });
+    return sans;
+}
+
+function generalName(buf, name) {
+    var bytes = buf.slice(name.start, name.end);
+    switch (name.tag) {
+    case 0x81:
+        return {type: 'EMAIL', value: bytes.toString()};
+    case 0x82:
+        return {type: 'DNS', value: bytes.toString()};
+    case 0x86:
+        return {type: 'URI', value: bytes.toString()};
+    case 0x87:
+        return {type: 'IP_ADDRESS', value: ip(bytes)};
+    }
+    return null;
+}
+
+function ip(bytes) {
+    var i;
+    if (bytes.length === 4) {
+        var octets = [];
+        for (i = 0; i < 4; i++) {
+            octets.push(bytes[i]);
+        }
+        return octets.join('.');
+    }
+
+    var groups = [];
+    for (i = 0; i < bytes.length; i += 2) {
+        groups.push(((bytes[i] << 8) | bytes[i + 1]).toString(16));
+    }
+
+    // The longest run of at least two zero groups is elided.
+    var best = -1, bestLen = 1;
+    for (i = 0; i < groups.length; i++) {
+        var len = 0;
+        while (i + len < groups.length && groups[i + len] === '0') {
+            len++;
+        }
+        if (len > bestLen) {
+            best = i;
+            bestLen = len;
+        }
+    }
+    if (best === -1) {
+        return groups.join(':');
+    }
+    return groups.slice(0, best).join(':') + '::' + groups.slice(best + bestLen).join(':');
+}
+
+export default {verify};
+`
@@ -0,0 +1,176 @@
+package parser_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"code.cloudfoundry.org/envoy-nginx/parser"
+	"code.cloudfoundry.org/envoy-nginx/parser/fakes"
+)
+
+// Runs verify of the njs verifier with a stand-in for the njs stream
+// session and prints whether it allowed or denied the client cert.
+const sanVerifierHarness = `import san from './san-verifier.js';
+import {readFileSync} from 'fs';
+
+var result = 'none';
+san.verify({
+    variables: {ssl_client_raw_cert: readFileSync(process.argv[2], 'utf8')},
+    allow: function () { result = 'allow'; },
+    deny: function () { result = 'deny'; },
+    error: function (message) { console.error(message); },
+});
+console.log(result);
+`
+
+/*
+* The verifier is run in node, which has the Buffer api the verifier
+* uses from njs. The client certs are real certs, so the verifier
+* parses the same DER nginx hands it.
+ */
+var _ = Describe("San Verifier", func() {
+	var (
+		tmpdir string
+		node   string
+		stderr *strings.Builder
+
+		certs map[string]string
+	)
+
+	BeforeEach(func() {
+		var err error
+		node, err = exec.LookPath("node")
+		if err != nil {
+			Skip("node is needed to run the njs verifier")
+		}
+
+		stderr = &strings.Builder{}
+
+		tmpdir, err = os.MkdirTemp("", "san-verifier")
+		Expect(err).ShouldNot(HaveOccurred())
+		DeferCleanup(os.RemoveAll, tmpdir)
+
+		Expect(os.WriteFile(filepath.Join(tmpdir, "package.json"), []byte(`{"type": "module"}`), 0644)).To(Succeed())
+		Expect(os.WriteFile(filepath.Join(tmpdir, "harness.js"), []byte(sanVerifierHarness), 0644)).To(Succeed())
+
+		certs = map[string]string{
+			"every san type": clientCert(tmpdir, "every-san-type", &x509.Certificate{
+				DNSNames:       []string{"gorouter.service.cf.internal"},
+				URIs:           []*url.URL{{Scheme: "spiffe", Host: "cf", Path: "/app/1234"}},
+				EmailAddresses: []string{"ops@example.com"},
+				IPAddresses:    []net.IP{net.ParseIP("10.0.0.1"), net.ParseIP("2001:db8::1"), net.ParseIP("fe80:0:0:1::1")},
+			}),
+			"wildcard": clientCert(tmpdir, "wildcard", &x509.Certificate{
+				DNSNames: []string{"*.service.cf.internal"},
+			}),
+			"mixed case": clientCert(tmpdir, "mixed-case", &x509.Certificate{
+				DNSNames: []string{"GoRouter.Service.CF.internal"},
+			}),
+			"no sans": clientCert(tmpdir, "no-sans", &x509.Certificate{}),
+			"none":    writeFile(tmpdir, "none.pem", ""),
+			"garbage": writeFile(tmpdir, "garbage.pem", "-----BEGIN CERTIFICATE-----\nMIIBkTCB+wIJAN==\n-----END CERTIFICATE-----\n"),
+		}
+	})
+
+	verify := func(matchers []parser.SANMatcher, cert string) string {
+		sdsValidationParser := &fakes.SdsIdValidationParser{}
+		sdsValidationParser.GetValidationContextsCall.Returns.ValidationContexts = []parser.SdsValidationContext{
+			{Name: "id-validation-context", SANMatchers: matchers},
+		}
+		nginxConfig := parser.NewNginxConfig(&fakes.EnvoyConfParser{}, nil, sdsValidationParser, tmpdir)
+		nginxConfig.SetVerifySAN(true)
+		Expect(nginxConfig.WriteTLSFiles()).To(Succeed())
+
+		command := exec.Command(node, "harness.js", certs[cert])
+		command.Dir = tmpdir
+		command.Stderr = io.MultiWriter(GinkgoWriter, stderr)
+		out, err := command.Output()
+		Expect(err).ShouldNot(HaveOccurred())
+		return strings.TrimSpace(string(out))
+	}
+
+	DescribeTable("allows client certs one of whose subject alt names matches",
+		func(matchers []parser.SANMatcher, cert, result string) {
+			Expect(verify(matchers, cert)).To(Equal(result))
+		},
+		Entry("an exact dns name", []parser.SANMatcher{{Kind: "exact", Value: "gorouter.service.cf.internal"}}, "every san type", "allow"),
+		Entry("another dns name", []parser.SANMatcher{{Kind: "exact", Value: "uaa.service.cf.internal"}}, "every san type", "deny"),
+		Entry("an exact uri of any type", []parser.SANMatcher{{Kind: "exact", Value: "spiffe://cf/app/1234"}}, "every san type", "allow"),
+		Entry("a uri prefix", []parser.SANMatcher{{Type: "URI", Kind: "prefix", Value: "spiffe://cf/"}}, "every san type", "allow"),
+		Entry("a uri prefix typed as dns", []parser.SANMatcher{{Type: "DNS", Kind: "prefix", Value: "spiffe://cf/"}}, "every san type", "deny"),
+		Entry("an email", []parser.SANMatcher{{Type: "EMAIL", Kind: "exact", Value: "ops@example.com"}}, "every san type", "allow"),
+		Entry("an ipv4 address", []parser.SANMatcher{{Type: "IP_ADDRESS", Kind: "exact", Value: "10.0.0.1"}}, "every san type", "allow"),
+		Entry("an ipv6 address", []parser.SANMatcher{{Type: "IP_ADDRESS", Kind: "exact", Value: "2001:db8::1"}}, "every san type", "allow"),
+		Entry("an ipv6 address with the longest run of zeros elided", []parser.SANMatcher{{Type: "IP_ADDRESS", Kind: "exact", Value: "fe80:0:0:1::1"}}, "every san type", "allow"),
+		Entry("an ip address typed as dns", []parser.SANMatcher{{Type: "DNS", Kind: "exact", Value: "10.0.0.1"}}, "every san type", "deny"),
+		Entry("a suffix", []parser.SANMatcher{{Kind: "suffix", Value: ".cf.internal"}}, "every san type", "allow"),
+		Entry("a suffix longer than the name", []parser.SANMatcher{{Kind: "suffix", Value: "x.gorouter.service.cf.internal"}}, "every san type", "deny"),
+		Entry("a substring", []parser.SANMatcher{{Kind: "contains", Value: "service.cf"}}, "every san type", "allow"),
+		Entry("a regex", []parser.SANMatcher{{Kind: "regex", Value: `[a-z]+\.service\.cf\.internal`}}, "every san type", "allow"),
+		Entry("a regex that only matches part of the name", []parser.SANMatcher{{Kind: "regex", Value: `service`}}, "every san type", "deny"),
+		Entry("any of several matchers", []parser.SANMatcher{
+			{Kind: "exact", Value: "uaa.service.cf.internal"},
+			{Type: "URI", Kind: "exact", Value: "spiffe://cf/app/1234"},
+		}, "every san type", "allow"),
+		Entry("a name of another case", []parser.SANMatcher{{Kind: "exact", Value: "gorouter.service.cf.internal"}}, "mixed case", "deny"),
+		Entry("a name of another case ignoring case", []parser.SANMatcher{{Kind: "exact", Value: "gorouter.service.cf.internal", IgnoreCase: true}}, "mixed case", "allow"),
+		Entry("a prefix ignoring case", []parser.SANMatcher{{Kind: "prefix", Value: "GOROUTER.", IgnoreCase: true}}, "mixed case", "allow"),
+		Entry("a name the wildcard covers", []parser.SANMatcher{{Kind: "exact", Value: "gorouter.service.cf.internal"}}, "wildcard", "allow"),
+		Entry("a name two labels below the wildcard", []parser.SANMatcher{{Kind: "exact", Value: "a.gorouter.service.cf.internal"}}, "wildcard", "deny"),
+		Entry("the parent of the wildcard", []parser.SANMatcher{{Kind: "exact", Value: "service.cf.internal"}}, "wildcard", "deny"),
+		Entry("a name the wildcard covers by prefix", []parser.SANMatcher{{Kind: "prefix", Value: "gorouter."}}, "wildcard", "deny"),
+		Entry("a cert without sans", []parser.SANMatcher{{Kind: "contains", Value: "."}}, "no sans", "deny"),
+		Entry("no client cert", []parser.SANMatcher{{Kind: "contains", Value: "."}}, "none", "deny"),
+		Entry("a cert that cannot be parsed", []parser.SANMatcher{{Kind: "contains", Value: "."}}, "garbage", "deny"),
+	)
+
+	Context("when a regex is not valid in javascript", func() {
+		It("denies the client cert and logs why", func() {
+			matchers := []parser.SANMatcher{
+				{Kind: "regex", Value: `(?i)gorouter\.service\.cf\.internal`},
+				{Kind: "exact", Value: "gorouter.service.cf.internal"},
+			}
+			Expect(verify(matchers, "every san type")).To(Equal("deny"))
+			Expect(stderr.String()).To(ContainSubstring("envoy-nginx: client certificate rejected: cannot apply subject alt name matcher: Invalid regular expression"))
+		})
+	})
+})
+
+// Writes a self-signed cert with the subject alt names of template to
+// dir and returns its path.
+func clientCert(dir, name string, template *x509.Certificate) string {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	Expect(err).ShouldNot(HaveOccurred())
+
+	template.SerialNumber = big.NewInt(1)
+	template.Subject = pkix.Name{CommonName: name}
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	Expect(err).ShouldNot(HaveOccurred())
+
+	return writeFile(dir, name+".pem", string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})))
+}
+
+func writeFile(dir, name, contents string) string {
+	path := filepath.Join(dir, name)
+	Expect(os.WriteFile(path, []byte(contents), 0644)).To(Succeed())
+	return path
+}
@@ -9,10 +9,12 @@ import (
 )
 
 type Sds struct {
-	Resources []Resource `yaml:"resources,omitempty"`
+	Resources   []Resource `yaml:"resources,omitempty"`
+	VersionInfo string     `yaml:"version_info,omitempty"`
 }
 
 type Resource struct {
+	Name           string         `yaml:"name,omitempty"`
 	TLSCertificate TLSCertificate `yaml:"tls_certificate,omitempty"`
 }
 
@@ -30,48 +32,80 @@ type PrivateKey struct {
 }
 
 type sdsCredParser struct {
-	file       string
-	configType SdsConfigType
+	name string
+	file string
 }
 
-func NewSdsIdCredParser(file string) SdsCredParser {
+// Reads the cert and key of the tls certificate secret with the given
+// name from an sds file.
+func NewSdsCredParser(name, file string) SdsCredParser {
 	return sdsCredParser{
-		file:       file,
-		configType: SdsIdConfigType,
+		name: name,
+		file: file,
 	}
 }
 
-func NewSdsC2CCredParser(file string) SdsCredParser {
-	return sdsCredParser{
-		file:       file,
-		configType: SdsC2CConfigType,
+/* Parses the Envoy SDS file and extracts the cert and key */
+func (p sdsCredParser) GetCertAndKey() (string, string, error) {
+	resource, _, err := p.read()
+	if err != nil {
+		return "", "", err
 	}
+
+	cert := resource.TLSCertificate.CertChain.InlineString
+	key := resource.TLSCertificate.PrivateKey.InlineString
+
+	return cert, key, nil
 }
 
-/* Parses the Envoy SDS file and extracts the cert and key */
-func (p sdsCredParser) GetCertAndKey() (string, string, error) {
+/* Returns the version_info of the SDS file and a hash of the cert and key */
+func (p sdsCredParser) Fingerprint() (SdsFingerprint, error) {
+	resource, versionInfo, err := p.read()
+	if err != nil {
+		return SdsFingerprint{}, err
+	}
+
+	cert := resource.TLSCertificate.CertChain.InlineString
+	key := resource.TLSCertificate.PrivateKey.InlineString
+
+	return newSdsFingerprint(versionInfo, cert, key), nil
+}
+
+// Name of the tls certificate secret, as listeners refer to it in
+// their tls_certificate_sds_secret_configs.
+func (p sdsCredParser) Name() string {
+	return p.name
+}
+
+// Returns the resource named after the secret together with the
+// version_info of the file. A file with a single resource is taken as
+// is, whatever its name, as it was before secrets were matched by name.
+func (p sdsCredParser) read() (Resource, string, error) {
 	contents, err := os.ReadFile(p.file)
 	if err != nil {
-		return "", "", fmt.Errorf("Failed to read sds creds: %s", err)
+		return Resource{}, "", fmt.Errorf("Failed to read sds creds: %s", err)
 	}
 
 	auth := Sds{}
 
 	err = yaml.Unmarshal(contents, &auth)
 	if err != nil {
-		return "", "", fmt.Errorf("Failed to unmarshal sds creds: %s", err)
+		return Resource{}, "", fmt.Errorf("Failed to unmarshal sds creds: %s", err)
 	}
 
 	if len(auth.Resources) < 1 {
-		return "", "", errors.New("resources section not found in sds cred file")
+		return Resource{}, "", errors.New("resources section not found in sds cred file")
 	}
 
-	cert := auth.Resources[0].TLSCertificate.CertChain.InlineString
-	key := auth.Resources[0].TLSCertificate.PrivateKey.InlineString
+	for _, resource := range auth.Resources {
+		if resource.Name == p.name {
+			return resource, auth.VersionInfo, nil
+		}
+	}
 
-	return cert, key, nil
-}
+	if len(auth.Resources) == 1 {
+		return auth.Resources[0], auth.VersionInfo, nil
+	}
 
-func (p sdsCredParser) ConfigType() SdsConfigType {
-	return p.configType
+	return Resource{}, "", fmt.Errorf("resource %q not found in sds cred file", p.name)
 }
@@ -0,0 +1,30 @@
+package parser
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+)
+
+// Identifies the material extracted from an sds file, so that a file
+// that was rewritten with the same cert, key or ca cert can be told
+// apart from an actual rotation.
+type SdsFingerprint struct {
+	VersionInfo string
+	Hash        string
+}
+
+func newSdsFingerprint(versionInfo string, material ...string) SdsFingerprint {
+	hash := sha256.New()
+	for _, m := range material {
+		// Length-prefix each part, so that moving bytes from the
+		// cert to the key does not produce the same hash.
+		binary.Write(hash, binary.BigEndian, uint64(len(m)))
+		hash.Write([]byte(m))
+	}
+
+	return SdsFingerprint{
+		VersionInfo: versionInfo,
+		Hash:        hex.EncodeToString(hash.Sum(nil)),
+	}
+}
@@ -1,29 +1,49 @@
 package parser
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"os"
+	"strings"
 
 	"gopkg.in/yaml.v2"
 )
 
+// The first validation context is written to id-ca.pem.
+const reservedValidationContextName = "id"
+
 type SdsIdValidation struct {
-	Resources []ValidationResource `yaml:"resources,omitempty"`
+	Resources   []ValidationResource `yaml:"resources,omitempty"`
+	VersionInfo string               `yaml:"version_info,omitempty"`
 }
 
 type ValidationResource struct {
+	Name              string            `yaml:"name,omitempty"`
 	ValidationContext ValidationContext `yaml:"validation_context,omitempty"`
 }
 
 type ValidationContext struct {
-	TrustedCA TrustedCA `yaml:"trusted_ca,omitempty"`
+	TrustedCA                 TrustedCA         `yaml:"trusted_ca,omitempty"`
+	VerifySubjectAltName      []string          `yaml:"verify_subject_alt_name,omitempty"`
+	MatchSubjectAltNames      []StringMatcher   `yaml:"match_subject_alt_names,omitempty"`
+	MatchTypedSubjectAltNames []TypedSANMatcher `yaml:"match_typed_subject_alt_names,omitempty"`
 }
 
 type TrustedCA struct {
 	InlineString string `yaml:"inline_string,omitempty"`
 }
 
+// A validation context as listeners refer to it by name in their
+// validation_context_sds_secret_config.
+type SdsValidationContext struct {
+	Name string
+	CA   string
+	// Client certs are accepted if any of their subject alt names
+	// matches, or regardless of them if there are no matchers.
+	SANMatchers []SANMatcher
+}
+
 type sdsIdValidationParser struct {
 	file string
 }
@@ -34,24 +54,92 @@ func NewSdsIdValidationParser(file string) SdsValidationParser {
 	}
 }
 
-func (p sdsIdValidationParser) GetCACert() (string, error) {
+/*
+* Returns every validation context of the SDS file, in file order. If
+* there is only one, it is the fallback for listeners whose validation
+* context is not in the file.
+ */
+func (p sdsIdValidationParser) GetValidationContexts() ([]SdsValidationContext, error) {
+	auth, err := p.read()
+	if err != nil {
+		return nil, err
+	}
+
+	contexts := []SdsValidationContext{}
+	names := map[string]bool{}
+	for i, resource := range auth.Resources {
+		// Only the first one can do without a name, it is the fallback.
+		if i > 0 || resource.Name != "" {
+			if !secretName.MatchString(resource.Name) {
+				return nil, fmt.Errorf("Invalid name %q of sds server validation context, expected letters, digits, '.', '-' and '_'", resource.Name)
+			}
+			// The others are written to files named after them, which
+			// must neither be those of the first one, id-ca.pem, nor
+			// collide on case-insensitive file systems.
+			if i > 0 && strings.EqualFold(resource.Name, reservedValidationContextName) {
+				return nil, fmt.Errorf("Invalid name %q of sds server validation context, only the first one may use the files of %q", resource.Name, reservedValidationContextName)
+			}
+			if names[strings.ToLower(resource.Name)] {
+				return nil, fmt.Errorf("Duplicate sds server validation context %q", resource.Name)
+			}
+			names[strings.ToLower(resource.Name)] = true
+		}
+
+		matchers, err := resource.ValidationContext.sanMatchers()
+		if err != nil {
+			return nil, fmt.Errorf("Invalid subject alt name matchers in sds server validation context: resources[%d]: %s", i, err)
+		}
+
+		contexts = append(contexts, SdsValidationContext{
+			Name:        resource.Name,
+			CA:          resource.ValidationContext.TrustedCA.InlineString,
+			SANMatchers: matchers,
+		})
+	}
+
+	return contexts, nil
+}
+
+/* Returns the version_info of the SDS file and a hash of the ca certs and san matchers */
+func (p sdsIdValidationParser) Fingerprint() (SdsFingerprint, error) {
+	auth, err := p.read()
+	if err != nil {
+		return SdsFingerprint{}, err
+	}
+
+	material := []string{}
+	for _, resource := range auth.Resources {
+		validationContext := resource.ValidationContext
+		matchers, err := json.Marshal([]interface{}{
+			validationContext.VerifySubjectAltName,
+			validationContext.MatchSubjectAltNames,
+			validationContext.MatchTypedSubjectAltNames,
+		})
+		if err != nil {
+			return SdsFingerprint{}, fmt.Errorf("Failed to marshal sds server validation context: %s", err)
+		}
+		material = append(material, resource.Name, validationContext.TrustedCA.InlineString, string(matchers))
+	}
+
+	return newSdsFingerprint(auth.VersionInfo, material...), nil
+}
+
+func (p sdsIdValidationParser) read() (SdsIdValidation, error) {
 	contents, err := os.ReadFile(p.file)
 	if err != nil {
-		return "", fmt.Errorf("Failed to read sds server validation context: %s", err)
+		return SdsIdValidation{}, fmt.Errorf("Failed to read sds server validation context: %s", err)
 	}
 
 	auth := SdsIdValidation{}
 
 	err = yaml.Unmarshal(contents, &auth)
 	if err != nil {
-		return "", fmt.Errorf("Failed to unmarshal sds server validation context: %s", err)
+		return SdsIdValidation{}, fmt.Errorf("Failed to unmarshal sds server validation context: %s", err)
 	}
 
 	if len(auth.Resources) < 1 {
-		return "", errors.New("resources section not found in sds-server-validation-context.yaml")
+		return SdsIdValidation{}, errors.New("resources section not found in sds-server-validation-context.yaml")
 	}
 
-	ca := auth.Resources[0].ValidationContext.TrustedCA.InlineString
-
-	return ca, nil
+	return auth, nil
 }
@@ -18,13 +18,209 @@ var _ = Describe("SdsIdValidationParser", func() {
 		sdsIdValidationParser = parser.NewSdsIdValidationParser(sdsIdValidationFile)
 	})
 
-	Describe("GetCACert", func() {
-		It("reads the sds file and returns the trusted ca cert", func() {
-			cert, err := sdsIdValidationParser.GetCACert()
+	Describe("Fingerprint", func() {
+		It("returns the version_info and a hash of the ca cert", func() {
+			fingerprint, err := sdsIdValidationParser.Fingerprint()
 			Expect(err).NotTo(HaveOccurred())
-			Expect(cert).To(ContainSubstring("-----BEGIN CERTIFICATE-----"))
+			Expect(fingerprint.VersionInfo).To(Equal("0"))
+			Expect(fingerprint.Hash).To(HaveLen(64))
 		})
 
+		It("changes when the san matchers change", func() {
+			sdsFile := writeValidationContext(`
+    verify_subject_alt_name:
+    - gorouter.service.cf.internal`)
+			defer os.Remove(sdsFile)
+			fingerprint, err := parser.NewSdsIdValidationParser(sdsFile).Fingerprint()
+			Expect(err).NotTo(HaveOccurred())
+
+			changedFile := writeValidationContext(`
+    verify_subject_alt_name:
+    - banana.service.cf.internal`)
+			defer os.Remove(changedFile)
+			changed, err := parser.NewSdsIdValidationParser(changedFile).Fingerprint()
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(changed.Hash).NotTo(Equal(fingerprint.Hash))
+		})
+
+		It("changes when the ca cert is rotated", func() {
+			fingerprint, err := sdsIdValidationParser.Fingerprint()
+			Expect(err).NotTo(HaveOccurred())
+
+			rotated, err := parser.NewSdsIdValidationParser("../fixtures/cf_assets_envoy_config/sds-id-validation-context-rotated.yaml").Fingerprint()
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(rotated.Hash).NotTo(Equal(fingerprint.Hash))
+		})
+
+		Context("when sdsCreds doesn't exist", func() {
+			BeforeEach(func() {
+				sdsIdValidationParser = parser.NewSdsIdValidationParser("not-a-real-file")
+			})
+
+			It("should return a read error", func() {
+				_, err := sdsIdValidationParser.Fingerprint()
+				Expect(err.Error()).To(ContainSubstring("Failed to read sds server validation context:"))
+			})
+		})
+	})
+
+	Describe("GetValidationContexts", func() {
+		It("reads the sds file and returns the validation context", func() {
+			contexts, err := sdsIdValidationParser.GetValidationContexts()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(contexts).To(HaveLen(1))
+			Expect(contexts[0].Name).To(Equal("server-validation-context"))
+			Expect(contexts[0].CA).To(ContainSubstring("-----BEGIN CERTIFICATE-----"))
+		})
+
+		It("returns verify_subject_alt_name as exact matchers", func() {
+			contexts, err := sdsIdValidationParser.GetValidationContexts()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(contexts[0].SANMatchers).To(Equal([]parser.SANMatcher{
+				{Kind: "exact", Value: "gorouter.service.cf.internal"},
+			}))
+		})
+
+		Context("when the sds file has several validation contexts", func() {
+			var sdsFile string
+
+			BeforeEach(func() {
+				sdsFile = writeValidationContext(`
+    verify_subject_alt_name:
+    - gorouter.service.cf.internal
+- '@type': type.googleapis.com/envoy.api.v2.auth.Secret
+  name: c2c-validation-context
+  validation_context:
+    trusted_ca:
+      inline_string: some-c2c-ca-cert`)
+				sdsIdValidationParser = parser.NewSdsIdValidationParser(sdsFile)
+			})
+
+			AfterEach(func() {
+				os.Remove(sdsFile)
+			})
+
+			It("returns every one of them by name", func() {
+				contexts, err := sdsIdValidationParser.GetValidationContexts()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(contexts).To(Equal([]parser.SdsValidationContext{
+					{
+						Name:        "server-validation-context",
+						CA:          "some-ca-cert",
+						SANMatchers: []parser.SANMatcher{{Kind: "exact", Value: "gorouter.service.cf.internal"}},
+					},
+					{
+						Name:        "c2c-validation-context",
+						CA:          "some-c2c-ca-cert",
+						SANMatchers: []parser.SANMatcher{},
+					},
+				}))
+			})
+		})
+
+		DescribeTable("when a validation context has an invalid name",
+			func(name, message string) {
+				sdsFile := writeValidationContext(`
+- '@type': type.googleapis.com/envoy.api.v2.auth.Secret
+  name: ` + name + `
+  validation_context:
+    trusted_ca:
+      inline_string: some-c2c-ca-cert`)
+				defer os.Remove(sdsFile)
+
+				_, err := parser.NewSdsIdValidationParser(sdsFile).GetValidationContexts()
+				Expect(err).To(MatchError(message))
+			},
+			Entry("without a name", `""`, `Invalid name "" of sds server validation context, expected letters, digits, '.', '-' and '_'`),
+			Entry("with a path", "../c2c", `Invalid name "../c2c" of sds server validation context, expected letters, digits, '.', '-' and '_'`),
+			Entry("with a duplicate name", "server-validation-context", `Duplicate sds server validation context "server-validation-context"`),
+			Entry("with a name that differs only in case", "Server-Validation-Context", `Duplicate sds server validation context "Server-Validation-Context"`),
+			Entry("with the name of the files of the first one", "id", `Invalid name "id" of sds server validation context, only the first one may use the files of "id"`),
+		)
+
+		Context("when the validation context has string matchers", func() {
+			var sdsFile string
+
+			BeforeEach(func() {
+				sdsFile = writeValidationContext(`
+    match_subject_alt_names:
+    - exact: gorouter.service.cf.internal
+    - prefix: spiffe://cf/
+      ignore_case: true
+    - suffix: .apps.internal
+    - contains: router
+    - safe_regex:
+        google_re2: {}
+        regex: 10\.0\.0\.[0-9]+
+    match_typed_subject_alt_names:
+    - san_type: IP_ADDRESS
+      matcher:
+        exact: 10.0.0.1
+    - san_type: URI
+      matcher:
+        prefix: spiffe://cf/`)
+				sdsIdValidationParser = parser.NewSdsIdValidationParser(sdsFile)
+			})
+
+			AfterEach(func() {
+				os.Remove(sdsFile)
+			})
+
+			It("returns a matcher for each of them", func() {
+				contexts, err := sdsIdValidationParser.GetValidationContexts()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(contexts[0].SANMatchers).To(Equal([]parser.SANMatcher{
+					{Kind: "exact", Value: "gorouter.service.cf.internal"},
+					{Kind: "prefix", Value: "spiffe://cf/", IgnoreCase: true},
+					{Kind: "suffix", Value: ".apps.internal"},
+					{Kind: "contains", Value: "router"},
+					{Kind: "regex", Value: `10\.0\.0\.[0-9]+`},
+					{Type: "IP_ADDRESS", Kind: "exact", Value: "10.0.0.1"},
+					{Type: "URI", Kind: "prefix", Value: "spiffe://cf/"},
+				}))
+			})
+		})
+
+		DescribeTable("when a matcher cannot be enforced",
+			func(validationContext, message string) {
+				sdsFile := writeValidationContext(validationContext)
+				defer os.Remove(sdsFile)
+
+				_, err := parser.NewSdsIdValidationParser(sdsFile).GetValidationContexts()
+				Expect(err).To(MatchError("Invalid subject alt name matchers in sds server validation context: resources[0]: " + message))
+			},
+			Entry("without a match", `
+    match_subject_alt_names:
+    - ignore_case: true`, "match_subject_alt_names[0]: expected exactly one of exact, prefix, suffix, contains or safe_regex, got 0"),
+			Entry("with two matches", `
+    match_subject_alt_names:
+    - exact: a
+      prefix: b`, "match_subject_alt_names[0]: expected exactly one of exact, prefix, suffix, contains or safe_regex, got 2"),
+			Entry("with an invalid regex", `
+    match_subject_alt_names:
+    - safe_regex:
+        regex: "("`, "match_subject_alt_names[0]: invalid safe_regex: error parsing regexp: missing closing ): `(`"),
+			Entry("with a regex flag group", `
+    match_subject_alt_names:
+    - safe_regex:
+        regex: "(?i)gorouter"`, "match_subject_alt_names[0]: unsupported safe_regex: flag and named groups are not supported in javascript"),
+			Entry("with a regex end of text", `
+    match_subject_alt_names:
+    - safe_regex:
+        regex: 'gorouter\z'`, `match_subject_alt_names[0]: unsupported safe_regex: \z is not supported in javascript`),
+			Entry("with a regex ascii character class", `
+    match_subject_alt_names:
+    - safe_regex:
+        regex: "[[:alpha:]]+"`, "match_subject_alt_names[0]: unsupported safe_regex: ascii character classes are not supported in javascript"),
+			Entry("with an unsupported san type", `
+    match_typed_subject_alt_names:
+    - san_type: OTHER_NAME
+      matcher:
+        exact: a`, `match_typed_subject_alt_names[0]: unsupported san_type "OTHER_NAME", expected DNS, URI, EMAIL or IP_ADDRESS`),
+		)
+
 		Context("when the resources section is not found", func() {
 			var invalidSdsFile string
 
@@ -43,7 +239,7 @@ var _ = Describe("SdsIdValidationParser", func() {
 			})
 
 			It("returns a helpful error", func() {
-				_, err := sdsIdValidationParser.GetCACert()
+				_, err := sdsIdValidationParser.GetValidationContexts()
 				Expect(err).To(MatchError("resources section not found in sds-server-validation-context.yaml"))
 			})
 		})
@@ -53,7 +249,7 @@ var _ = Describe("SdsIdValidationParser", func() {
 				sdsIdValidationParser = parser.NewSdsIdValidationParser("not-a-real-file")
 			})
 			It("should return a read error", func() {
-				_, err := sdsIdValidationParser.GetCACert()
+				_, err := sdsIdValidationParser.GetValidationContexts()
 				Expect(err.Error()).To(ContainSubstring("Failed to read sds server validation context:"))
 			})
 		})
@@ -76,9 +272,27 @@ var _ = Describe("SdsIdValidationParser", func() {
 			})
 
 			It("should return unmarshal error", func() {
-				_, err := sdsIdValidationParser.GetCACert()
+				_, err := sdsIdValidationParser.GetValidationContexts()
 				Expect(err.Error()).To(ContainSubstring("Failed to unmarshal sds server validation context: yaml: could not find expected directive name"))
 			})
 		})
 	})
 })
+
+// Writes an sds validation context with the given fields next to
+// trusted_ca to a temp file.
+func writeValidationContext(fields string) string {
+	tmpFile, err := os.CreateTemp(os.TempDir(), "sds-id-validation-context.yaml")
+	Expect(err).NotTo(HaveOccurred())
+	defer tmpFile.Close()
+
+	_, err = tmpFile.WriteString(`resources:
+- '@type': type.googleapis.com/envoy.api.v2.auth.Secret
+  name: server-validation-context
+  validation_context:
+    trusted_ca:
+      inline_string: some-ca-cert` + fields + "\n")
+	Expect(err).NotTo(HaveOccurred())
+
+	return tmpFile.Name()
+}
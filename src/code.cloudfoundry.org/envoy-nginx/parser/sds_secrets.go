@@ -0,0 +1,47 @@
+package parser
+
+import "regexp"
+
+// The secrets diego hands the instance identity and the container to
+// container cert and key in.
+const (
+	IdSecretName  = "id-cert-and-key"
+	C2CSecretName = "c2c-cert-and-key"
+)
+
+// Names end up in file names, so they must not contain separators.
+var secretName = regexp.MustCompile(`^[A-Za-z0-9_-][A-Za-z0-9._-]*$`)
+
+/*
+* Resolves tls certificate secrets to the sds files their cert and key
+* are read from, so that a new kind of secret only needs an sds file,
+* not a change to envoy-nginx. The first of these that applies wins:
+*  - the file passed for the secret's name with --sds-secret
+*  - the file passed with --c2c-creds, for c2c-cert-and-key
+*  - the file passed with --id-creds, for id-cert-and-key
+*  - the secret's sds_config.path, even if that file does not exist yet
+* Only the names of the secrets and the flags decide, no file is read,
+* so a half written sds file cannot rebind a secret to another file.
+ */
+type SdsSecrets struct {
+	Files    map[string]string
+	C2CCreds string
+	IdCreds  string
+}
+
+// Returns the sds file of the secret, false if there is none.
+func (s SdsSecrets) Resolve(secret TLSCertificateSdsSecretConfig) (string, bool) {
+	if file, ok := s.Files[secret.Name]; ok {
+		return file, true
+	}
+
+	if secret.Name == C2CSecretName && s.C2CCreds != "" {
+		return s.C2CCreds, true
+	}
+
+	if secret.Name == IdSecretName && s.IdCreds != "" {
+		return s.IdCreds, true
+	}
+
+	return secret.SdsConfig.Path, secret.SdsConfig.Path != ""
+}
@@ -0,0 +1,96 @@
+package parser_test
+
+import (
+	"code.cloudfoundry.org/envoy-nginx/parser"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("SdsSecrets", func() {
+	const idCreds = "../fixtures/cf_assets_envoy_config/sds-id-cert-and-key.yaml"
+
+	var sdsSecrets parser.SdsSecrets
+
+	BeforeEach(func() {
+		sdsSecrets = parser.SdsSecrets{
+			Files:    map[string]string{"server-cert-and-key": "some-server-file"},
+			C2CCreds: "some-c2c-file",
+			IdCreds:  idCreds,
+		}
+	})
+
+	Describe("Resolve", func() {
+		It("returns the file passed for the name of the secret", func() {
+			file, ok := sdsSecrets.Resolve(parser.TLSCertificateSdsSecretConfig{
+				Name:      "server-cert-and-key",
+				SdsConfig: parser.SdsConfig{Path: "some-sds-config-path"},
+			})
+			Expect(ok).To(BeTrue())
+			Expect(file).To(Equal("some-server-file"))
+		})
+
+		It("returns the c2c creds for the c2c secret", func() {
+			file, ok := sdsSecrets.Resolve(parser.TLSCertificateSdsSecretConfig{Name: parser.C2CSecretName})
+			Expect(ok).To(BeTrue())
+			Expect(file).To(Equal("some-c2c-file"))
+		})
+
+		It("returns the id creds for the id secret", func() {
+			file, ok := sdsSecrets.Resolve(parser.TLSCertificateSdsSecretConfig{
+				Name:      parser.IdSecretName,
+				SdsConfig: parser.SdsConfig{Path: "some-sds-config-path"},
+			})
+			Expect(ok).To(BeTrue())
+			Expect(file).To(Equal(idCreds))
+		})
+
+		Context("when the id creds cannot be read", func() {
+			BeforeEach(func() {
+				sdsSecrets.IdCreds = "not-a-real-file"
+			})
+
+			It("still returns them for the id secret, so that reading them fails later", func() {
+				file, ok := sdsSecrets.Resolve(parser.TLSCertificateSdsSecretConfig{
+					Name:      parser.IdSecretName,
+					SdsConfig: parser.SdsConfig{Path: "some-sds-config-path"},
+				})
+				Expect(ok).To(BeTrue())
+				Expect(file).To(Equal("not-a-real-file"))
+			})
+		})
+
+		It("does not return the id creds for other secrets", func() {
+			file, ok := sdsSecrets.Resolve(parser.TLSCertificateSdsSecretConfig{
+				Name:      "other-cert-and-key",
+				SdsConfig: parser.SdsConfig{Path: "some-sds-config-path"},
+			})
+			Expect(ok).To(BeTrue())
+			Expect(file).To(Equal("some-sds-config-path"))
+		})
+
+		It("returns the sds_config path of other secrets, even if that file does not exist yet", func() {
+			file, ok := sdsSecrets.Resolve(parser.TLSCertificateSdsSecretConfig{
+				Name:      "other-cert-and-key",
+				SdsConfig: parser.SdsConfig{Path: "not-a-real-file"},
+			})
+			Expect(ok).To(BeTrue())
+			Expect(file).To(Equal("not-a-real-file"))
+		})
+
+		It("returns false for secrets without a file", func() {
+			_, ok := sdsSecrets.Resolve(parser.TLSCertificateSdsSecretConfig{Name: "other-cert-and-key"})
+			Expect(ok).To(BeFalse())
+		})
+
+		Context("when there are no c2c creds", func() {
+			BeforeEach(func() {
+				sdsSecrets.C2CCreds = ""
+			})
+
+			It("does not fall back to the id creds for the c2c secret", func() {
+				_, ok := sdsSecrets.Resolve(parser.TLSCertificateSdsSecretConfig{Name: parser.C2CSecretName})
+				Expect(ok).To(BeFalse())
+			})
+		})
+	})
+})
@@ -0,0 +1,71 @@
+package parser
+
+import "strings"
+
+// envoy tls protocol versions, oldest first, and their nginx names.
+var tlsVersions = []struct {
+	envoy string
+	nginx string
+}{
+	{"TLSv1_0", "TLSv1"},
+	{"TLSv1_1", "TLSv1.1"},
+	{"TLSv1_2", "TLSv1.2"},
+	{"TLSv1_3", "TLSv1.3"},
+}
+
+// What envoy uses for TLS_AUTO or no version on the server side.
+const (
+	defaultTLSMinimumProtocolVersion = "TLSv1_2"
+	defaultTLSMaximumProtocolVersion = "TLSv1_3"
+)
+
+// Returns the position of an envoy tls version in tlsVersions,
+// -1 if it is not one.
+func tlsVersionIndex(version, auto string) int {
+	if version == "" || version == "TLS_AUTO" {
+		version = auto
+	}
+	for i, v := range tlsVersions {
+		if v.envoy == version {
+			return i
+		}
+	}
+	return -1
+}
+
+// Returns the nginx ssl_protocols for envoy's minimum and maximum
+// protocol versions, nil if either is invalid.
+func sslProtocols(params TLSParams) []string {
+	min := tlsVersionIndex(params.TLSMinimumProtocolVersion, defaultTLSMinimumProtocolVersion)
+	max := tlsVersionIndex(params.TLSMaximumProtocolVersion, defaultTLSMaximumProtocolVersion)
+	if min < 0 || max < 0 {
+		return nil
+	}
+
+	protocols := []string{}
+	for _, v := range tlsVersions[min : max+1] {
+		protocols = append(protocols, v.nginx)
+	}
+	return protocols
+}
+
+// TLS 1.3 cipher suites are all named TLS_*, OpenSSL configures
+// them apart from the ones of older versions.
+func isTLS13CipherSuite(cipherSuite string) bool {
+	return strings.HasPrefix(cipherSuite, "TLS_")
+}
+
+// Splits OpenSSL cipher names into the ssl_ciphers for TLS 1.2
+// and older and the Ciphersuites for TLS 1.3.
+func splitCipherSuites(cipherSuites []string) (ciphers, tls13Ciphersuites string) {
+	older := []string{}
+	tls13 := []string{}
+	for _, cipherSuite := range cipherSuites {
+		if isTLS13CipherSuite(cipherSuite) {
+			tls13 = append(tls13, cipherSuite)
+		} else {
+			older = append(older, cipherSuite)
+		}
+	}
+	return strings.Join(older, ":"), strings.Join(tls13, ":")
+}
@@ -0,0 +1,85 @@
+package parser
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Translates the typed_config of a filter or transport socket
+// into what it means for the nginx server of its listener.
+type TypedConfigTranslator interface {
+	Translate(listener *ListenerInfo)
+}
+
+/*
+* Type names without the type.googleapis.com/ prefix, mapped to a
+* constructor of the struct the typed_config is unmarshalled into.
+* v2 and v3 names of the same message share a struct, the fields we
+* read did not change between them.
+ */
+var typedConfigs = map[string]func() TypedConfigTranslator{
+	"envoy.config.filter.network.tcp_proxy.v2.TcpProxy":              func() TypedConfigTranslator { return &TypedConfigTcpProxy{} },
+	"envoy.extensions.filters.network.tcp_proxy.v3.TcpProxy":         func() TypedConfigTranslator { return &TypedConfigTcpProxy{} },
+	"envoy.api.v2.auth.DownstreamTlsContext":                         func() TypedConfigTranslator { return &TypedConfigDownstreamTlsContext{} },
+	"envoy.extensions.transport_sockets.tls.v3.DownstreamTlsContext": func() TypedConfigTranslator { return &TypedConfigDownstreamTlsContext{} },
+}
+
+// Adds a translator for typed_configs of the given type, so that
+// new filters and transport sockets need no change to GetClusters.
+// Type names are given with or without the type.googleapis.com/ prefix.
+func RegisterTypedConfig(typeURL string, newConfig func() TypedConfigTranslator) {
+	typedConfigs[typeName(typeURL)] = newConfig
+}
+
+func typeName(typeURL string) string {
+	return typeURL[strings.LastIndex(typeURL, "/")+1:]
+}
+
+// A typed_config, unmarshalled into the struct registered for its
+// @type. Config is nil if the @type is not registered, the
+// config is then left alone rather than guessed at.
+type TypedConfig struct {
+	Type   string
+	Config TypedConfigTranslator
+}
+
+func (t *TypedConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	typeURL := struct {
+		Type string `yaml:"@type"`
+	}{}
+	err := unmarshal(&typeURL)
+	if err != nil {
+		return err
+	}
+	t.Type = typeURL.Type
+
+	newConfig, ok := typedConfigs[typeName(t.Type)]
+	if !ok {
+		return nil
+	}
+
+	config := newConfig()
+	err = unmarshal(config)
+	if err != nil {
+		return fmt.Errorf("unmarshal %s: %s", t.Type, err)
+	}
+	t.Config = config
+
+	return nil
+}
+
+func (t TypedConfigTcpProxy) Translate(listener *ListenerInfo) {
+	listener.Cluster = t.Cluster
+	listener.IdleTimeout = t.IdleTimeout.Duration
+	listener.MaxConnectionDuration = t.MaxDownstreamConnectionDuration.Duration
+}
+
+func (t TypedConfigDownstreamTlsContext) Translate(listener *ListenerInfo) {
+	listener.MTLS = t.RequireClientCertificate
+	listener.ValidationContext = t.CommonTLSContext.ValidationContextSdsSecretConfig.Name
+	tlsParams := t.CommonTLSContext.TLSParams
+	listener.Ciphers, listener.TLS13Ciphersuites = splitCipherSuites(translateCipherSuites(tlsParams.CipherSuites))
+	listener.Protocols = sslProtocols(tlsParams)
+	listener.ECDHCurves = strings.Join(tlsParams.ECDHCurves, ":")
+	listener.CertificateSecrets = t.CommonTLSContext.TLSCertificateSdsSecretConfigs
+}
@@ -0,0 +1,130 @@
+package parser_test
+
+import (
+	"time"
+
+	"code.cloudfoundry.org/envoy-nginx/parser"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	yaml "gopkg.in/yaml.v2"
+)
+
+type fakeFilter struct {
+	Upstream string `yaml:"upstream"`
+}
+
+func (f fakeFilter) Translate(listener *parser.ListenerInfo) {
+	listener.Cluster = f.Upstream
+}
+
+var _ = Describe("TypedConfig", func() {
+	unmarshal := func(typedConfig string) parser.TypedConfig {
+		config := parser.TypedConfig{}
+		Expect(yaml.Unmarshal([]byte(typedConfig), &config)).To(Succeed())
+		return config
+	}
+
+	DescribeTable("unmarshals v2 and v3 types into the same struct",
+		func(typeURL string, expected parser.TypedConfigTranslator) {
+			config := unmarshal("'@type': " + typeURL + "\ncluster: some-cluster\nrequire_client_certificate: true\n")
+			Expect(config.Type).To(Equal(typeURL))
+			Expect(config.Config).To(Equal(expected))
+		},
+		Entry(nil, "type.googleapis.com/envoy.config.filter.network.tcp_proxy.v2.TcpProxy", &parser.TypedConfigTcpProxy{Cluster: "some-cluster"}),
+		Entry(nil, "type.googleapis.com/envoy.extensions.filters.network.tcp_proxy.v3.TcpProxy", &parser.TypedConfigTcpProxy{Cluster: "some-cluster"}),
+		Entry(nil, "type.googleapis.com/envoy.api.v2.auth.DownstreamTlsContext", &parser.TypedConfigDownstreamTlsContext{RequireClientCertificate: true}),
+		Entry(nil, "type.googleapis.com/envoy.extensions.transport_sockets.tls.v3.DownstreamTlsContext", &parser.TypedConfigDownstreamTlsContext{RequireClientCertificate: true}),
+	)
+
+	Describe("DownstreamTlsContext", func() {
+		translate := func(tlsParams string) parser.ListenerInfo {
+			config := unmarshal("'@type': type.googleapis.com/envoy.extensions.transport_sockets.tls.v3.DownstreamTlsContext\ncommon_tls_context:\n  tls_params:\n" + tlsParams)
+			listener := parser.ListenerInfo{}
+			config.Config.Translate(&listener)
+			return listener
+		}
+
+		DescribeTable("translates the protocol versions into nginx protocols",
+			func(tlsParams string, protocols []string) {
+				Expect(translate(tlsParams).Protocols).To(Equal(protocols))
+			},
+			Entry("by default", "    {}\n", []string{"TLSv1.2", "TLSv1.3"}),
+			Entry("with TLS_AUTO", "    tls_minimum_protocol_version: TLS_AUTO\n    tls_maximum_protocol_version: TLS_AUTO\n", []string{"TLSv1.2", "TLSv1.3"}),
+			Entry("with a minimum", "    tls_minimum_protocol_version: TLSv1_0\n", []string{"TLSv1", "TLSv1.1", "TLSv1.2", "TLSv1.3"}),
+			Entry("with a maximum", "    tls_maximum_protocol_version: TLSv1_2\n", []string{"TLSv1.2"}),
+			Entry("with TLS 1.3 only", "    tls_minimum_protocol_version: TLSv1_3\n", []string{"TLSv1.3"}),
+		)
+
+		It("translates BoringSSL cipher suites to OpenSSL names", func() {
+			listener := translate(`    cipher_suites:
+    - "[ECDHE-ECDSA-AES128-GCM-SHA256|ECDHE-ECDSA-CHACHA20-POLY1305]"
+    - TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256
+    - ECDHE-RSA-CHACHA20-POLY1305-OLD
+    - AES256-SHA
+`)
+			Expect(listener.Ciphers).To(Equal("ECDHE-ECDSA-AES128-GCM-SHA256:ECDHE-ECDSA-CHACHA20-POLY1305:ECDHE-RSA-AES128-GCM-SHA256:AES256-SHA"))
+		})
+
+		It("splits the cipher suites of TLS 1.3 from the older ones and joins the curves", func() {
+			listener := translate(`    cipher_suites:
+    - ECDHE-RSA-AES256-GCM-SHA384
+    - TLS_AES_256_GCM_SHA384
+    - ECDHE-RSA-AES128-GCM-SHA256
+    - TLS_CHACHA20_POLY1305_SHA256
+    ecdh_curves:
+    - X25519
+    - P-256
+`)
+			Expect(listener.Ciphers).To(Equal("ECDHE-RSA-AES256-GCM-SHA384:ECDHE-RSA-AES128-GCM-SHA256"))
+			Expect(listener.TLS13Ciphersuites).To(Equal("TLS_AES_256_GCM_SHA384:TLS_CHACHA20_POLY1305_SHA256"))
+			Expect(listener.ECDHCurves).To(Equal("X25519:P-256"))
+		})
+	})
+
+	Context("when the type is not registered", func() {
+		It("keeps the type and leaves the config alone", func() {
+			config := unmarshal("'@type': type.googleapis.com/envoy.extensions.filters.network.echo.v3.Echo\ncluster: some-cluster\n")
+			Expect(config.Type).To(Equal("type.googleapis.com/envoy.extensions.filters.network.echo.v3.Echo"))
+			Expect(config.Config).To(BeNil())
+		})
+	})
+
+	Context("when a type is registered", func() {
+		BeforeEach(func() {
+			parser.RegisterTypedConfig("type.googleapis.com/test.FakeFilter", func() parser.TypedConfigTranslator {
+				return &fakeFilter{}
+			})
+		})
+
+		It("translates it into the listeners returned by GetClusters", func() {
+			conf := parser.EnvoyConf{}
+			Expect(yaml.Unmarshal([]byte(`
+static_resources:
+  listeners:
+  - address:
+      socket_address:
+        port_value: 61001
+    filter_chains:
+    - filters:
+      - typed_config:
+          "@type": type.googleapis.com/envoy.config.filter.network.tcp_proxy.v2.TcpProxy
+          cluster: other-cluster
+          idle_timeout: 3600s
+          max_downstream_connection_duration: 60s
+      - typed_config:
+          "@type": type.googleapis.com/test.FakeFilter
+          upstream: some-cluster
+      transport_socket_connect_timeout: 10s
+      transport_socket:
+        typed_config:
+          "@type": type.googleapis.com/envoy.api.v2.auth.DownstreamTlsContext
+          require_client_certificate: true
+`), &conf)).To(Succeed())
+
+			_, nameToListeners := parser.NewEnvoyConfParser().GetClusters(conf)
+			Expect(nameToListeners["some-cluster"]).To(Equal([]parser.ListenerInfo{
+				{Port: "61001", Cluster: "some-cluster", MTLS: true, Protocols: []string{"TLSv1.2", "TLSv1.3"}, IdleTimeout: time.Hour, HandshakeTimeout: 10 * time.Second, MaxConnectionDuration: time.Minute},
+			}))
+		})
+	})
+})